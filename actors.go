@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// uniqueIDs maps the unique IDs of the entities of a world to the unique IDs
+// they get in the merged world. Unique IDs not in the map are kept.
+type uniqueIDs map[int64]int64
+
+// assignUniqueIDs gives the entities of every world unique IDs that no other
+// world uses, as entities in actor storage are stored under their unique ID.
+// Worlds keep their unique IDs in the order passed, so that the merged world
+// is the same every time. A unique ID used by an earlier world is replaced with
+// one above those of all worlds. It returns the number of unique IDs replaced.
+func assignUniqueIDs(worlds []*worldMap) int {
+	all := make(map[int64]struct{})
+	var next int64
+	for _, w := range worlds {
+		for _, id := range w.manifest.Actors {
+			all[id] = struct{}{}
+			if id > next {
+				next = id
+			}
+		}
+	}
+	owners := make(map[int64]*worldMap, len(all))
+	replaced := 0
+	for _, w := range worlds {
+		w.ids = nil
+		for _, id := range w.manifest.Actors {
+			owner, ok := owners[id]
+			if !ok {
+				owners[id] = w
+				continue
+			} else if owner == w {
+				continue
+			}
+			if _, ok := w.ids[id]; ok {
+				continue
+			}
+			for {
+				next++
+				if _, used := all[next]; !used {
+					break
+				}
+			}
+			if w.ids == nil {
+				w.ids = make(uniqueIDs)
+			}
+			w.ids[id] = next
+			replaced++
+		}
+	}
+	return replaced
+}
+
+// uid returns the unique ID uid, encoded as in actor keys and digests, as it
+// is in the merged world.
+func (ids uniqueIDs) uid(uid []byte) []byte {
+	if id, ok := ids[int64(binary.LittleEndian.Uint64(uid))]; ok {
+		return binary.LittleEndian.AppendUint64(nil, uint64(id))
+	}
+	return uid
+}
+
+// digest returns the actor digest digp with the unique IDs as they are in the
+// merged world.
+func (ids uniqueIDs) digest(digp []byte) []byte {
+	if len(ids) == 0 {
+		return digp
+	}
+	out := make([]byte, 0, len(digp))
+	for i := 0; i+8 <= len(digp); i += 8 {
+		out = append(out, ids.uid(digp[i:i+8])...)
+	}
+	return out
+}
+
+// entity sets the unique ID stored in the entity m to the one it has in the
+// merged world, together with the unique IDs of the entities it refers to: the
+// leash knot or mob it is leashed to and the entities riding it.
+func (ids uniqueIDs) entity(m map[string]any) {
+	ids.field(m, "UniqueID")
+	ids.field(m, "LeasherID")
+	links, _ := m["LinksTag"].([]any)
+	for _, l := range links {
+		if l, ok := l.(map[string]any); ok {
+			ids.field(l, "entityID")
+		}
+	}
+}
+
+// field replaces the unique ID stored as a long under key in m.
+func (ids uniqueIDs) field(m map[string]any, key string) {
+	if id, ok := m[key].(int64); ok {
+		if n, ok := ids[id]; ok {
+			m[key] = n
+		}
+	}
+}
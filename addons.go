@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// unknownPolicy decides what happens to blocks and entities with identifiers
+// that no pack of the merged world defines.
+type unknownPolicy string
+
+const (
+	// unknownNone doesn't check identifiers at all.
+	unknownNone unknownPolicy = "none"
+	// unknownReport reports the chunks holding undefined identifiers and
+	// copies them unchanged.
+	unknownReport unknownPolicy = "report"
+	// unknownPlaceholder replaces undefined blocks with a placeholder block
+	// and drops undefined entities.
+	unknownPlaceholder unknownPolicy = "placeholder"
+	// unknownDrop replaces undefined blocks with air and drops undefined
+	// entities.
+	unknownDrop unknownPolicy = "drop"
+)
+
+func parseUnknownPolicy(s string) (unknownPolicy, error) {
+	switch p := unknownPolicy(s); p {
+	case unknownNone, unknownReport, unknownPlaceholder, unknownDrop:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown policy for undefined identifiers %q", s)
+}
+
+// addonRegistry holds the identifiers of the custom blocks and entities
+// defined by the behavior packs of the merged world. Identifiers in the
+// minecraft namespace are always defined.
+type addonRegistry struct {
+	blocks   map[string]bool
+	entities map[string]bool
+}
+
+// addonDefinition holds the fields of a block or entity definition of a
+// behavior pack that hold its identifier.
+type addonDefinition struct {
+	Block *struct {
+		Description struct {
+			Identifier string `json:"identifier"`
+		} `json:"description"`
+	} `json:"minecraft:block"`
+	Entity *struct {
+		Description struct {
+			Identifier string `json:"identifier"`
+		} `json:"description"`
+	} `json:"minecraft:entity"`
+}
+
+// loadAddonRegistry reads the block and entity definitions of the behavior
+// packs in packs. Definitions that can't be read are skipped with a warning.
+func loadAddonRegistry(packs packSet) (*addonRegistry, error) {
+	reg := &addonRegistry{blocks: make(map[string]bool), entities: make(map[string]bool)}
+	for _, p := range packs[behaviorPacks] {
+		if p.archive == "" {
+			continue
+		}
+		if err := reg.loadPack(p); err != nil {
+			return nil, err
+		}
+	}
+	if len(reg.blocks) > 0 || len(reg.entities) > 0 {
+		logrus.Infof("Behavior packs define %d custom blocks and %d custom entities", len(reg.blocks), len(reg.entities))
+	}
+	return reg, nil
+}
+
+// loadPack adds the definitions in the blocks and entities folders of p.
+func (reg *addonRegistry) loadPack(p *pack) error {
+	zr, err := zip.OpenReader(p.archive)
+	if err != nil {
+		return &zipError{Archive: p.archive, Err: err}
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		name, err := entryPath(f.Name)
+		if err != nil {
+			return &zipError{Archive: p.archive, Entry: f.Name, Err: err}
+		}
+		rel, ok := strings.CutPrefix(name, p.dir+"/")
+		if !ok || path.Ext(rel) != ".json" || !f.Mode().IsRegular() {
+			continue
+		}
+		if folder, _, _ := strings.Cut(rel, "/"); folder != "blocks" && folder != "entities" {
+			continue
+		}
+		data, err := readZipFile(&zr.Reader, name)
+		if err != nil {
+			return &zipError{Archive: p.archive, Entry: f.Name, Err: err}
+		}
+		var def addonDefinition
+		if err := json.Unmarshal(stripJSONComments(data), &def); err != nil {
+			logrus.Warnf("%s: %s: %v", p.archive, f.Name, err)
+			continue
+		}
+		if def.Block != nil && def.Block.Description.Identifier != "" {
+			reg.blocks[def.Block.Description.Identifier] = true
+		}
+		if def.Entity != nil && def.Entity.Description.Identifier != "" {
+			reg.entities[def.Entity.Description.Identifier] = true
+		}
+	}
+	return nil
+}
+
+// vanillaIdentifier checks if id is in the minecraft namespace. Identifiers
+// without a namespace belong to it as well.
+func vanillaIdentifier(id string) bool {
+	ns, _, found := strings.Cut(id, ":")
+	return !found || ns == "minecraft"
+}
+
+// block checks if the block id is defined.
+func (reg *addonRegistry) block(id string) bool {
+	return vanillaIdentifier(id) || reg.blocks[id]
+}
+
+// entity checks if the entity id is defined.
+func (reg *addonRegistry) entity(id string) bool {
+	return vanillaIdentifier(id) || reg.entities[id]
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/df-mc/dragonfly/server/block/cube"
+	"github.com/df-mc/goleveldb/leveldb/util"
+)
+
+// mergeBlocks writes the chunk k merged block by block from all sources. Every
+// block is taken from the first source in which it isn't air, the sources
+// should be ordered by priority. Both layers of a block are taken from the same
+// source, so that waterlogged blocks stay intact. Blocks are compared by their
+// palette entries, so blocks unknown to dragonfly are merged like any other.
+//
+// Block entities are taken from the source the block they belong to came
+// from. The entities of all sources are combined. All other data of the chunk
+// is taken from the first source that has the chunk.
+func mergeBlocks(sources []*conflictSource, k iterKey, dbOutput *worldWriter) error {
+	index := key_index(k.pos, k.dim)
+	srcs := make([]*conflictSource, 0, len(sources))
+	for _, src := range sources {
+		exists, err := hasChunk(src.db, index)
+		if err != nil {
+			return err
+		}
+		if exists {
+			srcs = append(srcs, src)
+		}
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+
+	// The sub chunks of the first source are used as the base, air in them is
+	// filled from the other sources. from holds the source of every block not
+	// taken from the base.
+	r := k.dim.Range()
+	from := make(map[cube.Pos]int)
+	for y := r[0] >> 4; y <= r[1]>>4; y++ {
+		subs := make([]*rawSubChunk, len(srcs))
+		found := false
+		for i, src := range srcs {
+			data, err := src.subChunk(k, y)
+			if err != nil {
+				return fmt.Errorf("sub chunk %v: %w", y, err)
+			} else if data == nil {
+				continue
+			}
+			if subs[i], err = decodeRawSubChunk(data); err != nil {
+				return fmt.Errorf("sub chunk %v: %w", y, err)
+			}
+			found = true
+		}
+		if !found {
+			continue
+		}
+		sub, src := mergeSubChunks(subs)
+		for i, n := range src {
+			if n != 0 {
+				from[cube.Pos{i >> 8, y<<4 | i&15, i >> 4 & 15}] = n
+			}
+		}
+		dbOutput.Put(append(index, keySubChunkData, byte(y)), sub.encode(int8(y)))
+	}
+
+	// Keys the merger doesn't know how to combine are taken from the base.
+	iter := srcs[0].db.LDB().NewIterator(util.BytesPrefix(index), nil)
+	for iter.Next() {
+		key := iter.Key()
+		if _, n, ok := parseChunkKey(key); ok && n == len(index) {
+			switch key[n] {
+			case keySubChunkData, keyBlockEntities, keyEntities, keyChecksums:
+			case key3DData:
+				// The height map no longer matches the merged blocks, the game
+				// recalculates an empty one.
+				data := append([]byte(nil), iter.Value()...)
+				for i := 0; i < 512 && i < len(data); i++ {
+					data[i] = 0
+				}
+				dbOutput.Put(key, data)
+			case keyVersion, keyVersionOld:
+				dbOutput.chunkDone(k)
+				fallthrough
+			default:
+				dbOutput.Put(key, iter.Value())
+			}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	var blockNBT []map[string]any
+	// seen holds the unique IDs of the entities of all sources as they are in
+	// the sources, digp as they are in the merged world.
+	var entities, seen, digp []byte
+	for i, src := range srcs {
+		data, err := src.db.LoadBlockNBT(k.pos, k.dim)
+		if err != nil {
+			return err
+		}
+		for _, m := range data {
+			x, _ := m["x"].(int32)
+			y, _ := m["y"].(int32)
+			z, _ := m["z"].(int32)
+			if from[cube.Pos{int(x & 15), int(y), int(z & 15)}] == i && src.blockEntity(k, m) {
+				blockNBT = append(blockNBT, m)
+			}
+		}
+
+		e, err := src.entities(k)
+		if err != nil {
+			return fmt.Errorf("entities: %w", err)
+		}
+		entities = append(entities, e...)
+		d, err := src.digest(k)
+		if err != nil {
+			return err
+		}
+		// Actors present in more than one source are taken from the first.
+		n := len(seen)
+		seen = appendUniqueIDs(seen, d)
+		fresh := append([]byte(nil), seen[n:]...)
+		kept, err := src.actors(k, fresh, dbOutput)
+		if err != nil {
+			return err
+		}
+		digp = append(digp, kept...)
+	}
+	if len(blockNBT) > 0 {
+		data, err := encodeNBTList(blockNBT)
+		if err != nil {
+			return err
+		}
+		dbOutput.Put(append(index, keyBlockEntities), data)
+	}
+	if len(entities) > 0 {
+		dbOutput.Put(append(index, keyEntities), entities)
+	}
+	if len(digp) > 0 {
+		dbOutput.Put(append([]byte(keyActorDigest), index...), digp)
+	}
+	return nil
+}
+
+// mergeSubChunks merges the sub chunks at the same position of all sources,
+// any of which may be nil. It returns the merged sub chunk and the index of
+// the source of every block.
+func mergeSubChunks(subs []*rawSubChunk) (*rawSubChunk, []int) {
+	layers := 1
+	for _, s := range subs {
+		if s != nil && len(s.layers) > layers {
+			layers = len(s.layers)
+		}
+	}
+	builders := make([]*rawLayerBuilder, layers)
+	for i := range builders {
+		builders[i] = newRawLayerBuilder()
+	}
+	src := make([]int, 4096)
+	for i := range src {
+		if subs[0].airAt(0, i) {
+			for j, s := range subs[1:] {
+				if !s.airAt(0, i) {
+					src[i] = j + 1
+					break
+				}
+			}
+		}
+		s := subs[src[i]]
+		for layer, b := range builders {
+			b.set(i, s.entry(layer, i), s.airAt(layer, i))
+		}
+	}
+	out := &rawSubChunk{}
+	for layer, b := range builders {
+		if layer > 0 && len(b.l.palette) == 1 && b.l.air[0] {
+			// Layers above the first that hold only air are left out.
+			break
+		}
+		out.layers = append(out.layers, b.l)
+	}
+	return out, src
+}
+
+// hasChunk checks if db has the chunk with the index.
+func hasChunk(db sourceDB, index []byte) (bool, error) {
+	for _, tag := range [...]byte{keyVersion, keyVersionOld} {
+		found, err := db.LDB().Has(append(index, tag), nil)
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// appendUniqueIDs appends the entity unique IDs in b to the actor digest
+// digp, skipping IDs already present.
+func appendUniqueIDs(digp, b []byte) []byte {
+	for i := 0; i+8 <= len(b); i += 8 {
+		id := b[i : i+8]
+		found := false
+		for j := 0; j+8 <= len(digp); j += 8 {
+			if bytes.Equal(digp[j:j+8], id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			digp = binary.LittleEndian.AppendUint64(digp, binary.LittleEndian.Uint64(id))
+		}
+	}
+	return digp
+}
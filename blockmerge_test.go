@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// testSubChunk encodes a sub chunk with a single layer holding the block name
+// at every index in at, and air everywhere else.
+func testSubChunk(t *testing.T, name string, at ...int) []byte {
+	t.Helper()
+	e, err := nbt.MarshalEncoding(blockState(name, map[string]any{}), nbt.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newRawLayerBuilder()
+	for i := 0; i < 4096; i++ {
+		b.set(i, airEntry, true)
+	}
+	for _, i := range at {
+		b.set(i, e, false)
+	}
+	return (&rawSubChunk{layers: []rawLayer{b.l}}).encode(0)
+}
+
+// blockAt returns the name of the block at index i of the first layer.
+func blockAt(t *testing.T, s *rawSubChunk, i int) string {
+	t.Helper()
+	var m map[string]any
+	if err := nbt.UnmarshalEncoding(s.entry(0, i), &m, nbt.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	name, _ := m["name"].(string)
+	return name
+}
+
+// TestMergeSubChunksCustomBlocks checks that blocks dragonfly doesn't know,
+// such as blocks of add-ons, are merged like vanilla blocks.
+func TestMergeSubChunksCustomBlocks(t *testing.T) {
+	base, err := decodeRawSubChunk(testSubChunk(t, "addon:crate", 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	over, err := decodeRawSubChunk(testSubChunk(t, "minecraft:stone", 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if air, err := subChunkAir(testSubChunk(t, "addon:crate", 5)); err != nil || air {
+		t.Errorf("sub chunk with a custom block is air: %v, %v", air, err)
+	}
+
+	merged, src := mergeSubChunks([]*rawSubChunk{base, nil, over})
+	out, err := decodeRawSubChunk(merged.encode(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range map[int]string{0: "addon:crate", 1: "addon:crate", 2: "minecraft:stone", 3: "minecraft:air"} {
+		if got := blockAt(t, out, i); got != want {
+			t.Errorf("block %d is %s, want %s", i, got, want)
+		}
+	}
+	if src[1] != 0 || src[2] != 2 {
+		t.Errorf("sources of blocks 1 and 2 are %d and %d, want 0 and 2", src[1], src[2])
+	}
+}
+
+// TestMergeConflictsTransform checks that chunks merged from more than one
+// world are changed by the transform like the chunks copied from a single
+// world.
+func TestMergeConflictsTransform(t *testing.T) {
+	in := writeTestWorlds(t, []testWorld{
+		{"g/a", "minecraft:iron_block", ChunkPos{0, 0}, 2},
+		{"g/b", "minecraft:gold_block", ChunkPos{1, 1}, 2},
+	})
+	for policy, want := range map[conflictPolicy]string{
+		conflictNonAir: "minecraft:emerald_block",
+		conflictBlocks: "minecraft:emerald_block",
+		conflictLayers: "minecraft:gold_block",
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			tr := &transform{
+				blocks: blockMapping{{
+					From: blockPattern{Name: "minecraft:iron_block"},
+					To:   blockPattern{Name: "minecraft:emerald_block"},
+				}},
+				unknown: unknownNone,
+				report:  &transformReport{},
+			}
+			root, conflicts := loadTestWorlds(t, in, modeOriginal, policy)
+			if len(conflicts) != 1 {
+				t.Fatalf("found %d conflicts, want 1", len(conflicts))
+			}
+			blocks := outputBlocks(t, mergeTestWorlds(t, root, conflicts, policy, tr))
+			if got := blocks[ChunkPos{0, 0}]; got != "minecraft:emerald_block" {
+				t.Errorf("copied chunk holds %s, want minecraft:emerald_block", got)
+			}
+			if got := blocks[ChunkPos{1, 1}]; got != want {
+				t.Errorf("merged chunk holds %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestRewritePalettes checks that a palette rewritten by rewritePalettes is
+// read back by decodeRawSubChunk, which share the reader of the sub chunk
+// format.
+func TestRewritePalettes(t *testing.T) {
+	data := testSubChunk(t, "addon:crate", 7)
+	out, err := rewritePalettes(data, func(_, _ int, m map[string]any) map[string]any {
+		if m["name"] == "addon:crate" {
+			return blockState("minecraft:stone", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := decodeRawSubChunk(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := blockAt(t, s, 7); got != "minecraft:stone" {
+		t.Errorf("block 7 is %s, want minecraft:stone", got)
+	}
+	if got := blockAt(t, s, 8); got != "minecraft:air" {
+		t.Errorf("block 8 is %s, want minecraft:air", got)
+	}
+	if same, err := rewritePalettes(data, func(int, int, map[string]any) map[string]any { return nil }); err != nil || &same[0] != &data[0] {
+		t.Errorf("unchanged sub chunk was copied: %v", err)
+	}
+	if _, err := decodeRawSubChunk(data[:len(data)-3]); err == nil {
+		t.Error("truncated sub chunk was decoded")
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/util"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// mergeMode decides where the chunks of every world end up in the output.
+type mergeMode string
+
+const (
+	// modeGrid lays out all worlds next to each other in a grid of groups.
+	modeGrid mergeMode = "grid"
+	// modeOriginal keeps every chunk at its original coordinates. Chunks that
+	// are present in more than one world are resolved by a conflictPolicy.
+	modeOriginal mergeMode = "original"
+)
+
+func parseMergeMode(s string) (mergeMode, error) {
+	switch m := mergeMode(s); m {
+	case modeGrid, modeOriginal:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown merge mode %q", s)
+}
+
+// conflictPolicy decides what happens to a chunk present in more than one
+// world when merging with modeOriginal. Worlds are ordered by their path, or by
+// the priority passed to orderWorlds.
+type conflictPolicy string
+
+const (
+	// conflictFirst takes the chunk from the first world that has it.
+	conflictFirst conflictPolicy = "first"
+	// conflictLast takes the chunk from the last world that has it.
+	conflictLast conflictPolicy = "last"
+	// conflictNewest takes the chunk from the world that was played last.
+	// Bedrock doesn't store when a chunk was changed, so LastPlayed from the
+	// level.dat of the world is used.
+	conflictNewest conflictPolicy = "newest"
+	// conflictNonAir takes every sub chunk from the first world in which it
+	// isn't only air.
+	conflictNonAir conflictPolicy = "non-air"
+	// conflictBlocks takes every block from the first world in which it isn't
+	// air, so that all worlds are combined with earlier worlds winning.
+	conflictBlocks conflictPolicy = "blocks"
+	// conflictLayers draws every world over the worlds before it, with air
+	// being transparent. It is conflictBlocks with the worlds reversed, so that
+	// a decoration world ordered after a terrain world is placed on top of it.
+	conflictLayers conflictPolicy = "layers"
+)
+
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	switch p := conflictPolicy(s); p {
+	case conflictFirst, conflictLast, conflictNewest, conflictNonAir, conflictBlocks, conflictLayers:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// chunkConflict is a chunk that is present in more than one world.
+type chunkConflict struct {
+	Dimension int      `json:"dimension"`
+	Pos       ChunkPos `json:"pos"`
+	Worlds    []string `json:"worlds"`
+	// Winner is the world the chunk was taken from. It is empty if the chunk
+	// was merged from all worlds.
+	Winner string `json:"winner,omitempty"`
+
+	key    iterKey
+	worlds []*worldMap
+}
+
+// layoutOriginal places every world at its original bounds, without any
+// offset applied to its chunks. Groups are sized to cover all of their worlds.
+// It returns the absolute bounds of the group, max is exclusive.
+func layoutOriginal(g *mapGroup) (min, max ChunkPos) {
+	type child struct {
+		item     layoutItem
+		min, max ChunkPos
+	}
+	var children []child
+	for _, childGroup := range g.groups {
+		cmin, cmax := layoutOriginal(childGroup)
+		children = append(children, child{childGroup, cmin, cmax})
+	}
+	for _, w := range g.worlds {
+		children = append(children, child{w, w.boundsMin, w.boundsMin.Add(w.BoundsTotal())})
+	}
+	for i, c := range children {
+		if i == 0 {
+			min, max = c.min, c.max
+			continue
+		}
+		min = ChunkPos{minInt32(min.X(), c.min.X()), minInt32(min.Z(), c.min.Z())}
+		max = ChunkPos{maxInt32(max.X(), c.max.X()), maxInt32(max.Z(), c.max.Z())}
+	}
+	for _, c := range children {
+		c.item.setOffset(c.min.Sub(min))
+	}
+	g.size = max.Sub(min)
+	g.offsetFromParent = min
+	return min, max
+}
+
+// allWorlds returns all worlds in the group and its children, ordered by path.
+func allWorlds(g *mapGroup) []*worldMap {
+	var worlds []*worldMap
+	for _, childGroup := range g.groups {
+		worlds = append(worlds, allWorlds(childGroup)...)
+	}
+	for _, w := range g.worlds {
+		worlds = append(worlds, w)
+	}
+	sort.Slice(worlds, func(i, j int) bool {
+		return worlds[i].source < worlds[j].source
+	})
+	return worlds
+}
+
+// orderWorlds moves the worlds whose path contains one of the entries of
+// priority to the front, in the order of priority. The order of all other
+// worlds is kept.
+func orderWorlds(worlds []*worldMap, priority []string) {
+	rank := func(w *worldMap) int {
+		for i, p := range priority {
+			if strings.Contains(filepath.ToSlash(w.source), p) {
+				return i
+			}
+		}
+		return len(priority)
+	}
+	sort.SliceStable(worlds, func(i, j int) bool {
+		return rank(worlds[i]) < rank(worlds[j])
+	})
+}
+
+// findConflicts finds all chunks that are present in more than one of the
+// worlds and applies the policy to them. Worlds that lost a chunk get it added
+// to their skip set. With conflictNonAir, conflictBlocks and conflictLayers,
+// every world skips the chunk and it has to be written by resolveConflicts.
+func findConflicts(worlds []*worldMap, policy conflictPolicy) []*chunkConflict {
+	owners := make(map[iterKey][]*worldMap)
+	for _, w := range worlds {
+		for k := range w.manifest.index() {
+			owners[k] = append(owners[k], w)
+		}
+	}
+
+	var conflicts []*chunkConflict
+	for k, ws := range owners {
+		if len(ws) < 2 {
+			continue
+		}
+		dim, _ := world.DimensionID(k.dim)
+		c := &chunkConflict{Dimension: dim, Pos: ChunkPos(k.pos), key: k, worlds: ws}
+		var winner *worldMap
+		switch policy {
+		case conflictFirst:
+			winner = ws[0]
+		case conflictLast:
+			winner = ws[len(ws)-1]
+		case conflictNewest:
+			winner = ws[0]
+			for _, w := range ws[1:] {
+				if w.manifest.LastPlayed > winner.manifest.LastPlayed {
+					winner = w
+				}
+			}
+		}
+		for _, w := range ws {
+			c.Worlds = append(c.Worlds, w.source)
+			if w == winner {
+				c.Winner = w.source
+				continue
+			}
+			if w.skip == nil {
+				w.skip = make(map[iterKey]struct{})
+			}
+			w.skip[k] = struct{}{}
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		a, b := conflicts[i], conflicts[j]
+		if a.Dimension != b.Dimension {
+			return a.Dimension < b.Dimension
+		}
+		if a.Pos.X() != b.Pos.X() {
+			return a.Pos.X() < b.Pos.X()
+		}
+		return a.Pos.Z() < b.Pos.Z()
+	})
+	return conflicts
+}
+
+// writeConflictReport writes all conflicts to a JSON file.
+func writeConflictReport(conflicts []*chunkConflict, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Conflicts []*chunkConflict `json:"conflicts"`
+	}{conflicts})
+}
+
+// resolveConflicts writes all conflicts without a winner, merging the chunk
+// from all worlds that have it as decided by policy. The data of every world
+// is changed by t, as when the world is copied.
+func resolveConflicts(ctx context.Context, conflicts []*chunkConflict, policy conflictPolicy, t *transform, dbOutput *worldWriter, errs *errorCollector) error {
+	srcs := make(map[string]*conflictSource)
+	// The merged chunks hold the entities of more than one world, so their
+	// entities are counted together against the limit per chunk.
+	counts := make(map[iterKey]int)
+	defer func() {
+		for _, src := range srcs {
+			_ = src.db.Close()
+			src.wt.done()
+		}
+	}()
+	open := func(w *worldMap) (*conflictSource, error) {
+		if src, ok := srcs[w.source]; ok {
+			return src, nil
+		}
+		db, err := w.open()
+		if err != nil {
+			return nil, err
+		}
+		src := &conflictSource{db: db, wt: t.forWorld(w.source), ids: w.ids}
+		if src.wt != nil {
+			src.wt.counts = counts
+		}
+		srcs[w.source] = src
+		return src, nil
+	}
+
+	for _, c := range conflicts {
+		if c.Winner != "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sources := make([]*conflictSource, len(c.worlds))
+		for i, w := range c.worlds {
+			src, err := open(w)
+			if err != nil {
+				return fmt.Errorf("%s: %w", w.source, err)
+			}
+			sources[i] = src
+		}
+		var err error
+		switch policy {
+		case conflictBlocks:
+			err = mergeBlocks(sources, c.key, dbOutput)
+		case conflictLayers:
+			for i, j := 0, len(sources)-1; i < j; i, j = i+1, j-1 {
+				sources[i], sources[j] = sources[j], sources[i]
+			}
+			err = mergeBlocks(sources, c.key, dbOutput)
+		default:
+			err = mergeNonAir(sources, c.key, dbOutput)
+		}
+		if err != nil {
+			if !errs.chunkError(conflictsName, fmt.Errorf("chunk %v: %w", c.Pos, err)) {
+				return err
+			}
+		}
+		if dbOutput.Len() >= recordSize {
+			if err := dbOutput.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return dbOutput.flush()
+}
+
+// conflictsName is the name used for resolveConflicts in progress and error
+// reports.
+const conflictsName = "conflicts"
+
+// conflictSource is a world a conflict is merged from. The data read from it
+// is changed by wt, which may be nil, and its entities get the unique IDs in
+// ids, like the data of the chunks copied from the world.
+type conflictSource struct {
+	db  sourceDB
+	wt  *worldTransform
+	ids uniqueIDs
+}
+
+// subChunk returns the sub chunk at y of the chunk k, or nil if the chunk
+// doesn't have it.
+func (src *conflictSource) subChunk(k iterKey, y int) ([]byte, error) {
+	data, err := src.db.LDB().Get(append(key_index(k.pos, k.dim), keySubChunkData, byte(y)), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil || src.wt == nil {
+		return data, err
+	}
+	return src.wt.subChunk(k, y, data)
+}
+
+// blockEntity applies the transform to the block entity m of the chunk k,
+// whose block is kept in the merged chunk. It returns false if the block
+// entity is dropped, as its block was replaced.
+func (src *conflictSource) blockEntity(k iterKey, m map[string]any) bool {
+	return src.wt == nil || src.wt.blockEntity(k, m)
+}
+
+// entities returns the entities stored in the chunk k itself, as done by
+// older versions, without the entities dropped by the transform.
+func (src *conflictSource) entities(k iterKey) ([]byte, error) {
+	data, err := src.db.LDB().Get(append(key_index(k.pos, k.dim), keyEntities), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil || src.wt == nil && len(src.ids) == 0 {
+		return data, err
+	}
+	return rewriteNBT(data, func(m map[string]any) bool {
+		if src.wt != nil && !src.wt.entity(k, m) {
+			return false
+		}
+		src.ids.entity(m)
+		return true
+	})
+}
+
+// actors writes the actor records of the unique IDs in uids, which are listed
+// in the actor digest of the chunk k. The worlds don't copy actors of chunks
+// they skipped, so the chunks merged from more than one world copy their own.
+// It returns the unique IDs the actors that were kept have in the merged world,
+// to be written as the digest of the chunk.
+func (src *conflictSource) actors(k iterKey, uids []byte, dbOutput *worldWriter) ([]byte, error) {
+	values := make(map[string][]byte)
+	for i := 0; i+8 <= len(uids); i += 8 {
+		uid := uids[i : i+8]
+		data, err := src.db.LDB().Get(append([]byte(keyActorPrefix), uid...), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if src.wt != nil || len(src.ids) > 0 {
+			if data, err = rewriteNBT(data, func(m map[string]any) bool {
+				if src.wt != nil && !src.wt.actor(uid, m) {
+					return false
+				}
+				src.ids.entity(m)
+				return true
+			}); err != nil {
+				return nil, fmt.Errorf("entity: %w", err)
+			}
+		}
+		values[string(uid)] = data
+	}
+	if src.wt != nil {
+		uids, _ = src.wt.digest(k, uids)
+	}
+	for i := 0; i+8 <= len(uids); i += 8 {
+		if data := values[string(uids[i:i+8])]; len(data) > 0 {
+			dbOutput.Put(append([]byte(keyActorPrefix), src.ids.uid(uids[i:i+8])...), data)
+		}
+	}
+	return src.ids.digest(uids), nil
+}
+
+// digest returns the actor digest of the chunk k, or nil if the chunk doesn't
+// have one.
+func (src *conflictSource) digest(k iterKey) ([]byte, error) {
+	digp, err := src.db.LDB().Get(append([]byte(keyActorDigest), key_index(k.pos, k.dim)...), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return digp, err
+}
+
+// mergeNonAir writes the chunk k, merged from all sources per sub chunk. Every
+// sub chunk is taken from the first world in which it isn't only air. All other
+// data of the chunk is taken from the first world that has it, except for block
+// entities, which are taken from the world the sub chunk they are in came from.
+func mergeNonAir(sources []*conflictSource, k iterKey, dbOutput *worldWriter) error {
+	index := key_index(k.pos, k.dim)
+	r := k.dim.Range()
+
+	// Keys other than sub chunks, block entities, entities and checksums come
+	// from the first world unchanged.
+	iter := sources[0].db.LDB().NewIterator(util.BytesPrefix(index), nil)
+	for iter.Next() {
+		key := iter.Key()
+		if _, n, ok := parseChunkKey(key); !ok || n != len(index) {
+			continue
+		} else if t := key[n]; t == keySubChunkData || t == keyBlockEntities || t == keyEntities || t == keyChecksums {
+			continue
+		}
+		if key[len(index)] == keyVersion || key[len(index)] == keyVersionOld {
+			dbOutput.chunkDone(k)
+		}
+		dbOutput.Put(key, iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	entities, err := sources[0].entities(k)
+	if err != nil {
+		return fmt.Errorf("entities: %w", err)
+	}
+	if len(entities) > 0 {
+		dbOutput.Put(append(index, keyEntities), entities)
+	}
+	digp, err := sources[0].digest(k)
+	if err != nil {
+		return err
+	}
+	if digp, err = sources[0].actors(k, digp, dbOutput); err != nil {
+		return err
+	}
+	if len(digp) > 0 {
+		dbOutput.Put(append([]byte(keyActorDigest), index...), digp)
+	}
+
+	// Every sub chunk is taken from the first world where it isn't only air,
+	// or from the first world that has it at all.
+	chosen := make(map[int]int)
+	for y := r[0] >> 4; y <= r[1]>>4; y++ {
+		var first []byte
+		for i, src := range sources {
+			data, err := src.subChunk(k, y)
+			if err != nil {
+				return fmt.Errorf("sub chunk %v: %w", y, err)
+			} else if data == nil {
+				continue
+			}
+			air, err := subChunkAir(data)
+			if err != nil {
+				return fmt.Errorf("sub chunk %v: %w", y, err)
+			}
+			if first == nil {
+				first, chosen[y] = data, i
+			}
+			if !air {
+				first, chosen[y] = data, i
+				break
+			}
+		}
+		if first != nil {
+			dbOutput.Put(append(index, keySubChunkData, byte(y)), first)
+		}
+	}
+
+	// Block entities follow the sub chunk they are in.
+	var blockNBT []map[string]any
+	for i, src := range sources {
+		data, err := src.db.LoadBlockNBT(k.pos, k.dim)
+		if err != nil {
+			return err
+		}
+		for _, m := range data {
+			y, ok := m["y"].(int32)
+			if from, found := chosen[int(y>>4)]; ok && found && from == i && src.blockEntity(k, m) {
+				blockNBT = append(blockNBT, m)
+			}
+		}
+	}
+	if len(blockNBT) > 0 {
+		data, err := encodeNBTList(blockNBT)
+		if err != nil {
+			return err
+		}
+		dbOutput.Put(append(index, keyBlockEntities), data)
+	}
+	return nil
+}
+
+// subChunkAir checks if a serialised sub chunk holds only air.
+func subChunkAir(data []byte) (bool, error) {
+	sub, err := decodeRawSubChunk(data)
+	if err != nil {
+		return false, err
+	}
+	return sub.onlyAir(), nil
+}
+
+// encodeNBTList encodes NBT compound tags appended to each other.
+func encodeNBTList(list []map[string]any) ([]byte, error) {
+	var data []byte
+	for _, m := range list {
+		b, err := nbt.MarshalEncoding(m, nbt.LittleEndian)
+		if err != nil {
+			return nil, fmt.Errorf("encode NBT: %w", err)
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+func minInt32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
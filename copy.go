@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 
+	"github.com/df-mc/dragonfly/server/block/cube"
 	"github.com/df-mc/dragonfly/server/world"
-	"github.com/df-mc/dragonfly/server/world/mcdb"
-	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/df-mc/goleveldb/leveldb/util"
+	"github.com/go-gl/mathgl/mgl64"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+	"github.com/sirupsen/logrus"
 )
 
 // Keys on a per-sub chunk basis. These are prefixed by the chunk coordinates and subchunk ID.
@@ -23,6 +30,37 @@ const (
 	keyVersionOld = 'v' // 76
 	// key3DData holds 3-dimensional biomes for the entire chunk.
 	key3DData = '+' // 2b
+	// key2DData is no longer used by vanilla, it held the height map and 2-dimensional biomes of the chunk.
+	key2DData = '-' // 2d
+	// keyBlockEntities holds n amount of NBT compound tags appended to each other (not a TAG_List, just appended). The
+	// compound tags contain the position of the block entities.
+	keyBlockEntities = '1' // 31
+	// keyEntities holds n amount of NBT compound tags appended to each other (not a TAG_List, just appended). The
+	// compound tags contain the position of the entities.
+	keyEntities = '2' // 32
+	// keyPendingTicks and keyRandomTicks hold an NBT compound with a list of scheduled block updates, which contain
+	// the position of the block.
+	keyPendingTicks = '3' // 33
+	keyRandomTicks  = ':' // 3a
+	// keyFinalisation holds a little endian uint32 with the generation state of the chunk, 2 for a chunk that
+	// was fully generated.
+	keyFinalisation = '6' // 36
+	// keyChecksums holds checksums of the other keys of the chunk. It is no longer written by vanilla.
+	keyChecksums = ';' // 3b
+	// keyHardcodedSpawners holds the areas of structures with their own mob spawns, such as nether fortresses,
+	// in absolute block coordinates.
+	keyHardcodedSpawners = '9' // 39
+	// keyFirstTag and keyLastTag are the lowest and highest tags of all keys on a per-chunk basis, other than
+	// keyVersionOld.
+	keyFirstTag = '+' // 2b
+	keyLastTag  = 'A' // 41
+)
+
+// Keys used by actor storage, where every entity is stored under its own key and a chunk holds a list of the
+// unique IDs of its entities.
+const (
+	keyActorPrefix = "actorprefix"
+	keyActorDigest = "digp"
 )
 
 func key_index(position world.ChunkPos, d world.Dimension) []byte {
@@ -39,37 +77,423 @@ func key_index(position world.ChunkPos, d world.Dimension) []byte {
 	return b
 }
 
-const chunkVersion = 40
+// parseIndex parses a chunk index as written by key_index. index must be
+// either 8 or 12 bytes long.
+func parseIndex(index []byte) (iterKey, bool) {
+	k := iterKey{
+		pos: world.ChunkPos{
+			int32(binary.LittleEndian.Uint32(index[:4])),
+			int32(binary.LittleEndian.Uint32(index[4:8])),
+		},
+		dim: world.Overworld,
+	}
+	if len(index) == 12 {
+		var ok bool
+		if k.dim, ok = world.DimensionByID(int(binary.LittleEndian.Uint32(index[8:]))); !ok {
+			return k, false
+		}
+	}
+	return k, true
+}
 
-var countChunks = 0
+// parseChunkKey parses a key on a per-chunk or per-sub chunk basis. It returns
+// the chunk and the length of the index the key is prefixed with.
+func parseChunkKey(key []byte) (k iterKey, n int, ok bool) {
+	for _, n := range [...]int{8, 12} {
+		if len(key) <= n {
+			break
+		}
+		tag, rest := key[n], len(key)-n-1
+		if tag == keySubChunkData && rest != 1 || tag != keySubChunkData && rest != 0 {
+			continue
+		}
+		if tag != keyVersionOld && (tag < keyFirstTag || tag > keyLastTag) {
+			continue
+		}
+		if k, ok := parseIndex(key[:n]); ok {
+			return k, n, true
+		}
+	}
+	return iterKey{}, 0, false
+}
 
-func copyChunk(db *mcdb.DB, pos world.ChunkPos, dim world.Dimension, dbOutput *leveldb.Batch, posOut world.ChunkPos) error {
-	countChunks += 1
-	keyi := key_index(pos, dim)
-	keyo := key_index(posOut, dim)
+// copyWorld copies the world w into dbOutput, moving all chunks
+// by offset. The source database is read once in key order and every key
+// belonging to a chunk in the manifest of the world, or to one of its
+// entities, is written under the moved key after applying t to it. Errors
+// that only affect a single key are passed to errs, which decides if the copy
+// continues.
+func copyWorld(ctx context.Context, w *worldMap, dbOutput *worldWriter, offset ChunkPos, t *transform, errs *errorCollector) error {
+	index := w.manifest.index()
+	for k := range w.skip {
+		delete(index, k)
+	}
+	db, err := w.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	actors, err := digestActors(db, index)
+	if err != nil {
+		return err
+	}
 
-	dbOutput.Put(append(keyo, keyVersion), []byte{chunkVersion})
+	wt := t.forWorld(w.source)
+	mv := &worldMove{offset: offset, ids: w.ids}
+	iter := db.LDB().NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := copyKey(iter.Key(), iter.Value(), index, actors, dbOutput, mv, wt); err != nil {
+			err = fmt.Errorf("key %x: %w", iter.Key(), err)
+			if !errs.chunkError(w.source, err) {
+				return err
+			}
+		}
+		if dbOutput.Len() >= recordSize {
+			if err := dbOutput.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := dbOutput.flush(); err != nil {
+		return err
+	}
+	if mv.lossy > 0 {
+		logrus.Warnf("%s: %d entities are up to %.3g blocks off their position after moving them, float32 positions can't be stored exactly this far from 0,0", w.source, mv.lossy, mv.maxLoss)
+	}
+	if mv.invalid > 0 {
+		logrus.Warnf("%s: dropped %d entities that couldn't be moved, first: %v", w.source, mv.invalid, mv.invalidErr)
+	}
+	wt.done()
+	return nil
+}
 
-	Biomes, err := db.LDB().Get(append(keyi, key3DData), nil)
-	if err != nil && err != leveldb.ErrNotFound {
-		return fmt.Errorf("error reading 3D data: %w", err)
+// worldMove moves the chunks and entities of a world by offset, and gives
+// its entities the unique IDs in ids.
+type worldMove struct {
+	offset ChunkPos
+	ids    uniqueIDs
+	// lossy counts the entities whose position lost more than
+	// precisionWarning when moved, and maxLoss is the largest loss.
+	lossy   int
+	maxLoss float64
+	// invalid counts the entities dropped because they couldn't be moved,
+	// invalidErr is the error of the first. dropped holds the unique IDs of
+	// those in actor storage, which are removed from their actor digest.
+	invalid    int
+	invalidErr error
+	dropped    map[string]struct{}
+}
+
+// entity moves the entity m by the offset. It returns false if the entity
+// doesn't have a valid position and should be dropped, as it can't be placed
+// in the merged world.
+func (mv *worldMove) entity(m map[string]any) bool {
+	loss, err := moveEntity(m, mv.offset)
+	if err != nil {
+		if mv.invalid == 0 {
+			mv.invalidErr = err
+		}
+		mv.invalid++
+		return false
 	}
-	if len(Biomes) > 512 {
-		Biomes = Biomes[512:]
+	if loss > precisionWarning {
+		mv.lossy++
+		mv.maxLoss = math.Max(mv.maxLoss, loss)
 	}
-	dbOutput.Put(append(keyo, key3DData), Biomes)
+	mv.ids.entity(m)
+	return true
+}
 
-	for i := 0; i < (dim.Range().Height()>>4)+1; i++ {
-		o := uint8(i + (dim.Range()[0] >> 4))
-		SubChunk, err := db.LDB().Get(append(keyi, keySubChunkData, o), nil)
-		if err == leveldb.ErrNotFound {
-			// No sub chunk present at this Y level. We skip this one and move to the next, which might still
-			// be present.
+// actor moves the entity m stored in actor storage under the unique ID uid.
+// It returns false if the entity should be dropped, see entity.
+func (mv *worldMove) actor(uid []byte, m map[string]any) bool {
+	if mv.entity(m) {
+		return true
+	}
+	if mv.dropped == nil {
+		mv.dropped = make(map[string]struct{})
+	}
+	mv.dropped[string(uid)] = struct{}{}
+	return false
+}
+
+// digest removes the unique IDs of the actors dropped by actor from digp.
+func (mv *worldMove) digest(digp []byte) []byte {
+	if len(mv.dropped) == 0 {
+		return digp
+	}
+	out := digp[:0:0]
+	for i := 0; i+8 <= len(digp); i += 8 {
+		if _, ok := mv.dropped[string(digp[i:i+8])]; !ok {
+			out = append(out, digp[i:i+8]...)
+		}
+	}
+	return out
+}
+
+// digestActors returns the unique IDs of the actors listed in the digests of
+// the chunks in index. Only these actors are copied, so that a world never
+// writes the actors of chunks that are skipped or taken from another world,
+// which may share their unique IDs.
+func digestActors(db sourceDB, index map[iterKey]struct{}) (map[string]struct{}, error) {
+	actors := make(map[string]struct{})
+	iter := db.LDB().NewIterator(util.BytesPrefix([]byte(keyActorDigest)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		idx := iter.Key()[len(keyActorDigest):]
+		if len(idx) != 8 && len(idx) != 12 {
 			continue
-		} else if err != nil {
-			return fmt.Errorf("error reading sub chunk data %v: %w", i, err)
 		}
-		dbOutput.Put(append(keyo, keySubChunkData, o), SubChunk)
+		k, ok := parseIndex(idx)
+		if _, found := index[k]; !ok || !found {
+			continue
+		}
+		digp := iter.Value()
+		for i := 0; i+8 <= len(digp); i += 8 {
+			actors[string(digp[i:i+8])] = struct{}{}
+		}
+	}
+	return actors, iter.Error()
+}
+
+// copyKey writes a single key of a source world to dbOutput, moved by mv.
+// Keys that don't belong to a chunk in index are skipped, as are actors not
+// in actors, entities that can't be moved and entities dropped by wt, which
+// may be nil. A panic caused by malformed data is returned as an error.
+func copyKey(key, value []byte, index map[iterKey]struct{}, actors map[string]struct{}, dbOutput *worldWriter, mv *worldMove, wt *worldTransform) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	offset := mv.offset
+
+	switch {
+	case bytes.HasPrefix(key, []byte(keyActorPrefix)):
+		uid := key[len(keyActorPrefix):]
+		if _, ok := actors[string(uid)]; !ok {
+			return nil
+		}
+		value, err = rewriteNBT(value, func(m map[string]any) bool {
+			return mv.actor(uid, m) && (wt == nil || wt.actor(uid, m))
+		})
+		if err != nil {
+			return fmt.Errorf("entity: %w", err)
+		}
+		if len(value) > 0 {
+			dbOutput.Put(append([]byte(keyActorPrefix), mv.ids.uid(uid)...), value)
+		}
+		return nil
+	case bytes.HasPrefix(key, []byte(keyActorDigest)):
+		idx := key[len(keyActorDigest):]
+		if len(idx) != 8 && len(idx) != 12 {
+			return nil
+		}
+		k, ok := parseIndex(idx)
+		if _, found := index[k]; !ok || !found {
+			return nil
+		}
+		out := iterKey{pos: world.ChunkPos(offset.Add(k.pos)), dim: k.dim}
+		value = mv.digest(value)
+		if wt != nil {
+			var over [][]byte
+			value, over = wt.digest(out, value)
+			for _, uid := range over {
+				dbOutput.Delete(append([]byte(keyActorPrefix), mv.ids.uid(uid)...))
+			}
+		}
+		if len(value) == 0 {
+			return nil
+		}
+		value = mv.ids.digest(value)
+		dbOutput.Put(append([]byte(keyActorDigest), key_index(out.pos, out.dim)...), value)
+		return nil
+	}
+
+	k, n, ok := parseChunkKey(key)
+	if !ok {
+		return nil
+	}
+	if _, found := index[k]; !found {
+		return nil
+	}
+	out := iterKey{pos: world.ChunkPos(offset.Add(k.pos)), dim: k.dim}
+	switch key[n] {
+	case keySubChunkData:
+		if wt != nil {
+			value, err = wt.subChunk(out, int(int8(key[n+1])), value)
+		}
+	case keyBlockEntities:
+		value, err = rewriteNBT(value, func(m map[string]any) bool {
+			if wt != nil && !wt.blockEntity(out, m) {
+				return false
+			}
+			moveBlockNBT(m, offset)
+			return true
+		})
+		if err == nil && len(value) == 0 {
+			return nil
+		}
+	case keyHardcodedSpawners:
+		value, err = moveSpawners(value, offset)
+	case keyChecksums:
+		// The checksums no longer match once a key of the chunk is changed,
+		// the game doesn't need them.
+		return nil
+	case keyPendingTicks, keyRandomTicks:
+		value, err = rewriteNBT(value, func(m map[string]any) bool {
+			moveBlockNBT(m, offset)
+			return true
+		})
+	case keyEntities:
+		value, err = rewriteNBT(value, func(m map[string]any) bool {
+			return mv.entity(m) && (wt == nil || wt.entity(out, m))
+		})
+		if err == nil && len(value) == 0 {
+			return nil
+		}
 	}
+	if err != nil {
+		return fmt.Errorf("chunk %v: %w", k.pos, err)
+	}
+	if key[n] == keyVersion || key[n] == keyVersionOld {
+		dbOutput.chunkDone(k)
+	}
+	dbOutput.Put(append(key_index(out.pos, out.dim), key[n:]...), value)
 	return nil
 }
+
+// chunkVersion is the version written for chunks that were encoded by the
+// merger rather than copied.
+const chunkVersion = 40
+
+// encodedChunk holds the blocks and biomes of a chunk encoded for writing, so
+// that a chunk written at many positions only has to be encoded once.
+type encodedChunk struct {
+	r         cube.Range
+	data3D    []byte
+	subChunks [][]byte
+}
+
+// encodeChunk encodes c. Sub chunks that only hold air are left out.
+func encodeChunk(c *chunk.Chunk) encodedChunk {
+	data := chunk.Encode(c, chunk.DiskEncoding)
+	e := encodedChunk{
+		r: c.Range(),
+		// The height map is recalculated by the game, so it is left empty.
+		data3D:    append(make([]byte, 512), data.Biomes...),
+		subChunks: data.SubChunks,
+	}
+	for i, sub := range c.Sub() {
+		if sub.Empty() {
+			e.subChunks[i] = nil
+		}
+	}
+	return e
+}
+
+// put writes the chunk to dbOutput as the chunk k, marked as fully generated.
+func (e encodedChunk) put(dbOutput *worldWriter, k iterKey) {
+	index := key_index(k.pos, k.dim)
+	dbOutput.chunkDone(k)
+	dbOutput.Put(append(index, keyVersion), []byte{chunkVersion})
+	dbOutput.Put(append(index, key3DData), e.data3D)
+	dbOutput.Put(append(index, keyFinalisation), []byte{2, 0, 0, 0})
+	for i, sub := range e.subChunks {
+		if sub != nil {
+			dbOutput.Put(append(index, keySubChunkData, byte(i+(e.r[0]>>4))), sub)
+		}
+	}
+}
+
+// rewriteNBT decodes all NBT compound tags appended to each other in data,
+// passes them to f and encodes them again. Tags for which f returns false are
+// left out.
+func rewriteNBT(data []byte, f func(m map[string]any) bool) ([]byte, error) {
+	buf := bytes.NewBuffer(data)
+	dec := nbt.NewDecoderWithEncoding(buf, nbt.LittleEndian)
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	enc := nbt.NewEncoderWithEncoding(out, nbt.LittleEndian)
+	for buf.Len() != 0 {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return nil, fmt.Errorf("decode NBT: %w", err)
+		}
+		if !f(m) {
+			continue
+		}
+		if err := enc.Encode(m); err != nil {
+			return nil, fmt.Errorf("encode NBT: %w", err)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// moveBlockNBT moves a block entity, or the block updates in a list of
+// pending ticks, by offset.
+func moveBlockNBT(m map[string]any, offset ChunkPos) {
+	if x, ok := m["x"].(int32); ok {
+		m["x"] = x + offset.X()*16
+	}
+	if z, ok := m["z"].(int32); ok {
+		m["z"] = z + offset.Z()*16
+	}
+	if ticks, ok := m["tickList"].([]any); ok {
+		for _, t := range ticks {
+			if t, ok := t.(map[string]any); ok {
+				moveBlockNBT(t, offset)
+			}
+		}
+	}
+}
+
+// moveSpawners moves the areas in a list of hardcoded spawners, such as those
+// of nether fortresses and witch huts, by offset. The list holds an int32 count
+// followed by the minimum and maximum X, Y and Z of every area as int32s and a
+// byte with the type of the area.
+func moveSpawners(data []byte, offset ChunkPos) ([]byte, error) {
+	const size = 6*4 + 1
+	if len(data) < 4 {
+		return nil, fmt.Errorf("hardcoded spawners too short")
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	if n < 0 || len(data) != 4+n*size {
+		return nil, fmt.Errorf("hardcoded spawners: %d bytes for %d areas", len(data), n)
+	}
+	out := append([]byte(nil), data...)
+	for i := 0; i < n; i++ {
+		area := out[4+i*size:]
+		for _, j := range [...]int{0, 3} {
+			x := int32(binary.LittleEndian.Uint32(area[j*4:]))
+			z := int32(binary.LittleEndian.Uint32(area[(j+2)*4:]))
+			binary.LittleEndian.PutUint32(area[j*4:], uint32(x+offset.X()*16))
+			binary.LittleEndian.PutUint32(area[(j+2)*4:], uint32(z+offset.Z()*16))
+		}
+	}
+	return out, nil
+}
+
+// moveEntity moves all positions of an entity by offset. It returns the
+// largest distance a position is off after moving, as positions are stored in
+// limited precision.
+func moveEntity(m map[string]any, offset ChunkPos) (float64, error) {
+	e, err := decodeEntityNBT(m)
+	if err != nil {
+		id, _ := m["identifier"].(string)
+		return 0, fmt.Errorf("%s: %w", id, err)
+	}
+	loss, err := e.move(mgl64.Vec3{float64(offset.X()) * 16, 0, float64(offset.Z()) * 16}, m)
+	if err != nil {
+		id, _ := m["identifier"].(string)
+		return 0, fmt.Errorf("%s: %w", id, err)
+	}
+	e.encode(m)
+	return loss, nil
+}
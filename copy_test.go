@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// TestWorldMoveInvalidEntity checks that an entity without a valid position
+// is dropped, together with its unique ID in the actor digest, while the other
+// entities are moved.
+func TestWorldMoveInvalidEntity(t *testing.T) {
+	mv := &worldMove{offset: ChunkPos{1, -2}}
+	valid := map[string]any{"identifier": "minecraft:pig", "Pos": []any{float32(1), float32(64), float32(2)}}
+	invalid := map[string]any{"identifier": "minecraft:pig", "Pos": []any{float32(1), "64"}}
+	missing := map[string]any{"identifier": "minecraft:cow"}
+	uids := [][]byte{{1, 0, 0, 0, 0, 0, 0, 0}, {2, 0, 0, 0, 0, 0, 0, 0}}
+
+	if !mv.actor(uids[0], valid) {
+		t.Fatal("entity with a valid position was dropped")
+	}
+	if mv.actor(uids[1], invalid) {
+		t.Error("entity with an invalid position was kept")
+	}
+	if mv.entity(missing) {
+		t.Error("entity without a position was kept")
+	}
+	if pos := valid["Pos"].([]any); pos[0] != float32(17) || pos[2] != float32(-30) {
+		t.Errorf("entity was moved to %v, want 17 64 -30", pos)
+	}
+	if mv.invalid != 2 || mv.invalidErr == nil {
+		t.Errorf("counted %d invalid entities with error %v, want 2", mv.invalid, mv.invalidErr)
+	}
+	if digp := mv.digest(append(append([]byte(nil), uids[0]...), uids[1]...)); !bytes.Equal(digp, uids[0]) {
+		t.Errorf("digest is %x, want %x", digp, uids[0])
+	}
+}
+
+// TestAssignUniqueIDs checks that a unique ID used by more than one world is
+// only kept by the first, and that the new unique IDs are used by no world.
+func TestAssignUniqueIDs(t *testing.T) {
+	a := &worldMap{manifest: &worldManifest{Actors: []int64{1, 2, 5}}}
+	b := &worldMap{manifest: &worldManifest{Actors: []int64{2, 3, 6}}}
+	c := &worldMap{manifest: &worldManifest{Actors: []int64{2, 6, 6}}}
+	if n := assignUniqueIDs([]*worldMap{a, b, c}); n != 3 {
+		t.Errorf("replaced %d unique IDs, want 3", n)
+	}
+	if len(a.ids) != 0 {
+		t.Errorf("first world got new unique IDs %v", a.ids)
+	}
+	if b.ids[2] != 7 || len(b.ids) != 1 {
+		t.Errorf("second world got new unique IDs %v, want 2 as 7", b.ids)
+	}
+	if c.ids[2] != 8 || c.ids[6] != 9 || len(c.ids) != 2 {
+		t.Errorf("third world got new unique IDs %v, want 2 as 8 and 6 as 9", c.ids)
+	}
+
+	digp := []byte{2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}
+	if got := b.ids.digest(digp); !bytes.Equal(got, []byte{7, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("digest is %x after assigning unique IDs", got)
+	}
+	m := map[string]any{
+		"UniqueID":  int64(2),
+		"LeasherID": int64(2),
+		"LinksTag":  []any{map[string]any{"entityID": int64(2), "LinkID": int32(0)}, map[string]any{"entityID": int64(3), "LinkID": int32(1)}},
+	}
+	b.ids.entity(m)
+	if m["UniqueID"] != int64(7) || m["LeasherID"] != int64(7) {
+		t.Errorf("entity has unique ID %v and leasher %v, want 7", m["UniqueID"], m["LeasherID"])
+	}
+	links := m["LinksTag"].([]any)
+	if links[0].(map[string]any)["entityID"] != int64(7) || links[1].(map[string]any)["entityID"] != int64(3) {
+		t.Errorf("entity links %v, want 7 and 3", links)
+	}
+}
+
+// TestMoveSpawners checks that the areas of hardcoded spawners are moved by
+// whole chunks on X and Z only.
+func TestMoveSpawners(t *testing.T) {
+	data := binary.LittleEndian.AppendUint32(nil, 1)
+	for _, v := range []int32{-5, 30, 7, 20, 60, 40} {
+		data = binary.LittleEndian.AppendUint32(data, uint32(v))
+	}
+	data = append(data, 1)
+	out, err := moveSpawners(data, ChunkPos{2, -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int32{27, 30, -9, 52, 60, 24} {
+		if got := int32(binary.LittleEndian.Uint32(out[4+i*4:])); got != want {
+			t.Errorf("coordinate %d is %d, want %d", i, got, want)
+		}
+	}
+	if out[len(out)-1] != 1 || data[4] != byte(0xfb) {
+		t.Error("type of the area changed or the source was modified")
+	}
+	if _, err := moveSpawners(data[:10], ChunkPos{}); err == nil {
+		t.Error("truncated spawners were moved")
+	}
+}
+
+// TestMoveEntityOverflow checks that an entity whose integer position no
+// longer fits once moved fails, while a home position that doesn't fit is
+// left unchanged.
+func TestMoveEntityOverflow(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		pos  any
+		ok   bool
+	}{
+		{"int32", []int32{math.MaxInt32 - 5, 64, 0}, false},
+		{"int32 fits", []int32{math.MaxInt32 - 16, 64, 0}, true},
+		{"int16", []any{int16(math.MaxInt16), int16(64), int16(0)}, false},
+		{"byte", []any{uint8(250), uint8(64), uint8(0)}, false},
+		{"float32", []any{float32(1e30), float32(64), float32(0)}, true},
+		{"float64", []any{float64(1e300), float64(64), float64(0)}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := map[string]any{"identifier": "minecraft:pig", "Pos": c.pos}
+			_, err := moveEntity(m, ChunkPos{1, 0})
+			if (err == nil) != c.ok {
+				t.Errorf("moveEntity: %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+
+	m := map[string]any{
+		"identifier": "minecraft:bee",
+		"Pos":        []any{float32(0), float32(64), float32(0)},
+		"HomePos":    []int32{math.MaxInt32, 64, 0},
+	}
+	if _, err := moveEntity(m, ChunkPos{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if home := m["HomePos"].([]int32); home[0] != math.MaxInt32 {
+		t.Errorf("home position moved to %v despite not fitting", home)
+	}
+	if pos := m["Pos"].([]any); pos[0] != float32(16) {
+		t.Errorf("entity moved to %v, want x=16", pos)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path"
+	"text/tabwriter"
+
+	"github.com/df-mc/dragonfly/server/world/chunk"
+)
+
+// dryRunSummary describes the world a merge would write, as computed by
+// -dry-run without writing it.
+type dryRunSummary struct {
+	Worlds int
+	// Chunks is the number of chunks copied from the worlds, Conflicts the
+	// number of chunks present in more than one world, of which Merged are
+	// merged block by block.
+	Chunks, Conflicts, Merged int
+	Fill                      int64
+	// Size is the estimated size of the LevelDB of the merged world.
+	Size int64
+	// Problems are the problems of the layout, Failed the worlds that couldn't
+	// be opened and are left out.
+	Problems []string
+	Failed   []string
+}
+
+// summarizeMerge computes the dryRunSummary of merging the worlds of root,
+// laid out in mode. The size of every world is taken from the LevelDB files in
+// its archive, in proportion to the chunks copied from it.
+func summarizeMerge(root *mapGroup, mode mergeMode, conflicts []*chunkConflict, fill *chunk.Chunk) *dryRunSummary {
+	s := &dryRunSummary{Conflicts: len(conflicts)}
+	perChunk := make(map[*worldMap]float64)
+	for _, w := range allWorlds(root) {
+		s.Worlds++
+		n := len(w.manifest.Chunks) - len(w.skip)
+		s.Chunks += n
+		size, err := archiveDBSize(w.source)
+		if err != nil || len(w.manifest.Chunks) == 0 {
+			continue
+		}
+		perChunk[w] = float64(size) / float64(len(w.manifest.Chunks))
+		s.Size += int64(perChunk[w] * float64(n))
+	}
+	for _, c := range conflicts {
+		if c.Winner == "" && len(c.worlds) > 0 {
+			s.Merged++
+			s.Size += int64(perChunk[c.worlds[0]])
+		}
+	}
+	if fill != nil {
+		s.Fill = newFillArea(root, mode).count()
+		s.Size += s.Fill * compressedChunkSize(encodeChunk(fill))
+	}
+	return s
+}
+
+// archiveDBSize returns the total size of the files of the LevelDB in the
+// .mcworld file filename, read from the central directory of the archive.
+func archiveDBSize(filename string) (int64, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	var size int64
+	for _, f := range zr.File {
+		dir, base := path.Split(f.Name)
+		if _, ok := levelDBFile(base); ok && dir == "db/" {
+			size += int64(f.UncompressedSize64)
+		}
+	}
+	return size, nil
+}
+
+// compressedChunkSize returns the size of the data of e once compressed the
+// way the output LevelDB compresses it.
+func compressedChunkSize(e encodedChunk) int64 {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(e.data3D)
+	for _, sub := range e.subChunks {
+		fw.Write(sub)
+	}
+	fw.Close()
+	return int64(buf.Len())
+}
+
+// writeTable writes the summary as a table.
+func (s *dryRunSummary) writeTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Worlds\t%d\n", s.Worlds)
+	fmt.Fprintf(tw, "Chunks\t%d\n", int64(s.Chunks+s.Merged)+s.Fill)
+	fmt.Fprintf(tw, "  copied\t%d\n", s.Chunks)
+	fmt.Fprintf(tw, "  merged\t%d\n", s.Merged)
+	fmt.Fprintf(tw, "  fill\t%d\n", s.Fill)
+	fmt.Fprintf(tw, "Conflicts\t%d\n", s.Conflicts)
+	fmt.Fprintf(tw, "Estimated size\t%s\n", formatBytes(s.Size))
+	fmt.Fprintf(tw, "Layout problems\t%d\n", len(s.Problems))
+	for _, p := range s.Problems {
+		fmt.Fprintf(tw, "  \t%s\n", p)
+	}
+	fmt.Fprintf(tw, "Failed worlds\t%d\n", len(s.Failed))
+	for _, f := range s.Failed {
+		fmt.Fprintf(tw, "  \t%s\n", f)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestDryRunSummary checks that the summary of a dry run predicts the chunks
+// the merge writes, with chunks present in more than one world merged or taken
+// from one of them.
+func TestDryRunSummary(t *testing.T) {
+	in := writeTestWorlds(t, []testWorld{
+		{"g/a", "minecraft:iron_block", ChunkPos{0, 0}, 3},
+		{"g/b", "minecraft:gold_block", ChunkPos{2, 2}, 2},
+	})
+	for _, c := range []struct {
+		policy                 conflictPolicy
+		wantChunks, wantMerged int
+	}{
+		{conflictFirst, 12, 0},
+		{conflictNonAir, 11, 1},
+	} {
+		t.Run(string(c.policy), func(t *testing.T) {
+			root, conflicts := loadTestWorlds(t, in, modeOriginal, c.policy)
+			s := summarizeMerge(root, modeOriginal, conflicts, nil)
+			if s.Worlds != 2 || s.Chunks != c.wantChunks || s.Merged != c.wantMerged || s.Conflicts != 1 {
+				t.Errorf("summary %+v, want 2 worlds, %d chunks copied, %d merged and 1 conflict", s, c.wantChunks, c.wantMerged)
+			}
+			if s.Size <= 0 {
+				t.Errorf("estimated size %d", s.Size)
+			}
+
+			db := mergeTestWorlds(t, root, conflicts, c.policy, nil)
+			if n := len(outputBlocks(t, db)); n != s.Chunks+s.Merged {
+				t.Errorf("merge wrote %d chunks, the summary predicted %d", n, s.Chunks+s.Merged)
+			}
+
+			var buf bytes.Buffer
+			s.writeTable(&buf)
+			for _, want := range []string{
+				"Worlds           2\n",
+				fmt.Sprintf("Chunks           %d\n", s.Chunks+s.Merged),
+				fmt.Sprintf("  merged         %d\n", s.Merged),
+				"Conflicts        1\n",
+			} {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("table doesn't hold %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
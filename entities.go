@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// entityRules decide which entities of the worlds are copied, read from a JSON
+// file such as:
+//
+//	{
+//	  "exclude": [
+//	    {"identifier": "minecraft:item"},
+//	    {"identifier": "@hostile"},
+//	    {"identifier": "minecraft:armor_stand", "tags": ["lag"]}
+//	  ],
+//	  "maxPerChunk": 64,
+//	  "stripNames": true
+//	}
+type entityRules struct {
+	// Include, if not empty, drops every entity that matches none of its
+	// entries. Exclude drops every entity that matches one of its entries.
+	Include []entityMatch `json:"include,omitempty"`
+	Exclude []entityMatch `json:"exclude,omitempty"`
+	// MaxPerChunk is the largest number of entities kept in a chunk, 0 for no
+	// limit. Entities are kept in the order they are stored.
+	MaxPerChunk int `json:"maxPerChunk,omitempty"`
+	// StripNames removes the custom names of all entities.
+	StripNames bool `json:"stripNames,omitempty"`
+}
+
+// entityMatch matches entities by their identifier and tags.
+type entityMatch struct {
+	// Identifier is a pattern as used by path.Match, such as minecraft:* or
+	// minecraft:zombie*, or @hostile for all hostile mobs. An empty
+	// identifier matches all entities.
+	Identifier string `json:"identifier,omitempty"`
+	// Tags are tags the entity must all have, as added by the /tag command.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// hostileEntities are the identifiers matched by @hostile.
+var hostileEntities = map[string]bool{
+	"minecraft:blaze": true, "minecraft:bogged": true, "minecraft:breeze": true, "minecraft:cave_spider": true,
+	"minecraft:creeper": true, "minecraft:drowned": true, "minecraft:elder_guardian": true, "minecraft:ender_dragon": true,
+	"minecraft:enderman": true, "minecraft:endermite": true, "minecraft:evocation_illager": true, "minecraft:ghast": true,
+	"minecraft:guardian": true, "minecraft:hoglin": true, "minecraft:husk": true, "minecraft:magma_cube": true,
+	"minecraft:phantom": true, "minecraft:piglin_brute": true, "minecraft:pillager": true, "minecraft:ravager": true,
+	"minecraft:shulker": true, "minecraft:silverfish": true, "minecraft:skeleton": true, "minecraft:slime": true,
+	"minecraft:spider": true, "minecraft:stray": true, "minecraft:vex": true, "minecraft:vindicator": true,
+	"minecraft:warden": true, "minecraft:witch": true, "minecraft:wither": true, "minecraft:wither_skeleton": true,
+	"minecraft:zoglin": true, "minecraft:zombie": true, "minecraft:zombie_pigman": true, "minecraft:zombie_villager": true,
+	"minecraft:zombie_villager_v2": true,
+}
+
+// loadEntityRules reads entityRules from the file filename. An empty filename
+// returns nil.
+func loadEntityRules(filename string) (*entityRules, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules entityRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, m := range append(rules.Include, rules.Exclude...) {
+		if _, err := path.Match(m.Identifier, ""); err != nil {
+			return nil, fmt.Errorf("%s: identifier %q: %w", filename, m.Identifier, err)
+		}
+	}
+	if rules.MaxPerChunk < 0 {
+		return nil, fmt.Errorf("%s: maxPerChunk must not be negative", filename)
+	}
+	return &rules, nil
+}
+
+// keep checks if the entity m with the identifier id passes the include and
+// exclude rules.
+func (r *entityRules) keep(id string, m map[string]any) bool {
+	if r == nil {
+		return true
+	}
+	if len(r.Include) > 0 && !matchEntity(r.Include, id, m) {
+		return false
+	}
+	return !matchEntity(r.Exclude, id, m)
+}
+
+// matchEntity checks if one of matches matches the entity m with the
+// identifier id.
+func matchEntity(matches []entityMatch, id string, m map[string]any) bool {
+	for _, match := range matches {
+		switch match.Identifier {
+		case "":
+		case "@hostile":
+			if !hostileEntities[id] {
+				continue
+			}
+		default:
+			if ok, _ := path.Match(match.Identifier, id); !ok {
+				continue
+			}
+		}
+		if hasTags(m, match.Tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTags checks if the entity m has all tags.
+func hasTags(m map[string]any, tags []string) bool {
+	list, _ := m["Tags"].([]any)
+	for _, tag := range tags {
+		found := false
+		for _, t := range list {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// stripName removes the custom name of the entity m, returning true if it had
+// one.
+func stripName(m map[string]any) bool {
+	_, named := m["CustomName"]
+	delete(m, "CustomName")
+	delete(m, "CustomNameVisible")
+	return named
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+)
+
+// testEntity returns the NBT of an entity with the identifier id and tags.
+func testEntity(id string, tags ...string) map[string]any {
+	list := make([]any, len(tags))
+	for i, tag := range tags {
+		list[i] = tag
+	}
+	return map[string]any{"identifier": id, "Tags": list}
+}
+
+// TestEntityRules checks which entities the include and exclude rules keep.
+func TestEntityRules(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		rules  *entityRules
+		entity map[string]any
+		keep   bool
+	}{
+		{"no rules", nil, testEntity("minecraft:zombie"), true},
+		{"exclude identifier", &entityRules{Exclude: []entityMatch{{Identifier: "minecraft:item"}}}, testEntity("minecraft:item"), false},
+		{"exclude other identifier", &entityRules{Exclude: []entityMatch{{Identifier: "minecraft:item"}}}, testEntity("minecraft:pig"), true},
+		{"exclude pattern", &entityRules{Exclude: []entityMatch{{Identifier: "minecraft:zombie*"}}}, testEntity("minecraft:zombie_villager_v2"), false},
+		{"exclude hostile", &entityRules{Exclude: []entityMatch{{Identifier: "@hostile"}}}, testEntity("minecraft:creeper"), false},
+		{"exclude hostile passive", &entityRules{Exclude: []entityMatch{{Identifier: "@hostile"}}}, testEntity("minecraft:cow"), true},
+		{"exclude tag", &entityRules{Exclude: []entityMatch{{Identifier: "minecraft:armor_stand", Tags: []string{"lag"}}}}, testEntity("minecraft:armor_stand", "lag", "shop"), false},
+		{"exclude tag missing", &entityRules{Exclude: []entityMatch{{Identifier: "minecraft:armor_stand", Tags: []string{"lag"}}}}, testEntity("minecraft:armor_stand", "shop"), true},
+		{"exclude all tags", &entityRules{Exclude: []entityMatch{{Tags: []string{"a", "b"}}}}, testEntity("minecraft:pig", "a"), true},
+		{"exclude any identifier with tag", &entityRules{Exclude: []entityMatch{{Tags: []string{"a"}}}}, testEntity("addon:robot", "a"), false},
+		{"include", &entityRules{Include: []entityMatch{{Identifier: "minecraft:villager*"}}}, testEntity("minecraft:villager_v2"), true},
+		{"include other", &entityRules{Include: []entityMatch{{Identifier: "minecraft:villager*"}}}, testEntity("minecraft:pig"), false},
+		{"include then exclude", &entityRules{Include: []entityMatch{{Identifier: "minecraft:*"}}, Exclude: []entityMatch{{Identifier: "@hostile"}}}, testEntity("minecraft:skeleton"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			id, _ := c.entity["identifier"].(string)
+			if keep := c.rules.keep(id, c.entity); keep != c.keep {
+				t.Errorf("keep %v, want %v", keep, c.keep)
+			}
+		})
+	}
+}
+
+// TestEntityRulesTransform checks that maxPerChunk limits the entities of
+// every chunk and that stripNames removes custom names.
+func TestEntityRulesTransform(t *testing.T) {
+	tr := &transform{
+		entities: &entityRules{MaxPerChunk: 2, StripNames: true, Exclude: []entityMatch{{Identifier: "minecraft:item"}}},
+		unknown:  unknownNone,
+		report:   &transformReport{},
+	}
+	wt := tr.forWorld("w")
+	a := iterKey{pos: world.ChunkPos{0, 0}, dim: world.Overworld}
+	b := iterKey{pos: world.ChunkPos{1, 0}, dim: world.Overworld}
+
+	named := testEntity("minecraft:pig")
+	named["CustomName"], named["CustomNameVisible"] = "Bob", uint8(1)
+	for i, c := range []struct {
+		k      iterKey
+		entity map[string]any
+		keep   bool
+	}{
+		{a, named, true},
+		// Dropped entities don't count towards the limit.
+		{a, testEntity("minecraft:item"), false},
+		{a, testEntity("minecraft:cow"), true},
+		{a, testEntity("minecraft:sheep"), false},
+		{b, testEntity("minecraft:sheep"), true},
+	} {
+		if keep := wt.entity(c.k, c.entity); keep != c.keep {
+			t.Errorf("entity %d (%s): keep %v, want %v", i, c.entity["identifier"], keep, c.keep)
+		}
+	}
+	if _, ok := named["CustomName"]; ok {
+		t.Errorf("custom name wasn't stripped")
+	}
+	if _, ok := named["CustomNameVisible"]; ok {
+		t.Errorf("CustomNameVisible wasn't stripped")
+	}
+	for change, want := range map[string]int{
+		"dropped minecraft:item (rules)":        1,
+		"dropped minecraft:sheep (chunk limit)": 1,
+		"stripped custom names":                 1,
+	} {
+		if got := wt.changes[change]; got != want {
+			t.Errorf("%d changes %q, want %d", got, change, want)
+		}
+	}
+}
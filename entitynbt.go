@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// precisionWarning is the distance in blocks an entity position may be off
+// after moving it before it is counted as having lost precision. Positions
+// are stored as float32, which can only hold far coordinates in large steps.
+const precisionWarning = 1.0 / 16
+
+// entityNBT is a typed view of the fields of entity NBT the merger reads or
+// changes. Every number may be stored as any NBT numeric type, the type it had
+// is kept when the entity is encoded again.
+type entityNBT struct {
+	Pos      mgl64.Vec3
+	Rotation [2]float64
+	Motion   mgl64.Vec3
+	// Home is the home position of mobs that return to one, such as turtles
+	// and bees. It is nil if the entity doesn't have a valid one. Leashed mobs
+	// refer to what they are tied to by its unique ID in LeasherID, which
+	// doesn't change when the entity is moved but may be replaced by
+	// uniqueIDs.entity.
+	Home *mgl64.Vec3
+}
+
+// decodeEntityNBT decodes the fields of entityNBT from the entity m. An entity
+// without a valid position fails, a missing or invalid rotation or motion is
+// left at zero and an invalid home position is left unchanged.
+func decodeEntityNBT(m map[string]any) (entityNBT, error) {
+	var e entityNBT
+	var err error
+	if e.Pos, err = listVec3(m, "Pos"); err != nil {
+		return e, err
+	}
+	if r, ok := numbers(m["Rotation"]); ok && len(r) == 2 {
+		e.Rotation[0], _ = finiteNumber(r[0])
+		e.Rotation[1], _ = finiteNumber(r[1])
+	}
+	if _, ok := m["Motion"]; ok {
+		e.Motion, _ = listVec3(m, "Motion")
+	}
+	if _, ok := m["HomePos"]; ok {
+		if home, err := listVec3(m, "HomePos"); err == nil {
+			e.Home = &home
+		}
+	}
+	return e, nil
+}
+
+// encode writes the fields of e to the entity m they were decoded from.
+func (e entityNBT) encode(m map[string]any) {
+	setListVec3(m, "Pos", e.Pos)
+	if r, ok := numbers(m["Rotation"]); ok && len(r) == 2 {
+		m["Rotation"] = withNumbers(m["Rotation"], e.Rotation[:])
+	}
+	if _, ok := m["Motion"]; ok {
+		setListVec3(m, "Motion", e.Motion)
+	}
+	if e.Home != nil {
+		setListVec3(m, "HomePos", *e.Home)
+	}
+}
+
+// move moves all positions of e by the block offset d. It returns the largest
+// distance any of the positions is off once stored again in the numeric types
+// they were decoded from. It fails if the position no longer fits in its
+// numeric type, a home position that doesn't fit is left unchanged.
+func (e *entityNBT) move(d mgl64.Vec3, m map[string]any) (loss float64, err error) {
+	pos := e.Pos.Add(d)
+	if err := checkStore(m["Pos"], pos); err != nil {
+		return 0, fmt.Errorf("Pos: %w", err)
+	}
+	e.Pos = pos
+	loss = storeLoss(m["Pos"], e.Pos)
+	if e.Home != nil {
+		home := e.Home.Add(d)
+		if checkStore(m["HomePos"], home) != nil {
+			e.Home = nil
+			return loss, nil
+		}
+		*e.Home = home
+		loss = math.Max(loss, storeLoss(m["HomePos"], *e.Home))
+	}
+	return loss, nil
+}
+
+// checkStore checks that every element of v fits in the numeric type of the
+// element of the list orig at the same index.
+func checkStore(orig any, v mgl64.Vec3) error {
+	list, _ := numbers(orig)
+	for i, f := range v {
+		if i < len(list) && !fitsNumber(list[i], f) {
+			return fmt.Errorf("%v doesn't fit in %T", f, list[i])
+		}
+	}
+	return nil
+}
+
+// storeLoss returns how far v is off once stored in the numeric type of the
+// elements of the list orig.
+func storeLoss(orig any, v mgl64.Vec3) (loss float64) {
+	list, _ := numbers(orig)
+	for i, f := range v {
+		if i < len(list) {
+			if stored, ok := finiteNumber(numberAs(list[i], f)); ok {
+				loss = math.Max(loss, math.Abs(stored-f))
+			}
+		}
+	}
+	return loss
+}
+
+// listVec3 reads the list of three numbers stored under key in m.
+func listVec3(m map[string]any, key string) (mgl64.Vec3, error) {
+	var v mgl64.Vec3
+	list, ok := numbers(m[key])
+	if m[key] == nil {
+		return v, fmt.Errorf("%s: missing", key)
+	} else if !ok || len(list) != 3 {
+		return v, fmt.Errorf("%s: expected a list of 3 numbers, got %T %v", key, m[key], m[key])
+	}
+	for i, n := range list {
+		if v[i], ok = finiteNumber(n); !ok {
+			return v, fmt.Errorf("%s: invalid number %v", key, n)
+		}
+	}
+	return v, nil
+}
+
+// setListVec3 writes v to the list of three numbers stored under key in m,
+// keeping the type of every number. The list is created as float32s, the type
+// the game uses, if it doesn't exist or is invalid.
+func setListVec3(m map[string]any, key string, v mgl64.Vec3) {
+	if list, ok := numbers(m[key]); !ok || len(list) != 3 {
+		m[key] = []any{float32(0), float32(0), float32(0)}
+	}
+	m[key] = withNumbers(m[key], v[:])
+}
+
+// numbers returns the elements of an NBT list or array. Lists of bytes, ints
+// and longs are decoded as slices of their type, all other lists as []any.
+func numbers(v any) ([]any, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
+
+// withNumbers returns a copy of the NBT list or array v of the same type,
+// with its elements set to fs. v must have as many elements as fs.
+func withNumbers(v any, fs []float64) any {
+	rv := reflect.ValueOf(v)
+	out := reflect.New(rv.Type()).Elem()
+	if rv.Kind() == reflect.Slice {
+		out = reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+	}
+	for i := 0; i < rv.Len(); i++ {
+		out.Index(i).Set(reflect.ValueOf(numberAs(rv.Index(i).Interface(), fs[i])))
+	}
+	return out.Interface()
+}
+
+// finiteNumber converts the NBT number v to a float64. It returns false if v
+// isn't a number or isn't finite.
+func finiteNumber(v any) (float64, bool) {
+	var f float64
+	switch v := v.(type) {
+	case uint8:
+		f = float64(v)
+	case int16:
+		f = float64(v)
+	case int32:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return 0, false
+	}
+	return f, !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// fitsNumber checks if f, rounded to the nearest integer for integer types,
+// is in the range of the NBT numeric type of orig.
+func fitsNumber(orig any, f float64) bool {
+	r := math.Round(f)
+	switch orig.(type) {
+	case uint8:
+		return r >= 0 && r <= math.MaxUint8
+	case int16:
+		return r >= math.MinInt16 && r <= math.MaxInt16
+	case int32:
+		return r >= math.MinInt32 && r <= math.MaxInt32
+	case int64:
+		// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit.
+		return r >= math.MinInt64 && r < math.MaxInt64
+	case float64:
+		return true
+	}
+	return math.Abs(f) <= math.MaxFloat32
+}
+
+// numberAs converts f to the NBT numeric type of orig, rounding it to the
+// nearest integer for integer types. f is converted to a float32 if orig isn't
+// a number.
+func numberAs(orig any, f float64) any {
+	switch orig.(type) {
+	case uint8:
+		return uint8(math.Round(f))
+	case int16:
+		return int16(math.Round(f))
+	case int32:
+		return int32(math.Round(f))
+	case int64:
+		return int64(math.Round(f))
+	case float64:
+		return f
+	}
+	return float32(f)
+}
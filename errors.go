@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errorPolicy decides what happens to the merge when adding a world fails.
+type errorPolicy string
+
+const (
+	// policyFailFast stops the whole merge on the first error. No output
+	// archive is written.
+	policyFailFast errorPolicy = "fail-fast"
+	// policySkipWorld removes every key written for a world that failed and
+	// continues with the other worlds.
+	policySkipWorld errorPolicy = "skip-world"
+	// policyBestEffort keeps going after errors, copying as much of every
+	// world as possible.
+	policyBestEffort errorPolicy = "best-effort"
+)
+
+func parseErrorPolicy(s string) (errorPolicy, error) {
+	switch p := errorPolicy(s); p {
+	case policyFailFast, policySkipWorld, policyBestEffort:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown error policy %q", s)
+}
+
+// worldError is an error that occurred while adding a world to the output.
+type worldError struct {
+	World string
+	Err   error
+}
+
+func (e *worldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.World, e.Err)
+}
+
+func (e *worldError) Unwrap() error {
+	return e.Err
+}
+
+// errorCollector collects the errors of all worlds of a merge and applies the
+// errorPolicy to them. It is safe for concurrent use.
+type errorCollector struct {
+	policy errorPolicy
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	errs []*worldError
+}
+
+func newErrorCollector(policy errorPolicy) *errorCollector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &errorCollector{policy: policy, ctx: ctx, cancel: cancel}
+}
+
+// Context returns a context that is cancelled once the merge should stop.
+func (c *errorCollector) Context() context.Context {
+	return c.ctx
+}
+
+// chunkError records an error that only affects a single chunk of a world. It
+// returns true if the world should continue with the next chunk.
+func (c *errorCollector) chunkError(world string, err error) bool {
+	if c.policy != policyBestEffort {
+		return false
+	}
+	c.record(world, err)
+	return true
+}
+
+// worldError records an error that stopped a world from being added. It
+// returns true if the keys already written for the world should be removed.
+func (c *errorCollector) worldError(world string, err error) bool {
+	if errors.Is(err, context.Canceled) && c.ctx.Err() != nil {
+		// Another world failed and stopped the merge, this world has nothing
+		// to report by itself.
+		return false
+	}
+	c.record(world, err)
+	switch c.policy {
+	case policyFailFast:
+		c.cancel()
+	case policySkipWorld:
+		return true
+	}
+	return false
+}
+
+// abort records an error that affects the whole merge, such as failing to
+// write the output, and stops the merge.
+func (c *errorCollector) abort(err error) {
+	c.record("output", err)
+	c.cancel()
+}
+
+func (c *errorCollector) record(world string, err error) {
+	logrus.Errorf("%s: %v", world, err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, &worldError{World: world, Err: err})
+}
+
+// Err returns all errors collected joined together, or nil if there were
+// none.
+func (c *errorCollector) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errs := make([]error, len(c.errs))
+	for i, err := range c.errs {
+		errs[i] = err
+	}
+	return errors.Join(errs...)
+}
+
+// Report logs a summary of all worlds that had errors.
+func (c *errorCollector) Report() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) == 0 {
+		return
+	}
+	perWorld := make(map[string]int)
+	for _, err := range c.errs {
+		perWorld[err.World]++
+	}
+	worlds := make([]string, 0, len(perWorld))
+	for w := range perWorld {
+		worlds = append(worlds, w)
+	}
+	sort.Strings(worlds)
+
+	logrus.Errorf("%d errors in %d worlds (policy %s):", len(c.errs), len(worlds), c.policy)
+	for _, w := range worlds {
+		logrus.Errorf("  %s: %d errors", w, perWorld[w])
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+)
+
+// breakTestWorld rewrites the world w of the input folder in so that the
+// block entities of its first chunk aren't valid NBT, failing that chunk when
+// it is copied.
+func breakTestWorld(t *testing.T, in string, w testWorld) {
+	t.Helper()
+	rewriteTestWorld(t, in, w, func(dir string) {
+		ldb, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := append(key_index(world.ChunkPos(w.min), world.Overworld), keyBlockEntities)
+		if err := ldb.Put(key, []byte{0x0a, 0xff, 0xff, 0x01}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ldb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestErrorPolicies merges the test worlds with a chunk of one world broken
+// and checks what each error policy leaves in the output.
+func TestErrorPolicies(t *testing.T) {
+	broken := testWorlds[1]
+	for _, c := range []struct {
+		policy errorPolicy
+		// want is the number of chunks of the broken world and of the other
+		// worlds expected in the output, -1 if it isn't known.
+		wantBroken, wantOthers int
+		cancelled              bool
+	}{
+		{policyFailFast, -1, -1, true},
+		{policySkipWorld, 0, otherChunks(broken), false},
+		{policyBestEffort, int(broken.size * broken.size), otherChunks(broken), false},
+	} {
+		t.Run(string(c.policy), func(t *testing.T) {
+			in := writeTestWorlds(t, testWorlds)
+			breakTestWorld(t, in, broken)
+			root, conflicts := loadTestWorlds(t, in, modeOriginal, conflictFirst)
+			errs := newErrorCollector(c.policy)
+			db := mergeTestWorldsErrors(t, root, conflicts, conflictFirst, nil, newProgress(progressNone), errs)
+
+			if errs.Err() == nil {
+				t.Fatal("no error for the broken chunk")
+			}
+			if cancelled := errs.Context().Err() != nil; cancelled != c.cancelled {
+				t.Errorf("merge cancelled: %v, want %v", cancelled, c.cancelled)
+			}
+			var gotBroken, gotOthers int
+			for _, name := range outputBlocks(t, db) {
+				if name == broken.block {
+					gotBroken++
+				} else {
+					gotOthers++
+				}
+			}
+			if c.wantBroken >= 0 && gotBroken != c.wantBroken {
+				t.Errorf("%d chunks of the broken world in the output, want %d", gotBroken, c.wantBroken)
+			}
+			if c.wantOthers >= 0 && gotOthers != c.wantOthers {
+				t.Errorf("%d chunks of the other worlds in the output, want %d", gotOthers, c.wantOthers)
+			}
+		})
+	}
+}
+
+// otherChunks returns the number of chunks of all test worlds but w.
+func otherChunks(w testWorld) int {
+	var n int
+	for _, o := range testWorlds {
+		if o.name != w.name {
+			n += int(o.size * o.size)
+		}
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"os"
+	"path"
+)
+
+// geoFeatureCollection is a GeoJSON FeatureCollection of all groups and worlds
+// in the layout. Coordinates are block coordinates, with GeoJSON x being the
+// block x and GeoJSON y the block z, so that it can be drawn with a flat
+// coordinate system such as L.CRS.Simple in Leaflet.
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+type geoFeature struct {
+	Type       string        `json:"type"`
+	Geometry   geoPolygon    `json:"geometry"`
+	Properties geoProperties `json:"properties"`
+}
+
+type geoPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+type geoProperties struct {
+	// Kind is either "group" or "world".
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Path is the path of the group or world relative to the input folder,
+	// Depth the number of groups it is nested in.
+	Path  string `json:"path"`
+	Depth int    `json:"depth"`
+
+	Source string    `json:"source,omitempty"`
+	Chunks int       `json:"chunks,omitempty"`
+	Spawn  *[3]int32 `json:"spawn,omitempty"`
+}
+
+// layoutGeoJSON converts the groups and worlds of m into GeoJSON polygons.
+// Groups come before the worlds inside of them, so that worlds are drawn on top.
+func layoutGeoJSON(m mapJson) geoFeatureCollection {
+	fc := geoFeatureCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+	root := m.Groups["root"]
+	for _, name := range sortedKeys(root.Groups) {
+		groupGeoJSON(root.Groups[name], name, 0, &fc)
+	}
+	for _, name := range sortedKeys(root.Worlds) {
+		worldGeoJSON(root.Worlds[name], name, 0, &fc)
+	}
+	return fc
+}
+
+func groupGeoJSON(g groupJson, groupPath string, depth int, fc *geoFeatureCollection) {
+	fc.Features = append(fc.Features, geoFeature{
+		Type:       "Feature",
+		Geometry:   blockRect(g.OffsetAbsolute, g.Size),
+		Properties: geoProperties{Kind: "group", Name: g.Name, Path: groupPath, Depth: depth},
+	})
+	for _, name := range sortedKeys(g.Groups) {
+		groupGeoJSON(g.Groups[name], path.Join(groupPath, name), depth+1, fc)
+	}
+	for _, name := range sortedKeys(g.Worlds) {
+		worldGeoJSON(g.Worlds[name], path.Join(groupPath, name), depth+1, fc)
+	}
+}
+
+func worldGeoJSON(w worldJson, worldPath string, depth int, fc *geoFeatureCollection) {
+	spawn := w.Spawn
+	fc.Features = append(fc.Features, geoFeature{
+		Type:     "Feature",
+		Geometry: blockRect(w.OffsetAbsolute, w.Size),
+		Properties: geoProperties{
+			Kind:   "world",
+			Name:   w.Name,
+			Path:   worldPath,
+			Depth:  depth,
+			Source: w.Source,
+			Chunks: w.Chunks,
+			Spawn:  &spawn,
+		},
+	})
+}
+
+// blockRect returns the polygon covering size chunks starting at the chunk
+// offset, in block coordinates.
+func blockRect(offset, size ChunkPos) geoPolygon {
+	x0, z0 := float64(offset.X())*16, float64(offset.Z())*16
+	x1, z1 := x0+float64(size.X())*16, z0+float64(size.Z())*16
+	return geoPolygon{
+		Type:        "Polygon",
+		Coordinates: [][][2]float64{{{x0, z0}, {x1, z0}, {x1, z1}, {x0, z1}, {x0, z0}}},
+	}
+}
+
+// writeGeoJSON writes the layout of m as GeoJSON to filename.
+func writeGeoJSON(m mapJson, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(layoutGeoJSON(m))
+}
+
+//go:embed viewer.html
+var viewerHTML string
+
+var viewerTemplate = template.Must(template.New("viewer").Parse(viewerHTML))
+
+// writeViewer writes a standalone HTML page to filename, drawing the layout of
+// m. The page embeds all of its data and doesn't load anything over the
+// network.
+func writeViewer(m mapJson, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return viewerTemplate.Execute(file, struct {
+		MergedAt string
+		Layout   geoFeatureCollection
+	}{
+		MergedAt: m.MergedAt.Format("2006-01-02 15:04 MST"),
+		Layout:   layoutGeoJSON(m),
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGeoJSON checks that the GeoJSON export holds a closed polygon for every
+// group and world at its position in the merged world, with every group before
+// the worlds inside of it.
+func TestGeoJSON(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds)
+	root, _ := loadTestWorlds(t, in, modeOriginal, conflictFirst)
+	mapData, err := writeGroupToJSON(root, modeOriginal, nil, filepath.Join(t.TempDir(), "map.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "map.geojson")
+	if err := writeGeoJSON(mapData, filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fc geoFeatureCollection
+	if err := json.Unmarshal(data, &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" {
+		t.Errorf("type %q, want FeatureCollection", fc.Type)
+	}
+
+	features := make(map[string]geoFeature)
+	index := make(map[string]int)
+	for i, f := range fc.Features {
+		if f.Type != "Feature" || f.Geometry.Type != "Polygon" || len(f.Geometry.Coordinates) != 1 {
+			t.Fatalf("%s: feature %+v is not a single polygon", f.Properties.Path, f)
+		}
+		ring := f.Geometry.Coordinates[0]
+		if len(ring) != 5 || ring[0] != ring[4] {
+			t.Errorf("%s: ring %v isn't closed", f.Properties.Path, ring)
+		}
+		features[f.Properties.Kind+" "+f.Properties.Path] = f
+		index[f.Properties.Path] = i
+	}
+	for _, g := range []string{"g1", "g1/sub", "g2"} {
+		if _, ok := features["group "+g]; !ok {
+			t.Errorf("group %s is missing", g)
+		}
+	}
+	for _, tw := range testWorlds {
+		f, ok := features["world "+tw.name]
+		if !ok {
+			t.Errorf("world %s is missing", tw.name)
+			continue
+		}
+		x0, z0 := float64(tw.min.X()*16), float64(tw.min.Z()*16)
+		x1, z1 := x0+float64(tw.size*16), z0+float64(tw.size*16)
+		if ring := f.Geometry.Coordinates[0]; ring[0] != [2]float64{x0, z0} || ring[2] != [2]float64{x1, z1} {
+			t.Errorf("%s: ring %v, want %v to %v", tw.name, ring, [2]float64{x0, z0}, [2]float64{x1, z1})
+		}
+		if f.Properties.Chunks != int(tw.size*tw.size) || f.Properties.Spawn == nil {
+			t.Errorf("%s: properties %+v, want %d chunks and a spawn", tw.name, f.Properties, tw.size*tw.size)
+		}
+		if group := filepath.ToSlash(filepath.Dir(tw.name)); index[group] > index[tw.name] {
+			t.Errorf("%s comes before its group %s", tw.name, group)
+		}
+	}
+	if want := 3 + len(testWorlds); len(fc.Features) != want {
+		t.Errorf("%d features, want %d", len(fc.Features), want)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/df-mc/dragonfly/server/world/mcdb"
+)
+
+// fillPattern decides what the overworld chunks between the worlds are filled
+// with.
+type fillPattern string
+
+const (
+	// fillNone leaves the chunks between worlds empty, so that they are
+	// generated by the game.
+	fillNone fillPattern = "none"
+	// fillOcean fills the chunks between worlds with ocean.
+	fillOcean fillPattern = "ocean"
+	// fillFlat fills the chunks between worlds with a flat grass layer.
+	fillFlat fillPattern = "flat"
+	// fillTemplate fills the chunks between worlds with copies of a chunk of
+	// a template world.
+	fillTemplate fillPattern = "template"
+)
+
+func parseFillPattern(s string) (fillPattern, error) {
+	switch p := fillPattern(s); p {
+	case fillNone, fillOcean, fillFlat, fillTemplate:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown fill pattern %q", s)
+}
+
+// generatorType is the generator written to the level.dat of the merged world,
+// used by the game for all chunks that are not in the output.
+type generatorType string
+
+const (
+	// generatorAuto uses a flat generator with the layers of the fill pattern
+	// if there is one, and leaves the generator unchanged otherwise.
+	generatorAuto generatorType = "auto"
+	// generatorFlat uses a flat generator, with the layers of the fill pattern
+	// if there is one.
+	generatorFlat generatorType = "flat"
+	// generatorVoid uses a flat generator without any blocks.
+	generatorVoid generatorType = "void"
+	// generatorInfinite uses the normal terrain generator.
+	generatorInfinite generatorType = "infinite"
+)
+
+func parseGeneratorType(s string) (generatorType, error) {
+	switch g := generatorType(s); g {
+	case generatorAuto, generatorFlat, generatorVoid, generatorInfinite:
+		return g, nil
+	}
+	return "", fmt.Errorf("unknown generator %q", s)
+}
+
+// Biome IDs used by the fill patterns.
+const (
+	biomeOcean  = 0
+	biomePlains = 1
+)
+
+// fillChunk returns the chunk that the padding is filled with for fillOcean
+// and fillFlat.
+func fillChunk(pattern fillPattern) (*chunk.Chunk, error) {
+	r := world.Overworld.Range()
+	c := chunk.New(world.AirRID(), r, false)
+	type layer struct {
+		// blocks holds the names the block may have, the first known to
+		// dragonfly is used.
+		blocks []string
+		states map[string]any
+		top    int
+	}
+	var layers []layer
+	var biome uint32
+	switch pattern {
+	case fillOcean:
+		layers = []layer{
+			{[]string{"minecraft:bedrock"}, map[string]any{"infiniburn_bit": uint8(0)}, r[0]},
+			{[]string{"minecraft:stone"}, map[string]any{"stone_type": "stone"}, 44},
+			{[]string{"minecraft:sand"}, map[string]any{"sand_type": "normal"}, 47},
+			{[]string{"minecraft:water"}, map[string]any{"liquid_depth": int32(0)}, 62},
+		}
+		biome = biomeOcean
+	case fillFlat:
+		layers = []layer{
+			{[]string{"minecraft:bedrock"}, map[string]any{"infiniburn_bit": uint8(0)}, r[0]},
+			{[]string{"minecraft:dirt"}, map[string]any{"dirt_type": "normal"}, r[0] + 2},
+			// Grass was renamed in newer versions of the game.
+			{[]string{"minecraft:grass_block", "minecraft:grass"}, nil, r[0] + 3},
+		}
+		biome = biomePlains
+	default:
+		return nil, nil
+	}
+
+	y := r[0]
+	for _, l := range layers {
+		var rid uint32
+		ok := false
+		for _, name := range l.blocks {
+			if rid, ok = chunk.StateToRuntimeID(name, l.states); ok {
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown block %s", l.blocks[0])
+		}
+		for ; y <= l.top; y++ {
+			for x := uint8(0); x < 16; x++ {
+				for z := uint8(0); z < 16; z++ {
+					c.SetBlock(x, int16(y), z, 0, rid)
+				}
+			}
+		}
+	}
+	for y := r[0]; y <= r[1]; y++ {
+		for x := uint8(0); x < 16; x++ {
+			for z := uint8(0); z < 16; z++ {
+				c.SetBiome(x, int16(y), z, biome)
+			}
+		}
+	}
+	return c, nil
+}
+
+// templateChunk loads the overworld chunk at pos from the .mcworld file at
+// filepath. The world is read from the archive without extracting it. Block
+// entities and entities of the chunk are not used.
+func templateChunk(filepath string, pos ChunkPos) (*chunk.Chunk, error) {
+	if path.Ext(filepath) != ".mcworld" {
+		return nil, fmt.Errorf("%s is not mcworld", filepath)
+	}
+	db, err := openWorld(filepath, "", true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	c, exists, err := db.LoadChunk(world.ChunkPos(pos), world.Overworld)
+	if err != nil {
+		return nil, fmt.Errorf("template chunk %v: %w", pos, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("template chunk %v doesn't exist in %s", pos, filepath)
+	}
+	return c, nil
+}
+
+// parseChunkPos parses a chunk position written as "x,z".
+func parseChunkPos(s string) (ChunkPos, error) {
+	xs, zs, ok := strings.Cut(s, ",")
+	if !ok {
+		return ChunkPos{}, fmt.Errorf("invalid chunk position %q", s)
+	}
+	x, err := strconv.ParseInt(strings.TrimSpace(xs), 10, 32)
+	if err != nil {
+		return ChunkPos{}, fmt.Errorf("invalid chunk position %q: %w", s, err)
+	}
+	z, err := strconv.ParseInt(strings.TrimSpace(zs), 10, 32)
+	if err != nil {
+		return ChunkPos{}, fmt.Errorf("invalid chunk position %q: %w", s, err)
+	}
+	return ChunkPos{int32(x), int32(z)}, nil
+}
+
+// flatLayers returns the flat world layers of level.dat that generate the
+// column at 0, 0 of c, up to its highest block.
+func flatLayers(c *chunk.Chunk) (string, error) {
+	type blockLayer struct {
+		BlockName string `json:"block_name"`
+		Count     int    `json:"count"`
+	}
+	r := c.Range()
+	var layers []blockLayer
+	top := c.HighestBlock(0, 0)
+	for y := int16(r[0]); y <= top; y++ {
+		name, _, _ := chunk.RuntimeIDToState(c.Block(0, y, 0, 0))
+		if n := len(layers); n > 0 && layers[n-1].BlockName == name {
+			layers[n-1].Count++
+			continue
+		}
+		layers = append(layers, blockLayer{BlockName: name, Count: 1})
+	}
+	if layers == nil {
+		layers = []blockLayer{{BlockName: "minecraft:air", Count: 1}}
+	}
+	data, err := json.Marshal(struct {
+		BiomeID          uint32       `json:"biome_id"`
+		BlockLayers      []blockLayer `json:"block_layers"`
+		EncodingVersion  int          `json:"encoding_version"`
+		StructureOptions any          `json:"structure_options"`
+		WorldVersion     string       `json:"world_version"`
+	}{
+		BiomeID:         c.Biome(0, top, 0),
+		BlockLayers:     layers,
+		EncodingVersion: 6,
+		WorldVersion:    "version.post_1_18",
+	})
+	return string(data), err
+}
+
+// setGenerator writes the generator to the level.dat of db. fill is the chunk
+// the padding was filled with, or nil.
+func setGenerator(db *mcdb.DB, generator generatorType, fill *chunk.Chunk) error {
+	ldat := db.LevelDat()
+	switch {
+	case generator == generatorInfinite:
+		ldat.Generator = 1
+	case generator == generatorVoid:
+		ldat.Generator = 2
+		ldat.FlatWorldLayers = `{"biome_id":1,"block_layers":[{"block_name":"minecraft:air","count":1}],"encoding_version":6,"structure_options":null,"world_version":"version.post_1_18"}`
+	case fill != nil:
+		layers, err := flatLayers(fill)
+		if err != nil {
+			return err
+		}
+		ldat.Generator = 2
+		ldat.FlatWorldLayers = layers
+	case generator == generatorFlat:
+		ldat.Generator = 2
+	}
+	return nil
+}
+
+// chunkRect is a rectangle of chunks, max is exclusive.
+type chunkRect struct {
+	min, max ChunkPos
+}
+
+// fillArea holds the overworld chunks between the worlds of a layout that are
+// filled. Its chunks are generated column by column when needed, so that a
+// large layout doesn't need memory for every position.
+type fillArea struct {
+	// worlds are the rectangles of all worlds at their merged positions,
+	// which are never filled, even where a world has no chunks.
+	worlds []chunkRect
+	// areas are the rectangles filled where no world is.
+	areas []chunkRect
+}
+
+// newFillArea returns the fillArea of the layout of root. A grid is filled
+// within its bounds. Worlds keeping their original coordinates may be far
+// apart, so only a border of padding chunks around every world is filled.
+func newFillArea(root *mapGroup, mode mergeMode) *fillArea {
+	a := &fillArea{}
+	var addWorlds func(base ChunkPos, g *mapGroup)
+	addWorlds = func(base ChunkPos, g *mapGroup) {
+		offsetAbsolute := base.Add(g.offsetFromParent)
+		for _, childGroup := range g.groups {
+			addWorlds(offsetAbsolute, childGroup)
+		}
+		for _, w := range g.worlds {
+			min := w.boundsMin.Add(w.chunkOffset(offsetAbsolute))
+			a.worlds = append(a.worlds, chunkRect{min, min.Add(w.BoundsTotal())})
+		}
+	}
+	addWorlds(ChunkPos{}, root)
+
+	if mode == modeOriginal {
+		border := ChunkPos{padding, padding}
+		for _, r := range a.worlds {
+			a.areas = append(a.areas, chunkRect{r.min.Sub(border), r.max.Add(border)})
+		}
+	} else {
+		a.areas = []chunkRect{{root.offsetFromParent, root.offsetFromParent.Add(root.size)}}
+	}
+	return a
+}
+
+// count returns the number of chunks in the area.
+func (a *fillArea) count() (n int64) {
+	a.columns(func(x int32, z [][2]int32) bool {
+		for _, r := range z {
+			n += int64(r[1] - r[0])
+		}
+		return true
+	})
+	return n
+}
+
+// each calls f for every chunk in the area, in order of X and Z, until f
+// returns false.
+func (a *fillArea) each(f func(pos world.ChunkPos) bool) {
+	a.columns(func(x int32, z [][2]int32) bool {
+		for _, r := range z {
+			for z := r[0]; z < r[1]; z++ {
+				if !f(world.ChunkPos{x, z}) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// columns calls f for every X coordinate of the area with the ranges of Z
+// coordinates filled in that column, until f returns false.
+func (a *fillArea) columns(f func(x int32, z [][2]int32) bool) {
+	xs := make([][2]int32, len(a.areas))
+	for i, r := range a.areas {
+		xs[i] = [2]int32{r.min.X(), r.max.X()}
+	}
+	for _, xr := range mergeRanges(xs) {
+		for x := xr[0]; x < xr[1]; x++ {
+			var filled, taken [][2]int32
+			for _, r := range a.areas {
+				if x >= r.min.X() && x < r.max.X() {
+					filled = append(filled, [2]int32{r.min.Z(), r.max.Z()})
+				}
+			}
+			for _, r := range a.worlds {
+				if x >= r.min.X() && x < r.max.X() {
+					taken = append(taken, [2]int32{r.min.Z(), r.max.Z()})
+				}
+			}
+			z := subtractRanges(mergeRanges(filled), mergeRanges(taken))
+			if len(z) > 0 && !f(x, z) {
+				return
+			}
+		}
+	}
+}
+
+// mergeRanges sorts the half open ranges and merges the ones that overlap or
+// touch.
+func mergeRanges(ranges [][2]int32) [][2]int32 {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	var out [][2]int32
+	for _, r := range ranges {
+		if r[0] >= r[1] {
+			continue
+		}
+		if n := len(out); n > 0 && r[0] <= out[n-1][1] {
+			out[n-1][1] = maxInt32(out[n-1][1], r[1])
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// subtractRanges returns the parts of the merged ranges a not covered by the
+// merged ranges b.
+func subtractRanges(a, b [][2]int32) [][2]int32 {
+	var out [][2]int32
+	for _, r := range a {
+		start := r[0]
+		for _, c := range b {
+			if c[1] <= start || c[0] >= r[1] {
+				continue
+			}
+			if c[0] > start {
+				out = append(out, [2]int32{start, c[0]})
+			}
+			start = c[1]
+		}
+		if start < r[1] {
+			out = append(out, [2]int32{start, r[1]})
+		}
+	}
+	return out
+}
+
+// fillName is the name used for writeFill in progress and error reports.
+const fillName = "fill"
+
+// writeFill writes the chunk c at every position of the area.
+func writeFill(ctx context.Context, c *chunk.Chunk, area *fillArea, dbOutput *worldWriter) (err error) {
+	e := encodeChunk(c)
+	area.each(func(pos world.ChunkPos) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		e.put(dbOutput, iterKey{pos: pos, dim: world.Overworld})
+		if dbOutput.Len() >= recordSize {
+			err = dbOutput.flush()
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return dbOutput.flush()
+}
+
+// loadFill returns the fill chunk for the flags passed, or nil if the padding
+// isn't filled.
+func loadFill(pattern fillPattern, template, templateChunkPos string) (*chunk.Chunk, error) {
+	switch pattern {
+	case fillNone:
+		return nil, nil
+	case fillOcean, fillFlat:
+		return fillChunk(pattern)
+	}
+	if template == "" {
+		return nil, fmt.Errorf("-fill=template needs -fill-template")
+	}
+	if _, err := os.Stat(template); err != nil {
+		return nil, err
+	}
+	pos, err := parseChunkPos(templateChunkPos)
+	if err != nil {
+		return nil, err
+	}
+	return templateChunk(template, pos)
+}
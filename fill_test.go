@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/df-mc/dragonfly/server/world/mcdb"
+)
+
+// TestFillArea checks that the fill area leaves out the rectangles of all
+// worlds, including chunks a world doesn't have, and that count matches the
+// chunks generated by each.
+func TestFillArea(t *testing.T) {
+	a := &fillArea{
+		worlds: []chunkRect{{ChunkPos{0, 0}, ChunkPos{4, 4}}, {ChunkPos{1000000, 0}, ChunkPos{1000002, 2}}},
+	}
+	for _, r := range a.worlds {
+		a.areas = append(a.areas, chunkRect{r.min.Sub(ChunkPos{2, 2}), r.max.Add(ChunkPos{2, 2})})
+	}
+	var n int64
+	a.each(func(pos world.ChunkPos) bool {
+		n++
+		for _, r := range a.worlds {
+			if pos[0] >= r.min.X() && pos[0] < r.max.X() && pos[1] >= r.min.Z() && pos[1] < r.max.Z() {
+				t.Fatalf("chunk %v of a world is filled", pos)
+			}
+		}
+		return true
+	})
+	// Both worlds get a border of 2 chunks, the worlds are far apart.
+	if want := int64(8*8-4*4) + int64(6*6-2*2); n != want {
+		t.Errorf("filled %d chunks, want %d", n, want)
+	}
+	if c := a.count(); c != n {
+		t.Errorf("count is %d, each generated %d chunks", c, n)
+	}
+}
+
+// TestFillChunks writes the fill chunk of every pattern around a world and
+// checks that the chunks read back from the output hold its blocks and biome.
+func TestFillChunks(t *testing.T) {
+	template := filepath.Join(writeTestWorlds(t, []testWorld{{"g/t", "minecraft:iron_block", ChunkPos{0, 0}, 1}}), "g", "t.mcworld")
+	r := world.Overworld.Range()
+	tests := []struct {
+		pattern fillPattern
+		// blocks holds the block expected at every Y.
+		blocks map[int]string
+		biome  uint32
+	}{
+		{fillOcean, map[int]string{r[0]: "minecraft:bedrock", 44: "minecraft:stone", 47: "minecraft:sand", 62: "minecraft:water", 63: "minecraft:air"}, biomeOcean},
+		{fillFlat, map[int]string{r[0]: "minecraft:bedrock", r[0] + 2: "minecraft:dirt", r[0] + 3: "minecraft:grass", r[0] + 4: "minecraft:air"}, biomePlains},
+		{fillTemplate, map[int]string{0: "minecraft:iron_block", 1: "minecraft:air"}, biomePlains},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.pattern), func(t *testing.T) {
+			c, err := loadFill(tt.pattern, template, "0,0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := mcdb.New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			errs := newErrorCollector(policyFailFast)
+			w := newChunkWriter(db.LDB(), 1<<20, 1<<20, newProgress(progressNone), errs)
+			dbOutput := newWorldWriter(errs.Context(), w, fillName)
+			a := &fillArea{worlds: []chunkRect{{ChunkPos{0, 0}, ChunkPos{1, 1}}}, areas: []chunkRect{{ChunkPos{-1, -1}, ChunkPos{2, 2}}}}
+			err = writeFill(errs.Context(), c, a, dbOutput)
+			dbOutput.done()
+			w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, exists, err := db.LoadChunk(world.ChunkPos{-1, 1}, world.Overworld)
+			if err != nil || !exists {
+				t.Fatalf("fill chunk wasn't written: %v", err)
+			}
+			for y, want := range tt.blocks {
+				name, _, _ := chunk.RuntimeIDToState(out.Block(3, int16(y), 5, 0))
+				if name != want {
+					t.Errorf("block at y=%d is %s, want %s", y, name, want)
+				}
+			}
+			if tt.pattern != fillTemplate {
+				if b := out.Biome(3, 70, 5); b != tt.biome {
+					t.Errorf("biome is %d, want %d", b, tt.biome)
+				}
+			}
+			if _, exists, _ := db.LoadChunk(world.ChunkPos{0, 0}, world.Overworld); exists {
+				t.Error("chunk of the world was filled")
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/go-gl/mathgl v1.0.0
 	github.com/sandertv/gophertunnel v1.28.1
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/sync v0.1.0
 )
 
 require (
@@ -31,7 +32,6 @@ require (
 	golang.org/x/image v0.5.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/oauth2 v0.4.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/df-mc/goleveldb/leveldb"
+)
+
+// hashName is the file the hashes of a merge are written to, so that the next
+// merge of the same inputs can check that its output is identical.
+const hashName = "merge-hash.json"
+
+// mergeHash identifies the inputs and the output of a merge.
+type mergeHash struct {
+	// Input is the hash of all source worlds and of all flags that change the
+	// output.
+	Input string `json:"input"`
+	// Map is the hash of map.json, without the time of the merge. map.json
+	// itself isn't byte-identical between merges because of MergedAt, so it is
+	// only ever compared through this hash.
+	Map string `json:"map"`
+	// Keys is the hash of all keys in the output LevelDB.
+	Keys string `json:"keys"`
+}
+
+// outputFlags are the flags that don't change the output of a merge.
+var outputFlags = map[string]bool{
+	"progress": true, "worlds": true, "batch-size": true, "max-memory": true, "geojson": true, "html": true,
+	"source": true, "cache": true, "compression": true, "zip-workers": true,
+}
+
+// fileFlags are the flags that name a file. Their content changes the output,
+// so it is hashed along with the path.
+var fileFlags = map[string]bool{
+	"order": true, "replace-blocks": true, "entity-rules": true, "item-rules": true, "fill-template": true,
+}
+
+// inputHash hashes the path and content of all worlds together with every flag
+// in fs that changes the output, including the content of files passed to
+// flags.
+func inputHash(worlds []*worldMap, fs *flag.FlagSet) (string, error) {
+	h := sha256.New()
+	for _, w := range worlds {
+		fmt.Fprintf(h, "world %q %s\n", w.source, w.manifest.SourceHash)
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if outputFlags[f.Name] || err != nil {
+			return
+		}
+		fmt.Fprintf(h, "flag %s=%q\n", f.Name, f.Value.String())
+		if fileFlags[f.Name] && f.Value.String() != "" {
+			var sum string
+			if sum, err = hashFile(f.Value.String()); err != nil {
+				err = fmt.Errorf("hash -%s: %w", f.Name, err)
+				return
+			}
+			fmt.Fprintf(h, "file %s\n", sum)
+		}
+	})
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// hash hashes the map as it is written to map.json, leaving out the time of
+// the merge.
+func (m mapJson) hash() (string, error) {
+	m.MergedAt = time.Time{}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// keysHash hashes all keys in db, in key order.
+func keysHash(db *leveldb.DB) (string, error) {
+	h := sha256.New()
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	var n [4]byte
+	for iter.Next() {
+		binary.LittleEndian.PutUint32(n[:], uint32(len(iter.Key())))
+		h.Write(n[:])
+		h.Write(iter.Key())
+	}
+	return hex.EncodeToString(h.Sum(nil)), iter.Error()
+}
+
+// checkHash compares cur against the hashes written by the previous merge and
+// writes cur to filename. If the previous merge had the same inputs, the map and
+// keys must be the same too, otherwise an error is returned.
+func checkHash(cur mergeHash, filename string) error {
+	var prev mergeHash
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &prev)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read %s: %w", filename, err)
+	}
+
+	data, err = json.MarshalIndent(cur, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return err
+	}
+
+	if prev.Input != cur.Input {
+		return nil
+	}
+	if prev.Map != cur.Map {
+		return fmt.Errorf("map.json differs from the previous merge of the same inputs")
+	}
+	if prev.Keys != cur.Keys {
+		return fmt.Errorf("output keys differ from the previous merge of the same inputs")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMergeDeterministic merges the same worlds twice and checks that the
+// hashes of both merges are identical. map.json differs in MergedAt, so it is
+// compared through mapJson.hash, which must match the file that was written.
+func TestMergeDeterministic(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds)
+	for _, mode := range []mergeMode{modeGrid, modeOriginal} {
+		t.Run(string(mode), func(t *testing.T) {
+			var hashes [2]mergeHash
+			for i := range hashes {
+				root, conflicts := loadTestWorlds(t, in, mode, conflictFirst)
+				filename := filepath.Join(t.TempDir(), "map.json")
+				mapData, err := writeGroupToJSON(root, mode, nil, filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db := mergeTestWorlds(t, root, conflicts, conflictFirst, nil)
+
+				h := &hashes[i]
+				if h.Input, err = inputHash(allWorlds(root), flag.NewFlagSet("test", flag.ContinueOnError)); err != nil {
+					t.Fatal(err)
+				}
+				if h.Map, err = mapData.hash(); err != nil {
+					t.Fatal(err)
+				}
+				if h.Keys, err = keysHash(db.LDB()); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var written mapJson
+				if err := json.Unmarshal(data, &written); err != nil {
+					t.Fatal(err)
+				}
+				if sum, err := written.hash(); err != nil {
+					t.Fatal(err)
+				} else if sum != h.Map {
+					t.Errorf("hash of the written map.json %s, want %s", sum, h.Map)
+				}
+			}
+			if hashes[0] != hashes[1] {
+				t.Errorf("hashes differ between merges: %+v, %+v", hashes[0], hashes[1])
+			}
+
+			filename := filepath.Join(t.TempDir(), hashName)
+			for _, h := range hashes {
+				if err := checkHash(h, filename); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// TestInputHashFileFlags checks that editing a file passed to a flag changes
+// the input hash, while output-only flags don't.
+func TestInputHashFileFlags(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("replace-blocks", "", "")
+	fs.String("progress", "", "")
+	if err := fs.Parse([]string{"-replace-blocks", rules}); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func() string {
+		t.Helper()
+		h, err := inputHash(nil, fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	if _, err := inputHash(nil, fs); err == nil {
+		t.Fatalf("hashing a missing -replace-blocks file succeeded")
+	}
+	if err := os.WriteFile(rules, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := hash()
+	if err := fs.Set("progress", "json"); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != before {
+		t.Errorf("-progress changed the input hash")
+	}
+	if err := os.WriteFile(rules, []byte(`[{"from":{"name":"minecraft:dirt"},"to":{"name":"minecraft:stone"}}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if hash() == before {
+		t.Errorf("editing the -replace-blocks file didn't change the input hash")
+	}
+}
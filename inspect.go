@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/df-mc/dragonfly/server/world"
+	_ "github.com/df-mc/dragonfly/server/world/biome"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+	"github.com/sirupsen/logrus"
+)
+
+// worldStats are the statistics reported by the inspect subcommand for a
+// single world.
+type worldStats struct {
+	Path string `json:"path"`
+	// DBSize is the size of all files of the LevelDB in bytes, Keys the number
+	// of keys in it.
+	DBSize int64 `json:"dbSize"`
+	Keys   int   `json:"keys"`
+
+	Dimensions map[string]*dimensionStats `json:"dimensions"`
+	// SubChunkVersions counts the sub chunks by the version they are stored
+	// with.
+	SubChunkVersions map[int]int `json:"subChunkVersions"`
+	// Blocks counts the blocks in all chunks by name, Biomes counts 4x4x4
+	// cells of blocks by the biome they are in.
+	Blocks map[string]int `json:"blocks"`
+	Biomes map[string]int `json:"biomes"`
+	// BlockEntities and Entities count block entities and entities by their
+	// identifier.
+	BlockEntities map[string]int `json:"blockEntities"`
+	Entities      map[string]int `json:"entities"`
+	// UnknownKeys counts the keys that don't belong to a chunk and aren't
+	// known global keys, by their prefix.
+	UnknownKeys map[string]int `json:"unknownKeys"`
+	// Errors holds problems found while reading the world.
+	Errors []string `json:"errors,omitempty"`
+}
+
+type dimensionStats struct {
+	Chunks    int      `json:"chunks"`
+	BoundsMin ChunkPos `json:"boundsMin"`
+	BoundsMax ChunkPos `json:"boundsMax"`
+}
+
+// knownKeyPrefixes are the prefixes of global keys written by the game.
+var knownKeyPrefixes = []string{
+	"~local_player", "player_", "game_flatworldlayers", "BiomeData", "AutonomousEntities", "Overworld", "Nether",
+	"TheEnd", "mobevents", "portals", "scoreboard", "schedulerWT", "structuretemplate", "tickingarea", "VILLAGE_",
+	"map_", "LevelChunkMetaDataDictionary", "dimension", "idcounts", "lastPlayerCount", "realmsStoriesData",
+	"PositionTrackDB", "PosTrackDB", keyActorPrefix, keyActorDigest,
+}
+
+// runInspect runs the inspect subcommand, which reports statistics of worlds.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	top := fs.Int("top", 10, "with -format=table, the number of entries shown of every histogram")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: WorldMerge.exe inspect [flags] <world folder or .mcworld>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || (*format != "table" && *format != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var stats []*worldStats
+	failed := false
+	for _, p := range fs.Args() {
+		s, err := inspectWorld(p)
+		if err != nil {
+			logrus.Errorf("%s: %v", p, err)
+			failed = true
+			continue
+		}
+		stats = append(stats, s)
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			logrus.Fatal(err)
+		}
+	} else {
+		for _, s := range stats {
+			s.writeTable(os.Stdout, *top)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// inspectWorld collects the statistics of the world in the folder or .mcworld
+// file at p. The world is opened read-only.
+func inspectWorld(p string) (*worldStats, error) {
+	dir := p
+	if path.Ext(filepath.ToSlash(p)) == ".mcworld" {
+		var err error
+		if dir, err = extractWorld(filepath.ToSlash(p)); err != nil {
+			return nil, err
+		}
+	}
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	s := &worldStats{
+		Path:             p,
+		Dimensions:       make(map[string]*dimensionStats),
+		SubChunkVersions: make(map[int]int),
+		Blocks:           make(map[string]int),
+		Biomes:           make(map[string]int),
+		BlockEntities:    make(map[string]int),
+		Entities:         make(map[string]int),
+		UnknownKeys:      make(map[string]int),
+	}
+	s.DBSize, err = dirSize(filepath.Join(dir, "db"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunks and biomes
+	it := newChunkIterator(db, nil)
+	for it.Next() {
+		pos, dim := ChunkPos(it.Position()), fmt.Sprint(it.Dimension())
+		d, ok := s.Dimensions[dim]
+		if !ok {
+			d = &dimensionStats{BoundsMin: pos, BoundsMax: pos}
+			s.Dimensions[dim] = d
+		}
+		d.Chunks++
+		d.BoundsMin = ChunkPos{minInt32(d.BoundsMin.X(), pos.X()), minInt32(d.BoundsMin.Z(), pos.Z())}
+		d.BoundsMax = ChunkPos{maxInt32(d.BoundsMax.X(), pos.X()), maxInt32(d.BoundsMax.Z(), pos.Z())}
+
+		c, err := db.LoadBiomes(it.Position(), it.Dimension())
+		if err != nil {
+			s.Errors = append(s.Errors, fmt.Sprintf("load biomes of chunk %v in %s: %v", pos, dim, err))
+			continue
+		}
+		countBiomes(c, s.Biomes)
+	}
+	if err := it.Error(); err != nil {
+		s.Errors = append(s.Errors, err.Error())
+	}
+	it.Release()
+
+	// Keys that aren't decoded by the ChunkIterator
+	iter := db.LDB().NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		s.Keys++
+		key, value := iter.Key(), iter.Value()
+		if k, n, ok := parseChunkKey(key); ok {
+			switch key[n] {
+			case keySubChunkData:
+				if len(value) > 0 {
+					s.SubChunkVersions[int(value[0])]++
+				}
+				// Blocks are counted from the raw palettes, so that blocks of
+				// add-ons and blocks dragonfly doesn't know are counted too.
+				sub, err := decodeRawSubChunk(value)
+				if err != nil {
+					s.Errors = append(s.Errors, fmt.Sprintf("decode sub chunk %d of chunk %v: %v", int8(key[n+1]), ChunkPos(k.pos), err))
+					continue
+				}
+				countBlocks(sub, s.Blocks)
+			case keyBlockEntities:
+				s.countNBT(value, "id", s.BlockEntities)
+			case keyEntities:
+				s.countNBT(value, "identifier", s.Entities)
+			}
+			continue
+		}
+		if bytes.HasPrefix(key, []byte(keyActorPrefix)) {
+			s.countNBT(value, "identifier", s.Entities)
+			continue
+		}
+		if !knownKey(key) {
+			s.UnknownKeys[keyPrefix(key)]++
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// countBlocks adds the blocks of the first layer of sub to counts, using its
+// palette so that every block name is only decoded once per sub chunk. Sub
+// chunks holding only air aren't counted.
+func countBlocks(sub *rawSubChunk, counts map[string]int) {
+	if len(sub.layers) == 0 || sub.onlyAir() {
+		return
+	}
+	l := sub.layers[0]
+	perIndex := make([]int, len(l.palette))
+	for _, idx := range l.indices {
+		perIndex[idx]++
+	}
+	for i, name := range l.names() {
+		if perIndex[i] > 0 {
+			counts[name] += perIndex[i]
+		}
+	}
+}
+
+// countBiomes adds the biomes of c to counts, taking one sample for every
+// 4x4x4 cell of blocks.
+func countBiomes(c *chunk.Chunk, counts map[string]int) {
+	r := c.Range()
+	perID := make(map[uint32]int)
+	for y := r[0]; y <= r[1]; y += 4 {
+		for x := uint8(0); x < 16; x += 4 {
+			for z := uint8(0); z < 16; z += 4 {
+				perID[c.Biome(x, int16(y), z)]++
+			}
+		}
+	}
+	for id, n := range perID {
+		name := fmt.Sprintf("biome %d", id)
+		if b, ok := world.BiomeByID(int(id)); ok {
+			name = b.String()
+		}
+		counts[name] += n
+	}
+}
+
+// countNBT counts the NBT compound tags appended to each other in data by the
+// string tag field.
+func (s *worldStats) countNBT(data []byte, field string, counts map[string]int) {
+	buf := bytes.NewBuffer(data)
+	dec := nbt.NewDecoderWithEncoding(buf, nbt.LittleEndian)
+	for buf.Len() != 0 {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			s.Errors = append(s.Errors, fmt.Sprintf("decode NBT: %v", err))
+			return
+		}
+		id, _ := m[field].(string)
+		if id == "" {
+			id = "(none)"
+		}
+		counts[id]++
+	}
+}
+
+// knownKey checks if key is a global key written by the game.
+func knownKey(key []byte) bool {
+	for _, p := range knownKeyPrefixes {
+		if bytes.HasPrefix(key, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyPrefix returns a readable prefix of key: the leading letters, digits and
+// underscores, or the first bytes in hex if it doesn't start with one.
+func keyPrefix(key []byte) string {
+	n := 0
+	for n < len(key) && (key[n] == '_' || key[n] == '~' || key[n] >= '0' && key[n] <= '9' || key[n] >= 'A' && key[n] <= 'Z' || key[n] >= 'a' && key[n] <= 'z') {
+		n++
+	}
+	if n >= 3 {
+		return string(key[:n])
+	}
+	if len(key) > 4 {
+		key = key[:4]
+	}
+	return fmt.Sprintf("0x%x", key)
+}
+
+// dirSize returns the total size of all files in dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// writeTable writes the statistics as a table, showing the top entries of
+// every histogram.
+func (s *worldStats) writeTable(w io.Writer, top int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\n", s.Path)
+	fmt.Fprintf(tw, "  LevelDB\t%s, %d keys\n", formatBytes(s.DBSize), s.Keys)
+	for _, dim := range sortedKeys(s.Dimensions) {
+		d := s.Dimensions[dim]
+		fmt.Fprintf(tw, "  %s\t%d chunks, %v to %v\n", dim, d.Chunks, d.BoundsMin, d.BoundsMax)
+	}
+	versions := make(map[string]int, len(s.SubChunkVersions))
+	for v, n := range s.SubChunkVersions {
+		versions[fmt.Sprint(v)] = n
+	}
+	for _, h := range []struct {
+		name   string
+		counts map[string]int
+	}{
+		{"Sub chunk versions", versions},
+		{"Blocks", s.Blocks},
+		{"Biomes (4x4x4 cells)", s.Biomes},
+		{"Block entities", s.BlockEntities},
+		{"Entities", s.Entities},
+		{"Unknown keys", s.UnknownKeys},
+	} {
+		fmt.Fprintf(tw, "  %s\t\n", h.name)
+		for i, k := range topCounts(h.counts) {
+			if i == top {
+				fmt.Fprintf(tw, "    ...\t%d more\n", len(h.counts)-top)
+				break
+			}
+			fmt.Fprintf(tw, "    %s\t%d\n", k, h.counts[k])
+		}
+	}
+	for _, err := range s.Errors {
+		fmt.Fprintf(tw, "  error\t%s\n", err)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// topCounts returns the keys of counts ordered by count, highest first.
+func topCounts(counts map[string]int) []string {
+	keys := sortedKeys(counts)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return counts[keys[i]] > counts[keys[j]]
+	})
+	return keys
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+)
+
+// TestInspectWorld checks that inspect counts the blocks of every chunk, also
+// blocks dragonfly doesn't know, and continues past a broken sub chunk.
+func TestInspectWorld(t *testing.T) {
+	in := writeTestWorlds(t, []testWorld{{"g/a", "minecraft:iron_block", ChunkPos{0, 0}, 2}})
+	cacheDir = t.TempDir()
+	dir, err := extractWorld(filepath.ToSlash(filepath.Join(in, "g", "a.mcworld")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ldb, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(pos world.ChunkPos, y int8, data []byte) {
+		t.Helper()
+		if err := ldb.Put(append(key_index(pos, world.Overworld), keySubChunkData, byte(y)), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(world.ChunkPos{0, 0}, 1, testSubChunk(t, "addon:crate", 0, 1, 2))
+	// A palette entry that is cut off.
+	broken := testSubChunk(t, "minecraft:stone", 0)
+	put(world.ChunkPos{1, 0}, 1, broken[:len(broken)-3])
+	if err := ldb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := inspectWorld(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := s.Dimensions["Overworld"]; d == nil || d.Chunks != 4 {
+		t.Errorf("overworld stats %+v, want 4 chunks", d)
+	}
+	if n := s.Blocks["minecraft:iron_block"]; n != 4*256 {
+		t.Errorf("%d iron blocks, want %d", n, 4*256)
+	}
+	if n := s.Blocks["addon:crate"]; n != 3 {
+		t.Errorf("%d addon:crate blocks, want 3", n)
+	}
+	if n := s.Blocks["minecraft:stone"]; n != 0 {
+		t.Errorf("%d stone blocks counted from a broken sub chunk", n)
+	}
+	if len(s.Errors) != 1 {
+		t.Errorf("errors %q, want one for the broken sub chunk", s.Errors)
+	}
+	if len(s.Biomes) == 0 {
+		t.Errorf("no biomes counted")
+	}
+}
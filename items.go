@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/df-mc/dragonfly/server/item"
+	"github.com/df-mc/dragonfly/server/world"
+)
+
+// itemRules decide which items are kept in the containers of block entities,
+// such as chests, barrels, shulker boxes and hoppers. They are read from a
+// JSON file such as:
+//
+//	{
+//	  "remove": ["minecraft:command_block", "minecraft:structure_block", "minecraft:*spawn_egg"],
+//	  "illegalEnchantments": true,
+//	  "normalizeCounts": true
+//	}
+type itemRules struct {
+	// Remove holds patterns as used by path.Match of the names of items that
+	// are removed.
+	Remove []string `json:"remove,omitempty"`
+	// IllegalEnchantments removes items with enchantments that don't exist or
+	// have a level higher than possible in survival.
+	IllegalEnchantments bool `json:"illegalEnchantments,omitempty"`
+	// NormalizeCounts limits the count of every stack to the most the item
+	// can stack to, and removes stacks without any items.
+	NormalizeCounts bool `json:"normalizeCounts,omitempty"`
+}
+
+// maxEnchantmentLevels holds the highest level of every enchantment by its ID.
+var maxEnchantmentLevels = map[int16]int16{
+	0: 4, 1: 4, 2: 4, 3: 4, 4: 4, 5: 3, 6: 3, 7: 3, 8: 1, 9: 5, 10: 5,
+	11: 5, 12: 2, 13: 2, 14: 3, 15: 5, 16: 1, 17: 3, 18: 3, 19: 5, 20: 2,
+	21: 1, 22: 1, 23: 3, 24: 3, 25: 2, 26: 1, 27: 1, 28: 1, 29: 5, 30: 3,
+	31: 3, 32: 1, 33: 1, 34: 4, 35: 3, 36: 3, 37: 3, 38: 3, 39: 5, 40: 4,
+}
+
+// loadItemRules reads itemRules from the file filename. An empty filename
+// returns nil.
+func loadItemRules(filename string) (*itemRules, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules itemRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, p := range rules.Remove {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s: item %q: %w", filename, p, err)
+		}
+	}
+	return &rules, nil
+}
+
+// sanitizeContainer applies the rules to the items of the block entity m and,
+// recursively, to the items stored in those items, such as the content of a
+// shulker box. Every change is passed to changed.
+func (r *itemRules) sanitizeContainer(m map[string]any, changed func(change string)) {
+	if items, ok := m["Items"].([]any); ok {
+		kept := items[:0]
+		for _, it := range items {
+			if it, ok := it.(map[string]any); ok && !r.sanitizeItem(it, changed) {
+				continue
+			}
+			kept = append(kept, it)
+		}
+		m["Items"] = kept
+	}
+	// Item frames and flower pots hold a single item.
+	if it, ok := m["Item"].(map[string]any); ok && !r.sanitizeItem(it, changed) {
+		delete(m, "Item")
+	}
+}
+
+// sanitizeItem applies the rules to the item stack m, returning false if it
+// should be removed.
+func (r *itemRules) sanitizeItem(m map[string]any, changed func(change string)) bool {
+	name, _ := m["Name"].(string)
+	if name == "" || name == "minecraft:air" {
+		// Empty slots hold air.
+		return true
+	}
+	for _, p := range r.Remove {
+		if ok, _ := path.Match(p, name); ok {
+			changed("removed " + name)
+			return false
+		}
+	}
+	tag, _ := m["tag"].(map[string]any)
+	if r.IllegalEnchantments && illegalEnchantments(tag) {
+		changed("removed " + name + " (illegal enchantments)")
+		return false
+	}
+	if r.NormalizeCounts {
+		count, _ := m["Count"].(uint8)
+		if count == 0 {
+			changed("removed empty stacks of " + name)
+			return false
+		}
+		if max := maxCount(name, m); int(count) > max {
+			m["Count"] = uint8(max)
+			changed("normalized counts of " + name)
+		}
+	}
+	if tag != nil {
+		r.sanitizeContainer(tag, changed)
+	}
+	return true
+}
+
+// illegalEnchantments checks if the item tag holds an enchantment that
+// doesn't exist or has a level above its maximum.
+func illegalEnchantments(tag map[string]any) bool {
+	list, _ := tag["ench"].([]any)
+	for _, e := range list {
+		e, _ := e.(map[string]any)
+		id, _ := e["id"].(int16)
+		lvl, _ := e["lvl"].(int16)
+		if max, ok := maxEnchantmentLevels[id]; !ok || lvl > max || lvl < 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// maxCount returns the largest stack of the item name. Items unknown to the
+// item registry, such as most blocks, stack to 64.
+func maxCount(name string, m map[string]any) int {
+	damage, _ := m["Damage"].(int16)
+	if it, ok := world.ItemByName(name, damage); ok {
+		if c, ok := it.(item.MaxCounter); ok {
+			return c.MaxCount()
+		}
+	}
+	return 64
+}
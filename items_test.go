@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testItem returns the NBT of an item stack of count items name, with the
+// item tag passed, which may be nil.
+func testItem(name string, count uint8, tag map[string]any) map[string]any {
+	m := map[string]any{"Name": name, "Count": count, "Damage": int16(0)}
+	if tag != nil {
+		m["tag"] = tag
+	}
+	return m
+}
+
+// testEnchanted returns the item tag of an item with the enchantment id at
+// level lvl.
+func testEnchanted(id, lvl int16) map[string]any {
+	return map[string]any{"ench": []any{map[string]any{"id": id, "lvl": lvl}}}
+}
+
+// itemNames returns the name and count of every item in the container m,
+// recursing into the containers of the items.
+func itemNames(m map[string]any) []string {
+	var names []string
+	items, _ := m["Items"].([]any)
+	for _, it := range items {
+		it := it.(map[string]any)
+		names = append(names, fmt.Sprintf("%s %d", it["Name"], it["Count"]))
+		if tag, ok := it["tag"].(map[string]any); ok {
+			for _, n := range itemNames(tag) {
+				names = append(names, "  "+n)
+			}
+		}
+	}
+	return names
+}
+
+// TestItemRules checks the items kept in containers by the item rules.
+func TestItemRules(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		rules itemRules
+		items []any
+		want  []string
+	}{
+		{
+			"remove",
+			itemRules{Remove: []string{"minecraft:command_block"}},
+			[]any{testItem("minecraft:command_block", 1, nil), testItem("minecraft:stone", 5, nil)},
+			[]string{"minecraft:stone 5"},
+		},
+		{
+			"remove pattern",
+			itemRules{Remove: []string{"minecraft:*spawn_egg"}},
+			[]any{testItem("minecraft:pig_spawn_egg", 3, nil), testItem("minecraft:egg", 3, nil)},
+			[]string{"minecraft:egg 3"},
+		},
+		{
+			"empty slots",
+			itemRules{Remove: []string{"*"}},
+			[]any{testItem("minecraft:air", 0, nil), testItem("", 0, nil)},
+			[]string{"minecraft:air 0", " 0"},
+		},
+		{
+			"illegal enchantments",
+			itemRules{IllegalEnchantments: true},
+			[]any{
+				testItem("minecraft:diamond_sword", 1, testEnchanted(9, 5)),
+				testItem("minecraft:diamond_sword", 1, testEnchanted(9, 6)),
+				testItem("minecraft:diamond_pickaxe", 1, testEnchanted(99, 1)),
+				testItem("minecraft:diamond_pickaxe", 1, testEnchanted(15, 0)),
+			},
+			[]string{"minecraft:diamond_sword 1"},
+		},
+		{
+			"illegal enchantments off",
+			itemRules{},
+			[]any{testItem("minecraft:diamond_sword", 1, testEnchanted(9, 32))},
+			[]string{"minecraft:diamond_sword 1"},
+		},
+		{
+			"normalize counts",
+			itemRules{NormalizeCounts: true},
+			[]any{
+				testItem("minecraft:stone", 99, nil),
+				testItem("minecraft:dirt", 0, nil),
+				testItem("minecraft:diamond_sword", 5, nil),
+				testItem("minecraft:ender_pearl", 64, nil),
+			},
+			[]string{"minecraft:stone 64", "minecraft:diamond_sword 1", "minecraft:ender_pearl 16"},
+		},
+		{
+			"nested",
+			itemRules{Remove: []string{"minecraft:command_block"}, NormalizeCounts: true},
+			[]any{testItem("minecraft:shulker_box", 1, map[string]any{"Items": []any{
+				testItem("minecraft:command_block", 1, nil),
+				testItem("minecraft:stone", 70, nil),
+				testItem("minecraft:undyed_shulker_box", 1, map[string]any{"Items": []any{
+					testItem("minecraft:command_block", 1, nil),
+					testItem("minecraft:dirt", 1, nil),
+				}}),
+			}})},
+			[]string{"minecraft:shulker_box 1", "  minecraft:stone 64", "  minecraft:undyed_shulker_box 1", "    minecraft:dirt 1"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := map[string]any{"id": "Chest", "Items": c.items}
+			c.rules.sanitizeContainer(m, func(string) {})
+			if got := itemNames(m); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("items %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	// Item frames hold a single item.
+	frame := map[string]any{"id": "ItemFrame", "Item": testItem("minecraft:command_block", 1, nil)}
+	(&itemRules{Remove: []string{"minecraft:command_block"}}).sanitizeContainer(frame, func(string) {})
+	if _, ok := frame["Item"]; ok {
+		t.Errorf("item of an item frame wasn't removed")
+	}
+}
@@ -6,10 +6,21 @@ import (
 
 	"github.com/df-mc/dragonfly/server/world"
 	"github.com/df-mc/dragonfly/server/world/chunk"
-	"github.com/df-mc/dragonfly/server/world/mcdb"
+	"github.com/df-mc/goleveldb/leveldb"
 	"github.com/df-mc/goleveldb/leveldb/iterator"
 )
 
+// chunkSource is a database chunks can be read from, such as a *mcdb.DB.
+type chunkSource interface {
+	LDB() *leveldb.DB
+	LoadChunk(position world.ChunkPos, dim world.Dimension) (c *chunk.Chunk, exists bool, err error)
+}
+
+// lookupLimit is the largest number of chunks in an IteratorRange for which a
+// ChunkIterator looks up every position in the range, rather than iterating
+// over all keys of the database.
+const lookupLimit = 64 * 64
+
 // ChunkIterator iterates over a DB's position/chunk pairs in key order.
 //
 // When an error is encountered, any call to Next will return false and will
@@ -21,11 +32,20 @@ import (
 // Also, an iterator is not necessarily safe for concurrent use, but it is
 // safe to use multiple iterators concurrently, with each in a dedicated
 // goroutine.
+//
+// If the range is limited to a single dimension and covers at most lookupLimit
+// chunks, the positions within the range are looked up one by one, in order of
+// their Z and X coordinate, instead.
 type ChunkIterator struct {
 	dbIter iterator.Iterator
-	db     *mcdb.DB
+	db     chunkSource
 	r      *IteratorRange
 
+	// lookup is true if positions are looked up, next is the next position
+	// looked up.
+	lookup bool
+	next   world.ChunkPos
+
 	err error
 
 	current *chunk.Chunk
@@ -39,10 +59,13 @@ type iterKey struct {
 	dim world.Dimension
 }
 
-func newChunkIterator(db *mcdb.DB, r *IteratorRange) *ChunkIterator {
+func newChunkIterator(db chunkSource, r *IteratorRange) *ChunkIterator {
 	if r == nil {
 		r = &IteratorRange{}
 	}
+	if area := r.area(); r.Dimension != nil && area > 0 && area <= lookupLimit {
+		return &ChunkIterator{db: db, r: r, lookup: true, next: r.Min}
+	}
 	return &ChunkIterator{
 		db:     db,
 		dbIter: db.LDB().NewIterator(nil, nil),
@@ -54,6 +77,9 @@ func newChunkIterator(db *mcdb.DB, r *IteratorRange) *ChunkIterator {
 // Next moves the iterator to the next key/value pair.
 // It returns false if the iterator is exhausted.
 func (iter *ChunkIterator) Next() bool {
+	if iter.lookup {
+		return iter.nextLookup()
+	}
 	if iter.err != nil || !iter.dbIter.Next() {
 		iter.current = nil
 		iter.dim = nil
@@ -90,6 +116,32 @@ func (iter *ChunkIterator) Next() bool {
 	return true
 }
 
+// nextLookup moves the iterator to the next position in the range that has a
+// chunk.
+func (iter *ChunkIterator) nextLookup() bool {
+	iter.current = nil
+	for iter.err == nil && iter.next[1] < iter.r.Max[1] {
+		pos := iter.next
+		if iter.next[0]++; iter.next[0] >= iter.r.Max[0] {
+			iter.next = world.ChunkPos{iter.r.Min[0], iter.next[1] + 1}
+		}
+		index := key_index(pos, iter.r.Dimension)
+		for _, tag := range [...]byte{keyVersion, keyVersionOld} {
+			found, err := iter.db.LDB().Has(append(index, tag), nil)
+			if err != nil {
+				iter.err = err
+				break
+			}
+			if found {
+				iter.pos, iter.dim = pos, iter.r.Dimension
+				return true
+			}
+		}
+	}
+	iter.dim = nil
+	return false
+}
+
 // Chunk returns the value of the current position/chunk pair, or nil if done.
 func (iter *ChunkIterator) Chunk() *chunk.Chunk {
 	if iter.current == nil {
@@ -116,7 +168,9 @@ func (iter *ChunkIterator) Dimension() world.Dimension {
 // Release releases associated resources. Release should always success
 // and can be called multiple times without causing error.
 func (iter *ChunkIterator) Release() {
-	iter.dbIter.Release()
+	if iter.dbIter != nil {
+		iter.dbIter.Release()
+	}
 }
 
 // Error returns any accumulated error. Exhausting all the key/value pairs
@@ -137,6 +191,15 @@ type IteratorRange struct {
 	Dimension world.Dimension
 }
 
+// area returns the number of chunk positions within the range, or 0 if the
+// range isn't limited.
+func (r *IteratorRange) area() int64 {
+	if r.Max[0] <= r.Min[0] || r.Max[1] <= r.Min[1] {
+		return 0
+	}
+	return int64(r.Max[0]-r.Min[0]) * int64(r.Max[1]-r.Min[1])
+}
+
 // within checks if a position and dimension is within the IteratorRange.
 func (r *IteratorRange) within(pos world.ChunkPos, dim world.Dimension) bool {
 	if dim != r.Dimension && r.Dimension != nil {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// layoutSort decides the order in which the children of a group are placed in
+// its grid.
+type layoutSort string
+
+const (
+	// sortName places groups before worlds, both ordered by name.
+	sortName layoutSort = "name"
+	// sortSize places the largest children first, by the number of chunks
+	// they cover. Children of the same size are ordered by name.
+	sortSize layoutSort = "size"
+	// sortOrder places the children in the order of an order file. Children
+	// not listed in it are placed after all listed ones, ordered by name.
+	sortOrder layoutSort = "order"
+)
+
+func parseLayoutSort(s string) (layoutSort, error) {
+	switch o := layoutSort(s); o {
+	case sortName, sortSize, sortOrder:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown sort %q", s)
+}
+
+// layoutOrder orders the children of groups during layout, so that the same
+// inputs always result in the same layout.
+type layoutOrder struct {
+	by layoutSort
+	// rank holds the position of every path listed in the order file.
+	rank map[string]int
+}
+
+// loadLayoutOrder returns the layoutOrder for by. With sortOrder, orderFile is
+// read, it lists the path of a group or world relative to the input folder on
+// every line, such as "group/sub/world". Empty lines and lines starting with #
+// are ignored.
+func loadLayoutOrder(by layoutSort, orderFile string) (*layoutOrder, error) {
+	o := &layoutOrder{by: by}
+	if by != sortOrder {
+		return o, nil
+	}
+	if orderFile == "" {
+		return nil, fmt.Errorf("-sort=order needs -order")
+	}
+	f, err := os.Open(orderFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	o.rank = make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSuffix(path.Clean(strings.ReplaceAll(line, "\\", "/")), ".mcworld")
+		if _, ok := o.rank[line]; !ok {
+			o.rank[line] = len(o.rank)
+		}
+	}
+	return o, scanner.Err()
+}
+
+// children returns the children of g in layout order. groupPath is the path of
+// g relative to the input folder.
+func (o *layoutOrder) children(g *mapGroup, groupPath string) []layoutItem {
+	type child struct {
+		path string
+		item layoutItem
+	}
+	var children []child
+	for _, name := range sortedKeys(g.groups) {
+		children = append(children, child{path.Join(groupPath, name), g.groups[name]})
+	}
+	for _, name := range sortedKeys(g.worlds) {
+		children = append(children, child{path.Join(groupPath, name), g.worlds[name]})
+	}
+
+	switch o.by {
+	case sortSize:
+		sort.SliceStable(children, func(i, j int) bool {
+			a, b := children[i].item.BoundsTotal(), children[j].item.BoundsTotal()
+			return int64(a[0])*int64(a[1]) > int64(b[0])*int64(b[1])
+		})
+	case sortOrder:
+		rank := func(c child) int {
+			if r, ok := o.rank[c.path]; ok {
+				return r
+			}
+			return len(o.rank)
+		}
+		sort.SliceStable(children, func(i, j int) bool {
+			return rank(children[i]) < rank(children[j])
+		})
+	}
+
+	items := make([]layoutItem, len(children))
+	for i, c := range children {
+		items[i] = c.item
+	}
+	return items
+}
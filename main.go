@@ -1,30 +1,33 @@
 package main
 
 import (
-	"context"
+	"compress/flate"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
 	"github.com/df-mc/dragonfly/server/world/mcdb"
-	"github.com/df-mc/goleveldb/leveldb"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 )
 
 const padding = 80
 
-var sem = semaphore.NewWeighted(30)
-
 type layoutItem interface {
 	BoundsTotal() ChunkPos
+	getOffset() ChunkPos
 	setOffset(ChunkPos)
 }
 
@@ -35,19 +38,18 @@ type mapGroup struct {
 
 	numCols, colWidth int32
 	rowHeights        []int32
+	// size is the size of the group, it covers all of its children.
+	size ChunkPos
 
 	offsetFromParent ChunkPos
 }
 
 func (g *mapGroup) BoundsTotal() ChunkPos {
-	var z int32
-	for _, v := range g.rowHeights {
-		z += v
-	}
-	return ChunkPos{
-		int32(g.numCols) * g.colWidth,
-		z,
-	}
+	return g.size
+}
+
+func (g *mapGroup) getOffset() ChunkPos {
+	return g.offsetFromParent
 }
 
 func (g *mapGroup) setOffset(p ChunkPos) {
@@ -55,17 +57,59 @@ func (g *mapGroup) setOffset(p ChunkPos) {
 }
 
 type worldMap struct {
-	Name             string
+	Name string
+	// source is the path of the .mcworld file, filepath the entry of the
+	// world in the cache folder. With memory set, the world is read from the
+	// .mcworld file and the cache entry only holds its manifest.
+	source           string
 	filepath         string
+	memory           bool
 	boundsMin        ChunkPos
 	boundsMax        ChunkPos
 	offsetFromParent ChunkPos
+	manifest         *worldManifest
+	// skip holds chunks of the world that are not copied, because they were
+	// taken from another world.
+	skip map[iterKey]struct{}
+	// ids holds the new unique IDs of the entities of the world whose unique
+	// IDs are used by another world, as set by assignUniqueIDs.
+	ids uniqueIDs
 }
 
+// mapSchemaVersion is the version of the format of map.json, it is increased
+// whenever a field changes in a way that isn't backwards compatible. The format
+// is described by map.schema.json.
+const mapSchemaVersion = 2
+
 type worldJson struct {
 	Name           string
 	Size           ChunkPos
 	OffsetAbsolute ChunkPos
+
+	// Source is the path of the .mcworld file the world was read from, and
+	// SourceHash the hex encoded SHA-256 hash of that file.
+	Source     string
+	SourceHash string
+	// BoundsMin and BoundsMax are the inclusive bounds of the world at its
+	// original chunk coordinates, over all dimensions.
+	BoundsMin ChunkPos
+	BoundsMax ChunkPos
+	// Dimensions holds the bounds at the original chunk coordinates and the
+	// number of chunks of every dimension present in the world.
+	Dimensions map[string]dimensionJson
+	// Chunks is the number of chunks of the world, over all dimensions.
+	Chunks int
+	// Spawn is the spawn point of the world in merged block coordinates.
+	Spawn [3]int32
+	// Rotation is the clockwise rotation of the world in degrees. Worlds are
+	// currently never rotated, so it is always 0.
+	Rotation int
+}
+
+type dimensionJson struct {
+	BoundsMin ChunkPos
+	BoundsMax ChunkPos
+	Chunks    int
 }
 
 type groupJson struct {
@@ -78,7 +122,18 @@ type groupJson struct {
 }
 
 type mapJson struct {
-	Groups map[string]groupJson
+	Schema        string `json:"$schema"`
+	SchemaVersion int
+	// MergedAt is the time the merge ran. It is the only field that changes
+	// between merges of the same inputs, so mapJson.hash leaves it out and
+	// map.json is only compared through that hash.
+	MergedAt time.Time
+	// Mode is the mergeMode the worlds were placed with.
+	Mode mergeMode
+	// Transform is the transform applied to the chunks, nil if they were
+	// copied unchanged.
+	Transform *transformJson `json:",omitempty"`
+	Groups    map[string]groupJson
 }
 
 func (w *worldMap) BoundsTotal() ChunkPos {
@@ -88,136 +143,140 @@ func (w *worldMap) BoundsTotal() ChunkPos {
 	}
 }
 
+func (w *worldMap) getOffset() ChunkPos {
+	return w.offsetFromParent
+}
+
 func (w *worldMap) setOffset(p ChunkPos) {
 	w.offsetFromParent = p
 }
 
-func (w *worldMap) calcBounds(db *mcdb.DB) {
-	it := newChunkIterator(db, nil)
-	for it.Next() {
-		pos := it.Position()
-		if w.boundsMin[0] > pos.X() {
-			w.boundsMin[0] = pos.X()
-		}
-		if w.boundsMin[1] > pos.Z() {
-			w.boundsMin[1] = pos.Z()
-		}
-		if w.boundsMax[0] < pos.X() {
-			w.boundsMax[0] = pos.X()
-		}
-		if w.boundsMax[1] < pos.Z() {
-			w.boundsMax[1] = pos.Z()
-		}
-	}
-	it.Release()
+// chunkOffset returns the offset that moves a chunk of the source world to its
+// position in the merged world. base is the absolute offset of the parent
+// group, so that the chunk at boundsMin ends up at the OffsetAbsolute written
+// to map.json.
+func (w *worldMap) chunkOffset(base ChunkPos) ChunkPos {
+	return base.Add(w.offsetFromParent).Sub(w.boundsMin)
 }
 
-var worldsAdded = 0
-var worldsTotal = 0
+// merger copies worlds into the output database. Up to sem worlds are read at
+// the same time, all of them sending their chunks to a single chunkWriter.
+type merger struct {
+	out  *chunkWriter
+	sem  *semaphore.Weighted
+	prog *progress
+	errs *errorCollector
+	t    *transform
+	wg   sync.WaitGroup
+}
 
-func addWorlds(wg *sync.WaitGroup, dbOutput *mcdb.DB, baseOffset ChunkPos, worlds map[string]*worldMap) error {
+func (m *merger) addWorlds(baseOffset ChunkPos, worlds map[string]*worldMap) error {
+	ctx := m.errs.Context()
 	for _, w := range worlds {
-		logrus.Infof("Adding %s %d/%d", w.Name, worldsAdded, worldsTotal)
-		worldsAdded++
-
-		wg.Add(1)
-		sem.Acquire(context.Background(), 1)
+		if err := m.sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		m.wg.Add(1)
 		go func(w *worldMap) {
-			defer wg.Done()
-			defer sem.Release(1)
-			var outputOffset = baseOffset.Add(w.offsetFromParent)
-
-			db, err := mcdb.New(w.filepath)
-			if err != nil {
-				logrus.Error(err)
-				return
-			}
-
-			it := newChunkIterator(db, nil)
-			defer it.Release()
-			for it.Next() {
-			}
-
-			b := leveldb.MakeBatch(len(it.seen) * 16)
-			for k := range it.seen {
-				pos := k.pos
-				dim := k.dim
-				var posOut = (world.ChunkPos)(outputOffset.Add(pos))
-
-				err := copyChunk(db, pos, dim, b, posOut)
-				if err != nil {
-					logrus.Error(err)
-					return
-				}
-
-				blockNBT, err := db.LoadBlockNBT(pos, dim)
-				if err != nil {
-					logrus.Error(err)
-					return
-				}
-				for _, v := range blockNBT {
-					x, ok := v["x"].(int32)
-					if !ok {
-						continue
-					}
-					z, ok := v["z"].(int32)
-					if !ok {
-						continue
-					}
-					v["x"] = x + outputOffset.X()*16
-					v["z"] = z + outputOffset.Z()*16
-				}
-				err = dbOutput.SaveBlockNBT(posOut, blockNBT, world.Overworld)
-				if err != nil {
-					logrus.Error(err)
-					return
-				}
-
-				entities, err := db.LoadEntities(pos, dim, &EntityRegistry{})
-				if err != nil {
-					logrus.Error(err)
-					return
-				}
-				for _, e := range entities {
-					ent := e.(*DummyEntity)
-					entt := ent.T.(*DummyEntityType)
-					entt.NBT["Pos"].([]any)[0] = entt.NBT["Pos"].([]any)[0].(float32) + float32(outputOffset.X()*16)
-					entt.NBT["Pos"].([]any)[2] = entt.NBT["Pos"].([]any)[2].(float32) + float32(outputOffset.Z()*16)
-				}
-				err = dbOutput.SaveEntities(posOut, entities, world.Overworld)
-				if err != nil {
-					logrus.Error(err)
-					return
-				}
-			}
-
-			err = dbOutput.LDB().Write(b, nil)
-			if err != nil {
-				logrus.Error(err)
-				return
+			defer m.wg.Done()
+			defer m.sem.Release(1)
+			m.prog.startWorld(w.source)
+
+			dbOutput := newWorldWriter(ctx, m.out, w.source)
+			defer dbOutput.done()
+			err := copyWorld(ctx, w, dbOutput, w.chunkOffset(baseOffset), m.t, m.errs)
+			if err != nil && m.errs.worldError(w.source, err) {
+				dbOutput.rollback()
 			}
 		}(w)
 	}
 	return nil
 }
 
-func addGroups(wg *sync.WaitGroup, dbOutput *mcdb.DB, baseOffset ChunkPos, groups map[string]*mapGroup) error {
-	for _, group := range groups {
-		if len(group.groups) > 0 {
-			err := addGroups(wg, dbOutput, baseOffset.Add(group.offsetFromParent), group.groups)
-			if err != nil {
-				return err
-			}
-		}
-		err := addWorlds(wg, dbOutput, baseOffset.Add(group.offsetFromParent), group.worlds)
+// addConflicts writes the chunks of all conflicts that have to be merged from
+// more than one world. It must be called after all worlds were added.
+func (m *merger) addConflicts(conflicts []*chunkConflict, policy conflictPolicy) {
+	ctx := m.errs.Context()
+	m.prog.startWorld(conflictsName)
+	dbOutput := newWorldWriter(ctx, m.out, conflictsName)
+	defer dbOutput.done()
+	err := resolveConflicts(ctx, conflicts, policy, m.t, dbOutput, m.errs)
+	if err != nil && m.errs.worldError(conflictsName, err) {
+		dbOutput.rollback()
+	}
+}
+
+// addFill writes the chunk c at every position of the area. It must be called
+// after all worlds were added.
+func (m *merger) addFill(c *chunk.Chunk, area *fillArea) {
+	ctx := m.errs.Context()
+	m.prog.startWorld(fillName)
+	dbOutput := newWorldWriter(ctx, m.out, fillName)
+	defer dbOutput.done()
+	err := writeFill(ctx, c, area, dbOutput)
+	if err != nil && m.errs.worldError(fillName, err) {
+		dbOutput.rollback()
+	}
+}
+
+func (m *merger) addGroup(base ChunkPos, g *mapGroup) error {
+	offsetAbsolute := base.Add(g.offsetFromParent)
+	for _, childGroup := range g.groups {
+		err := m.addGroup(offsetAbsolute, childGroup)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return m.addWorlds(offsetAbsolute, g.worlds)
+}
+
+// registerProgress adds all worlds in the group to the progress tracker.
+func registerProgress(prog *progress, g *mapGroup) {
+	for _, childGroup := range g.groups {
+		registerProgress(prog, childGroup)
+	}
+	for _, w := range g.worlds {
+		prog.addWorld(w.source, int64(len(w.manifest.Chunks)-len(w.skip)))
+	}
+}
+
+// scanError is returned by recursiveAddWorld for a world whose chunks couldn't
+// be read. The world is left out of the merge, unless the error policy stops
+// it.
+type scanError struct {
+	source string
+	err    error
+}
+
+func (e *scanError) Error() string {
+	var zipErr *zipError
+	if errors.As(e.err, &zipErr) {
+		// The archive is already named.
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.source, e.err)
+}
+
+func (e *scanError) Unwrap() error {
+	return e.err
+}
+
+// loadCause returns the error recursiveAddWorld returned for a world without
+// the name of the world, for reports that list it next to the error.
+func loadCause(err error) error {
+	if scanErr, ok := err.(*scanError); ok {
+		err = scanErr.err
+	}
+	if zipErr, ok := err.(*zipError); ok {
+		if zipErr.Entry == "" {
+			return zipErr.Err
+		}
+		return fmt.Errorf("%s: %w", zipErr.Entry, zipErr.Err)
+	}
+	return err
 }
 
-func recursiveAddWorld(filepath string, parts []string, groups map[string]*mapGroup) error {
+func recursiveAddWorld(filepath string, parts []string, groups map[string]*mapGroup, mode sourceMode) error {
 	groupName := parts[0]
 	group, ok := groups[groupName]
 	if !ok {
@@ -241,57 +300,105 @@ func recursiveAddWorld(filepath string, parts []string, groups map[string]*mapGr
 			return nil
 		}
 
-		if path.Ext(filepath) == ".mcworld" {
-			s := path.Join("tmp", filepath)
-			if _, err := os.Stat(s); err != nil {
-				os.MkdirAll(s, 0755)
-				err := UnpackZip(filepath, s, func(s string) bool {
-					is_behaviors := strings.Contains(s, "behavior_packs")
-					is_resources := strings.Contains(s, "resource_packs")
-					return !is_resources && !is_behaviors
-				})
-				if err != nil {
-					return err
-				}
-			}
-			filepath = s
-		} else {
+		if path.Ext(filepath) != ".mcworld" {
 			return fmt.Errorf("%s is not mcworld", filepath)
 		}
+		source := filepath
+		filepath, hash, err := cacheEntry(source)
+		if err != nil {
+			return err
+		}
+		memory := mode == sourceMemory
+		if !memory {
+			if _, err := extractInto(source, filepath); err != nil {
+				return err
+			}
+		}
 
-		logrus.Infof("Getting Bounds %s", filepath)
-		db, err := mcdb.New(filepath)
+		manifest, err := loadManifest(filepath, stat)
 		if err != nil {
-			logrus.Error(err)
-			return nil
+			logrus.Warnf("%s: %v", filepath, err)
+		}
+		if manifest == nil {
+			logrus.Infof("Getting Bounds %s", source)
+			manifest, err = scanWorld(source, filepath, memory, stat, hash)
+			if err != nil {
+				return &scanError{source, err}
+			}
+			if err := manifest.save(filepath); err != nil {
+				logrus.Warnf("%s: save manifest: %v", filepath, err)
+			}
+		}
+		group.worlds[worldName] = &worldMap{
+			Name:      worldName,
+			source:    source,
+			filepath:  filepath,
+			memory:    memory,
+			boundsMin: manifest.BoundsMin,
+			boundsMax: manifest.BoundsMax,
+			manifest:  manifest,
 		}
-		w := &worldMap{Name: worldName, filepath: filepath}
-		w.calcBounds(db)
-		db.Close()
-		group.worlds[worldName] = w
-		worldsTotal++
 		return nil
 	}
-	return recursiveAddWorld(filepath, parts, group.groups)
+	return recursiveAddWorld(filepath, parts, group.groups, mode)
 }
 
-func layoutWorld(w *worldMap, offset ChunkPos) {
-	w.offsetFromParent = offset
+// extractWorld extracts the .mcworld file at filepath into its entry in the
+// cache folder, unless it was extracted before, and returns the folder of the
+// world.
+func extractWorld(filepath string) (string, error) {
+	entry, _, err := cacheEntry(filepath)
+	if err != nil {
+		return "", err
+	}
+	return extractInto(filepath, entry)
 }
 
-func layoutGroup(g *mapGroup, parentOffset ChunkPos, padding int32) {
-	// First, layout the children
-	var children []layoutItem
-	for _, childGroup := range g.groups {
-		layoutGroup(childGroup, parentOffset, padding)
-		children = append(children, childGroup)
+// extractedName is the name of the folder in a cache entry that the world is
+// extracted to.
+const extractedName = "world"
+
+// extractInto extracts the .mcworld file at filepath into the cache entry, and
+// returns the folder of the world. The world is extracted into a separate
+// folder first, so that an archive that fails to extract is never mistaken for
+// an extracted world.
+func extractInto(filepath, entry string) (string, error) {
+	s := path.Join(entry, extractedName)
+	if _, err := os.Stat(s); err == nil {
+		return s, nil
 	}
-	for _, childWorld := range g.worlds {
-		layoutWorld(childWorld, parentOffset)
-		children = append(children, childWorld)
+	partial := s + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return "", err
 	}
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return "", err
+	}
+	err := UnpackZip(filepath, partial, func(s string) bool {
+		is_behaviors := strings.Contains(s, "behavior_packs")
+		is_resources := strings.Contains(s, "resource_packs")
+		return !is_resources && !is_behaviors
+	}, defaultZipLimits)
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", err
+	}
+	return s, os.Rename(partial, s)
+}
+
+// layoutGroup arranges the children of g in a grid. Every offset set here is
+// relative to the origin of the parent group, the absolute position of an item
+// is the sum of the offsets of all its parents. Children are placed in the
+// order decided by order, groupPath is the path of g relative to the input
+// folder.
+func layoutGroup(g *mapGroup, groupPath string, padding int32, order *layoutOrder) {
+	// First, layout the children
+	for name, childGroup := range g.groups {
+		layoutGroup(childGroup, path.Join(groupPath, name), padding, order)
+	}
+	children := order.children(g, groupPath)
 
-	// Then, calculate the size and position of this group based on its children
+	// Then, calculate the size of a cell based on the largest child
 	var maxWidth, maxHeight int32
 	for _, child := range children {
 		cb := child.BoundsTotal()
@@ -303,65 +410,166 @@ func layoutGroup(g *mapGroup, parentOffset ChunkPos, padding int32) {
 		}
 	}
 
-	a := math.Sqrt(float64(len(g.groups) + len(g.worlds)))
-
+	a := math.Sqrt(float64(len(children)))
 	g.numCols = int32(math.Ceil(a))
 	if g.numCols == 0 {
 		g.numCols = 1
 	}
-	rows := int32(math.Floor(a))
-	_ = rows
-	g.colWidth = int32(maxWidth)
-	if a > 0 {
+	g.colWidth = maxWidth
+	rowHeight := maxHeight
+	if len(children) > 0 {
 		g.colWidth += padding
+		rowHeight += padding
 	}
 
-	currentOffset := ChunkPos(parentOffset)
-	var row, col int32
-	var rowHeight int32 = maxHeight
-	for _, child := range children {
-		_, is_world := child.(*worldMap)
-		cb := child.BoundsTotal()
-		child.setOffset(ChunkPos{
-			currentOffset.X() + col*g.colWidth,
-			currentOffset.Z(),
-		})
-
-		childHeight := cb.Z()
-		if is_world {
-			childHeight += padding
-		}
-
-		col++
-		if col == g.numCols {
-			col = 0
-			row++
-			currentOffset[1] += rowHeight
-			if is_world {
-				currentOffset[1] += padding
-			}
-			currentOffset[0] = parentOffset[0]
+	g.rowHeights = nil
+	for i, child := range children {
+		col, row := int32(i)%g.numCols, int32(i)/g.numCols
+		if col == 0 {
 			g.rowHeights = append(g.rowHeights, rowHeight)
-		} else {
-			if is_world {
-				currentOffset[0] += padding
-			}
 		}
+		child.setOffset(ChunkPos{col * g.colWidth, row * rowHeight})
+	}
+
+	g.size = ChunkPos{g.numCols * g.colWidth, 0}
+	for _, h := range g.rowHeights {
+		g.size[1] += h
 	}
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		logrus.Error("Usage: WorldMerge.exe <input folder> [output-name]")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "clean-cache":
+			runCleanCache(os.Args[2:])
+			return
+		}
+	}
+
+	progressFlag := flag.String("progress", string(progressAuto), "progress output: auto, bar, log, json or none")
+	errorsFlag := flag.String("errors", string(policyFailFast), "what to do when a world fails: fail-fast, skip-world or best-effort")
+	concurrencyFlag := flag.Int("worlds", 8, "number of worlds read at the same time")
+	batchSizeFlag := flag.Int("batch-size", 4<<20, "size in bytes at which a batch is written to the output")
+	maxMemoryFlag := flag.Int64("max-memory", 256<<20, "maximum bytes of chunk data read but not yet written")
+	modeFlag := flag.String("mode", string(modeGrid), "where worlds are placed: grid, or original to keep their coordinates")
+	conflictsFlag := flag.String("conflicts", string(conflictFirst), "with -mode=original, which world a chunk present in more than one world is taken from: first, last, newest, non-air, or blocks and layers to merge it block by block")
+	priorityFlag := flag.String("priority", "", "with -mode=original, comma separated parts of world paths, worlds matching an earlier part come first when resolving conflicts")
+	fillFlag := flag.String("fill", string(fillNone), "what the chunks between worlds are filled with: none, ocean, flat or template")
+	fillTemplateFlag := flag.String("fill-template", "", "with -fill=template, the .mcworld file the fill chunk is copied from")
+	fillChunkFlag := flag.String("fill-chunk", "0,0", "with -fill=template, the chunk x,z of the template world that is copied")
+	generatorFlag := flag.String("generator", string(generatorAuto), "generator of the merged world: auto to match -fill, flat, void or infinite")
+	sortFlag := flag.String("sort", string(sortName), "order in which worlds and groups are laid out: name, size, or order to use -order")
+	orderFlag := flag.String("order", "", "with -sort=order, a file listing the paths of worlds and groups in the order they are laid out")
+	geoJSONFlag := flag.String("geojson", "map.geojson", "file the layout is exported to as GeoJSON, empty to disable")
+	htmlFlag := flag.String("html", "map.html", "file a standalone HTML map of the layout is written to, empty to disable")
+	fixFlag := flag.Bool("fix", false, "move apart overlapping worlds and groups after layout")
+	sourceFlag := flag.String("source", string(sourceExtract), "how .mcworld files are read: extract into the cache folder, or memory to read them from the archive without extracting")
+	flag.StringVar(&cacheDir, "cache", cacheDir, "folder extracted worlds and manifests are cached in")
+	compressionFlag := flag.Int("compression", flate.DefaultCompression, "compression level of world.mcworld from 1 to 9, -1 for the default or 0 to store files uncompressed")
+	packsFlag := flag.Bool("packs", true, "copy the behavior and resource packs used by the worlds into the merged world")
+	unknownFlag := flag.String("unknown", string(unknownNone), "what happens to blocks and entities no pack of the merged world defines: none to not check them, report, placeholder to replace blocks with -placeholder, or drop; entities are dropped by both placeholder and drop")
+	replaceBlocksFlag := flag.String("replace-blocks", "", "JSON file of rules replacing blocks in all copied chunks, each with a from and to block with a name and optional states")
+	entityRulesFlag := flag.String("entity-rules", "", "JSON file of rules deciding which entities are copied: include and exclude lists matching identifiers and tags, maxPerChunk and stripNames")
+	itemRulesFlag := flag.String("item-rules", "", "JSON file of rules for the items in containers such as chests: remove lists item names to remove, illegalEnchantments and normalizeCounts")
+	placeholderFlag := flag.String("placeholder", "minecraft:info_update", "with -unknown=placeholder, the block undefined blocks are replaced with")
+	dryRunFlag := flag.Bool("dry-run", false, "scan the worlds and write map.json and a summary of the merge without writing the output world; worlds are read from their archives")
+	zipWorkersFlag := flag.Int("zip-workers", runtime.NumCPU(), "number of files compressed at the same time when writing world.mcworld")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: WorldMerge.exe [flags] <input folder> [output-name]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       WorldMerge.exe serve [flags] <world folder>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       WorldMerge.exe inspect [flags] <world folder or .mcworld>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       WorldMerge.exe verify [flags] <world folder>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       WorldMerge.exe clean-cache [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
 		return
 	}
-	inputFolder := os.Args[1]
+	inputFolder := flag.Arg(0)
 
 	outputName := "world-out"
-	if len(os.Args) >= 3 {
-		outputName = os.Args[2]
+	if flag.NArg() >= 2 {
+		outputName = flag.Arg(1)
+	}
+	progressMode, err := parseProgressMode(*progressFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	errorPolicy, err := parseErrorPolicy(*errorsFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mode, err := parseMergeMode(*modeFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	conflictPolicy, err := parseConflictPolicy(*conflictsFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	layoutSort, err := parseLayoutSort(*sortFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	order, err := loadLayoutOrder(layoutSort, *orderFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fillPattern, err := parseFillPattern(*fillFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	generator, err := parseGeneratorType(*generatorFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sourceMode, err := parseSourceMode(*sourceFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	unknown, err := parseUnknownPolicy(*unknownFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	blocks, err := loadBlockMapping(*replaceBlocksFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	entities, err := loadEntityRules(*entityRulesFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	items, err := loadItemRules(*itemRulesFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fill, err := loadFill(fillPattern, *fillTemplateFlag, *fillChunkFlag)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *concurrencyFlag < 1 || *batchSizeFlag < 1 || *maxMemoryFlag < 1 || *zipWorkersFlag < 1 {
+		logrus.Fatal("-worlds, -batch-size, -max-memory and -zip-workers must be positive")
+	}
+	if *compressionFlag < flate.DefaultCompression || *compressionFlag > flate.BestCompression {
+		logrus.Fatal("-compression must be between -1 and 9")
+	}
+	if *dryRunFlag {
+		// Nothing is extracted, the manifests are still cached.
+		sourceMode = sourceMemory
+	} else {
+		os.RemoveAll(outputName)
 	}
-	os.RemoveAll(outputName)
 
 	worldPaths, err := glob(inputFolder, ".mcworld")
 	if err != nil {
@@ -371,11 +579,31 @@ func main() {
 
 	// load
 	var worldGroups = map[string]*mapGroup{}
+	var failed []string
+	errs := newErrorCollector(errorPolicy)
 	for _, v := range worldPaths {
 		v = filepath.ToSlash(v)
 		p := strings.Split(v, ".")
 		parts := strings.Split(p[0], "/")[1:]
-		err = recursiveAddWorld(v, parts, worldGroups)
+		err = recursiveAddWorld(v, parts, worldGroups, sourceMode)
+		if err != nil && *dryRunFlag {
+			logrus.Errorf("Skipping %v", err)
+			failed = append(failed, err.Error())
+			continue
+		}
+		var zipErr *zipError
+		var scanErr *scanError
+		if err != nil && (errors.As(err, &scanErr) || errors.As(err, &zipErr)) {
+			// A broken or malicious archive only loses its own world, unless
+			// the error policy stops the merge.
+			errs.worldError(v, loadCause(err))
+			if errorPolicy == policyFailFast {
+				logrus.Fatal("merge failed, not writing world.mcworld")
+			}
+			logrus.Errorf("Skipping %s", v)
+			failed = append(failed, err.Error())
+			continue
+		}
 		if err != nil {
 			logrus.Fatal(err)
 		}
@@ -383,51 +611,214 @@ func main() {
 
 	logrus.Info("Laying Out")
 	root := &mapGroup{groups: worldGroups}
-	layoutGroup(root, ChunkPos{}, padding)
+	var conflicts []*chunkConflict
+	var unresolved int
+	if mode == modeOriginal {
+		layoutOriginal(root)
+		worlds := allWorlds(root)
+		if *priorityFlag != "" {
+			orderWorlds(worlds, strings.Split(*priorityFlag, ","))
+		}
+		conflicts = findConflicts(worlds, conflictPolicy)
+		for _, c := range conflicts {
+			if c.Winner == "" {
+				unresolved++
+			}
+		}
+		logrus.Infof("%d chunks are present in more than one world", len(conflicts))
+		if err := writeConflictReport(conflicts, "conflicts.json"); err != nil {
+			logrus.Fatal(err)
+		}
+	} else {
+		layoutGroup(root, "", padding, order)
 
-	// center root
-	root.offsetFromParent = root.offsetFromParent.Sub(root.BoundsTotal().Div(2))
+		// center root
+		root.offsetFromParent = ChunkPos{}.Sub(root.BoundsTotal().Div(2))
+	}
 
-	err = writeGroupToJSON(root, "map.json")
+	// Worlds keeping their original coordinates may overlap on purpose.
+	allowOverlaps := mode == modeOriginal
+	problems := validateLayout(root, allowOverlaps)
+	if len(problems) > 0 && *fixFlag && !allowOverlaps {
+		logrus.Infof("Fixing Layout, moved %d items", fixLayout(root, padding))
+		root.offsetFromParent = ChunkPos{}.Sub(root.BoundsTotal().Div(2))
+		problems = validateLayout(root, allowOverlaps)
+	}
+	if len(problems) > 0 {
+		fixable := false
+		for _, p := range problems {
+			logrus.Error(p.msg)
+			fixable = fixable || p.fixable
+		}
+		if fixable && !*fixFlag {
+			logrus.Info("Overlapping items can be moved apart with -fix")
+		}
+		if !*dryRunFlag {
+			logrus.Fatalf("Layout has %d problems", len(problems))
+		}
+	}
+
+	transformData, err := newTransformJson(*replaceBlocksFlag, *entityRulesFlag, *itemRulesFlag, unknown)
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	mapData, err := writeGroupToJSON(root, mode, transformData, "map.json")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *geoJSONFlag != "" {
+		if err := writeGeoJSON(mapData, *geoJSONFlag); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if *htmlFlag != "" {
+		if err := writeViewer(mapData, *htmlFlag); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if *dryRunFlag {
+		summary := summarizeMerge(root, mode, conflicts, fill)
+		for _, p := range problems {
+			summary.Problems = append(summary.Problems, p.msg)
+		}
+		summary.Failed = failed
+		summary.writeTable(os.Stdout)
+		if len(summary.Problems) > 0 || len(summary.Failed) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var packs packSet
+	if *packsFlag {
+		if packs, err = collectPacks(allWorlds(root)); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	t := &transform{blocks: blocks, entities: entities, items: items, unknown: unknown, placeholder: *placeholderFlag, report: &transformReport{}}
+	if t.unknown != unknownNone {
+		if t.registry, err = loadAddonRegistry(packs); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if n := assignUniqueIDs(allWorlds(root)); n > 0 {
+		logrus.Infof("%d entities get a new unique ID, as another world uses theirs", n)
+	}
 
 	logrus.Info("Generating Output World")
+	var chunksDone int64
+	var mergeErr error
 	{ // output world
 		providerOut, err := mcdb.New(outputName)
 		if err != nil {
 			logrus.Fatal(err)
 		}
 
-		wg := &sync.WaitGroup{}
-		err = addGroups(wg, providerOut, ChunkPos{}, worldGroups)
-		if err != nil {
+		prog := newProgress(progressMode)
+		registerProgress(prog, root)
+		if unresolved > 0 {
+			prog.addWorld(conflictsName, int64(unresolved))
+		}
+		var fillAt *fillArea
+		var fillChunks int64
+		if fill != nil {
+			fillAt = newFillArea(root, mode)
+			fillChunks = fillAt.count()
+			prog.addWorld(fillName, fillChunks)
+		}
+		prog.Start(time.Second)
+
+		m := &merger{
+			out:  newChunkWriter(providerOut.LDB(), *batchSizeFlag, *maxMemoryFlag, prog, errs),
+			sem:  semaphore.NewWeighted(int64(*concurrencyFlag)),
+			prog: prog,
+			errs: errs,
+			t:    t,
+		}
+		err = m.addGroup(ChunkPos{}, root)
+		m.wg.Wait()
+		if err == nil && unresolved > 0 {
+			m.addConflicts(conflicts, conflictPolicy)
+		}
+		if err == nil && fillChunks > 0 {
+			m.addFill(fill, fillAt)
+		}
+		m.out.Close()
+		prog.Stop()
+		chunksDone = prog.ChunksDone()
+		if err != nil && m.errs.Context().Err() == nil {
 			logrus.Fatal(err)
 		}
-		wg.Wait()
+		mergeErr = m.errs.Err()
+
+		var hash mergeHash
+		if mergeErr == nil {
+			if hash.Input, err = inputHash(allWorlds(root), flag.CommandLine); err != nil {
+				logrus.Fatal(err)
+			}
+			if hash.Map, err = mapData.hash(); err != nil {
+				logrus.Fatal(err)
+			}
+			if hash.Keys, err = keysHash(providerOut.LDB()); err != nil {
+				logrus.Fatal(err)
+			}
+		}
 
 		providerOut.SaveSettings(&world.Settings{
 			Name:            "world",
 			DefaultGameMode: world.GameModeCreative,
 		})
+		if err := setGenerator(providerOut, generator, fill); err != nil {
+			logrus.Fatal(err)
+		}
 		err = providerOut.Close()
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		err = ZipFolder("world.mcworld", outputName)
+		if err := packs.write(outputName); err != nil {
+			logrus.Error(err)
+			if mergeErr == nil {
+				mergeErr = err
+			}
+		}
+		t.report.log()
+		if err := t.report.write("transforms.json"); err != nil {
+			logrus.Error(err)
+		}
+		m.errs.Report()
+		if mergeErr != nil && errorPolicy == policyFailFast {
+			logrus.Fatal("merge failed, not writing world.mcworld")
+		}
+		logrus.Info("Writing world.mcworld")
+		err = ZipFolder("world.mcworld", outputName, *compressionFlag, *zipWorkersFlag)
 		if err != nil {
 			logrus.Fatal(err)
 		}
+		if mergeErr == nil {
+			if err := checkHash(hash, hashName); err != nil {
+				logrus.Error(err)
+				mergeErr = err
+			}
+		}
 	}
 
-	logrus.Infof("%d chunks", countChunks)
+	logrus.Infof("%d chunks", chunksDone)
+	if mergeErr != nil {
+		os.Exit(1)
+	}
 }
 
-func writeGroupToJSON(rootGroup *mapGroup, filename string) error {
+func writeGroupToJSON(rootGroup *mapGroup, mode mergeMode, transform *transformJson, filename string) (mapJson, error) {
 	// Create a mapJson instance to hold the root group data
 	mapData := mapJson{
-		Groups: make(map[string]groupJson),
+		Schema:        "map.schema.json",
+		SchemaVersion: mapSchemaVersion,
+		MergedAt:      time.Now().UTC().Truncate(time.Second),
+		Mode:          mode,
+		Transform:     transform,
+		Groups:        make(map[string]groupJson),
 	}
 
 	// Convert the root group and its children to JSON data
@@ -439,17 +830,17 @@ func writeGroupToJSON(rootGroup *mapGroup, filename string) error {
 	// Encode the mapJson instance as JSON and write it to a file
 	file, err := os.Create(filename)
 	if err != nil {
-		return err
+		return mapData, err
 	}
 	defer file.Close()
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(mapData); err != nil {
-		return err
+		return mapData, err
 	}
 
-	return nil
+	return mapData, nil
 }
 
 func groupToJSON(g *mapGroup, base ChunkPos) groupJson {
@@ -480,10 +871,36 @@ func groupToJSON(g *mapGroup, base ChunkPos) groupJson {
 
 func worldToJSON(w *worldMap, base ChunkPos) worldJson {
 	// Create a worldJson instance to hold the world data
+	offset := w.chunkOffset(base)
+	spawn := w.manifest.Spawn
 	worldData := worldJson{
 		Name:           w.Name,
 		Size:           w.BoundsTotal(),
 		OffsetAbsolute: base.Add(w.offsetFromParent),
+		Source:         filepath.ToSlash(w.source),
+		SourceHash:     w.manifest.SourceHash,
+		BoundsMin:      w.boundsMin,
+		BoundsMax:      w.boundsMax,
+		Dimensions:     make(map[string]dimensionJson),
+		Chunks:         len(w.manifest.Chunks),
+		Spawn:          [3]int32{spawn[0] + offset.X()*16, spawn[1], spawn[2] + offset.Z()*16},
+	}
+
+	// Collect the bounds of every dimension from the chunks of the world
+	for _, c := range w.manifest.Chunks {
+		dim, ok := world.DimensionByID(int(c[0]))
+		if !ok {
+			continue
+		}
+		pos := ChunkPos{c[1], c[2]}
+		d, ok := worldData.Dimensions[fmt.Sprint(dim)]
+		if !ok {
+			d.BoundsMin, d.BoundsMax = pos, pos
+		}
+		d.BoundsMin = ChunkPos{minInt32(d.BoundsMin.X(), pos.X()), minInt32(d.BoundsMin.Z(), pos.Z())}
+		d.BoundsMax = ChunkPos{maxInt32(d.BoundsMax.X(), pos.X()), maxInt32(d.BoundsMax.Z(), pos.Z())}
+		d.Chunks++
+		worldData.Dimensions[fmt.Sprint(dim)] = d
 	}
 
 	return worldData
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/df-mc/dragonfly/server/block/cube"
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/df-mc/dragonfly/server/world/mcdb"
+	"golang.org/x/sync/semaphore"
+)
+
+// testWorld describes a world written by writeTestWorlds. Every chunk of the
+// world holds a layer of block at y=0, so that its chunks can be told apart
+// from those of other worlds in the output.
+type testWorld struct {
+	// name is the path of the world relative to the input folder, without
+	// the .mcworld extension.
+	name  string
+	block string
+	// min is the first chunk of the world, it covers size by size chunks.
+	min  ChunkPos
+	size int32
+}
+
+// testWorlds are nested in groups at different depths and are far apart at
+// their original coordinates, so that they don't overlap in any mode.
+var testWorlds = []testWorld{
+	{"g1/a", "minecraft:iron_block", ChunkPos{0, 0}, 3},
+	{"g1/b", "minecraft:emerald_block", ChunkPos{-10, 5}, 4},
+	{"g1/sub/c", "minecraft:glass", ChunkPos{100, 100}, 2},
+	{"g2/d", "minecraft:gold_block", ChunkPos{-40, -40}, 5},
+}
+
+// writeTestWorlds writes every world as a .mcworld file into a new input
+// folder, which is returned.
+func writeTestWorlds(t *testing.T, worlds []testWorld) string {
+	t.Helper()
+	in := t.TempDir()
+	for _, w := range worlds {
+		dir := filepath.Join(t.TempDir(), "world")
+		db, err := mcdb.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rid, ok := chunk.StateToRuntimeID(w.block, nil)
+		if !ok {
+			t.Fatalf("unknown block %s", w.block)
+		}
+		for x := w.min.X(); x < w.min.X()+w.size; x++ {
+			for z := w.min.Z(); z < w.min.Z()+w.size; z++ {
+				c := chunk.New(world.AirRID(), cube.Range{-64, 319}, false)
+				for bx := uint8(0); bx < 16; bx++ {
+					for bz := uint8(0); bz < 16; bz++ {
+						c.SetBlock(bx, 0, bz, 0, rid)
+					}
+				}
+				if err := db.SaveChunk(world.ChunkPos{x, z}, c, world.Overworld); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		db.SaveSettings(&world.Settings{Name: path.Base(w.name)})
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(in, filepath.FromSlash(w.name)+".mcworld")
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ZipFolder(filename, dir, flate.DefaultCompression, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return in
+}
+
+// rewriteTestWorld extracts the world w of the input folder in, lets f change
+// the files of the world in dir and writes the world back.
+func rewriteTestWorld(t *testing.T, in string, w testWorld, f func(dir string)) {
+	t.Helper()
+	cacheDir = t.TempDir()
+	filename := filepath.Join(in, filepath.FromSlash(w.name)+".mcworld")
+	dir, err := extractWorld(filepath.ToSlash(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f(dir)
+	if err := ZipFolder(filename, dir, flate.DefaultCompression, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadTestWorlds adds all worlds of the input folder in and lays them out in
+// mode, the same way main does. It returns the root group and the conflicts
+// found in modeOriginal.
+func loadTestWorlds(t *testing.T, in string, mode mergeMode, policy conflictPolicy) (*mapGroup, []*chunkConflict) {
+	t.Helper()
+	cacheDir = t.TempDir()
+	worldPaths, err := glob(in, ".mcworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := map[string]*mapGroup{}
+	for _, p := range worldPaths {
+		rel, err := filepath.Rel(in, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(strings.TrimSuffix(filepath.ToSlash(rel), ".mcworld"), "/")
+		if err := recursiveAddWorld(filepath.ToSlash(p), parts, groups, sourceMemory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := &mapGroup{groups: groups}
+	var conflicts []*chunkConflict
+	if mode == modeOriginal {
+		layoutOriginal(root)
+		conflicts = findConflicts(allWorlds(root), policy)
+	} else {
+		order, err := loadLayoutOrder(sortName, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		layoutGroup(root, "", padding, order)
+		root.offsetFromParent = ChunkPos{}.Sub(root.BoundsTotal().Div(2))
+	}
+	if problems := validateLayout(root, mode == modeOriginal); len(problems) > 0 {
+		t.Fatalf("layout has %d problems, first: %s", len(problems), problems[0].msg)
+	}
+	return root, conflicts
+}
+
+// mergeTestWorlds merges the worlds of root into a new output database,
+// which is returned open.
+func mergeTestWorlds(t *testing.T, root *mapGroup, conflicts []*chunkConflict, policy conflictPolicy, tr *transform) *mcdb.DB {
+	t.Helper()
+	return mergeTestWorldsProgress(t, root, conflicts, policy, tr, newProgress(progressNone))
+}
+
+// mergeTestWorldsProgress is mergeTestWorlds reporting the merge to prog.
+func mergeTestWorldsProgress(t *testing.T, root *mapGroup, conflicts []*chunkConflict, policy conflictPolicy, tr *transform, prog *progress) *mcdb.DB {
+	t.Helper()
+	errs := newErrorCollector(policyFailFast)
+	db := mergeTestWorldsErrors(t, root, conflicts, policy, tr, prog, errs)
+	if err := errs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mergeTestWorldsErrors merges the worlds of root like mergeTestWorlds, but
+// leaves errors of the worlds to errs, so that they can be checked by the
+// caller.
+func mergeTestWorldsErrors(t *testing.T, root *mapGroup, conflicts []*chunkConflict, policy conflictPolicy, tr *transform, prog *progress, errs *errorCollector) *mcdb.DB {
+	t.Helper()
+	db, err := mcdb.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	registerProgress(prog, root)
+	assignUniqueIDs(allWorlds(root))
+	m := &merger{
+		out:  newChunkWriter(db.LDB(), 4<<20, 256<<20, prog, errs),
+		sem:  semaphore.NewWeighted(4),
+		prog: prog,
+		errs: errs,
+		t:    tr,
+	}
+	err = m.addGroup(ChunkPos{}, root)
+	m.wg.Wait()
+	if err == nil {
+		var merged []*chunkConflict
+		for _, c := range conflicts {
+			if c.Winner == "" {
+				merged = append(merged, c)
+			}
+		}
+		if len(merged) > 0 {
+			m.addConflicts(merged, policy)
+		}
+	}
+	m.out.Close()
+	if err != nil && errs.Context().Err() == nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// outputBlocks returns the block at 0,0,0 of every chunk of the overworld of
+// db by its position.
+func outputBlocks(t *testing.T, db *mcdb.DB) map[ChunkPos]string {
+	t.Helper()
+	blocks := make(map[ChunkPos]string)
+	it := newChunkIterator(db, nil)
+	defer it.Release()
+	for it.Next() {
+		c := it.Chunk()
+		if c == nil {
+			break
+		}
+		name, _, _ := chunk.RuntimeIDToState(c.Block(0, 0, 0, 0))
+		blocks[ChunkPos(it.Position())] = name
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+// mapWorlds returns every world of the group and its children in map.json by
+// its path.
+func mapWorlds(g groupJson, prefix string, out map[string]worldJson) map[string]worldJson {
+	if out == nil {
+		out = make(map[string]worldJson)
+	}
+	for name, child := range g.Groups {
+		mapWorlds(child, path.Join(prefix, name), out)
+	}
+	for name, w := range g.Worlds {
+		out[path.Join(prefix, name)] = w
+	}
+	return out
+}
+
+func TestChunkOffset(t *testing.T) {
+	w := &worldMap{boundsMin: ChunkPos{5, -3}, boundsMax: ChunkPos{9, 2}, offsetFromParent: ChunkPos{10, 20}}
+	base := ChunkPos{-100, 200}
+	off := w.chunkOffset(base)
+	if got, want := w.boundsMin.Add(off), base.Add(w.offsetFromParent); got != want {
+		t.Errorf("boundsMin is moved to %v, want %v", got, want)
+	}
+	if got, want := w.boundsMax.Add(off), base.Add(w.offsetFromParent).Add(ChunkPos{4, 5}); got != want {
+		t.Errorf("boundsMax is moved to %v, want %v", got, want)
+	}
+}
+
+// TestMergeOffsets checks that every chunk of every world ends up at the
+// OffsetAbsolute of the world in map.json, and that nothing else is written.
+func TestMergeOffsets(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds)
+	for _, mode := range []mergeMode{modeGrid, modeOriginal} {
+		t.Run(string(mode), func(t *testing.T) {
+			root, conflicts := loadTestWorlds(t, in, mode, conflictFirst)
+			mapData, err := writeGroupToJSON(root, mode, nil, filepath.Join(t.TempDir(), "map.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db := mergeTestWorlds(t, root, conflicts, conflictFirst, nil)
+			blocks := outputBlocks(t, db)
+
+			worlds := mapWorlds(mapData.Groups["root"], "", nil)
+			want := 0
+			for _, tw := range testWorlds {
+				w, ok := worlds[tw.name]
+				if !ok {
+					t.Fatalf("%s is missing from map.json", tw.name)
+				}
+				if mode == modeOriginal && w.OffsetAbsolute != tw.min {
+					t.Errorf("%s: OffsetAbsolute is %v, want its original position %v", tw.name, w.OffsetAbsolute, tw.min)
+				}
+				for x := int32(0); x < tw.size; x++ {
+					for z := int32(0); z < tw.size; z++ {
+						pos := w.OffsetAbsolute.Add(ChunkPos{x, z})
+						if got := blocks[pos]; got != tw.block {
+							t.Errorf("%s: chunk %v holds %q, want %q", tw.name, pos, got, tw.block)
+						}
+						want++
+					}
+				}
+			}
+			if len(blocks) != want {
+				t.Errorf("output has %d chunks, want %d", len(blocks), want)
+			}
+		})
+	}
+}
+
+// TestMapSchema checks that map.json, with and without a transform, matches
+// map.schema.json.
+func TestMapSchema(t *testing.T) {
+	data, err := os.ReadFile("map.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(rules, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTransformJson(rules, "", "", unknownPlaceholder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := writeTestWorlds(t, testWorlds)
+	for _, mode := range []mergeMode{modeGrid, modeOriginal} {
+		for _, transform := range []*transformJson{nil, tr} {
+			root, _ := loadTestWorlds(t, in, mode, conflictFirst)
+			filename := filepath.Join(t.TempDir(), "map.json")
+			if _, err := writeGroupToJSON(root, mode, transform, filename); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v any
+			if err := json.Unmarshal(data, &v); err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range checkSchema(schema, schema, v, "map.json") {
+				t.Errorf("%s, transform %v: %s", mode, transform != nil, problem)
+			}
+			// A world without its source hash must not pass.
+			for _, w := range v.(map[string]any)["Groups"].(map[string]any)["root"].(map[string]any)["Groups"].(map[string]any)["g1"].(map[string]any)["Worlds"].(map[string]any) {
+				delete(w.(map[string]any), "SourceHash")
+			}
+			if problems := checkSchema(schema, schema, v, "map.json"); len(problems) != 2 {
+				t.Errorf("%s: problems %q, want two for the missing source hashes", mode, problems)
+			}
+		}
+	}
+}
+
+// checkSchema returns the problems of v against the JSON schema s, a part of
+// root. Only the keywords used by map.schema.json are checked.
+func checkSchema(root, s map[string]any, v any, at string) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		def := root
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			def = def[part].(map[string]any)
+		}
+		return checkSchema(root, def, v, at)
+	}
+	var problems []string
+	fail := func(format string, a ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, a...))
+	}
+	if c, ok := s["const"]; ok && v != c {
+		fail("%v is not %v", v, c)
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			fail("%v is not one of %v", v, enum)
+		}
+	}
+	if p, ok := s["pattern"].(string); ok {
+		if str, _ := v.(string); !regexp.MustCompile(p).MatchString(str) {
+			fail("%q doesn't match %s", str, p)
+		}
+	}
+	if s["format"] == "date-time" {
+		if str, _ := v.(string); !validDateTime(str) {
+			fail("%q is not a date-time", str)
+		}
+	}
+	if min, ok := s["minimum"].(float64); ok {
+		if n, _ := v.(float64); n < min {
+			fail("%v is below %v", v, min)
+		}
+	}
+	switch s["type"] {
+	case "string":
+		if _, ok := v.(string); !ok {
+			fail("%v is not a string", v)
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			fail("%v is not an integer", v)
+		}
+	case "array":
+		a, ok := v.([]any)
+		if !ok {
+			fail("%v is not an array", v)
+			break
+		}
+		if n, ok := s["minItems"].(float64); ok && len(a) < int(n) {
+			fail("%d items, want at least %v", len(a), n)
+		}
+		if n, ok := s["maxItems"].(float64); ok && len(a) > int(n) {
+			fail("%d items, want at most %v", len(a), n)
+		}
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range a {
+				problems = append(problems, checkSchema(root, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case "object":
+		o, ok := v.(map[string]any)
+		if !ok {
+			fail("%v is not an object", v)
+			break
+		}
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			if _, ok := o[name.(string)]; !ok {
+				fail("%s is missing", name)
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		for name, value := range o {
+			if names, ok := s["propertyNames"].(map[string]any); ok {
+				problems = append(problems, checkSchema(root, names, name, at+" name "+name)...)
+			}
+			if p, ok := props[name].(map[string]any); ok {
+				problems = append(problems, checkSchema(root, p, value, at+"."+name)...)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					fail("%s is not allowed", name)
+				}
+			case map[string]any:
+				problems = append(problems, checkSchema(root, extra, value, at+"."+name)...)
+			}
+		}
+	}
+	return problems
+}
+
+func validDateTime(s string) bool {
+	_, err := time.Parse(time.RFC3339, s)
+	return err == nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb/util"
+)
+
+// manifestName is the name of the file a worldManifest is cached in, inside the
+// cache entry of the .mcworld file next to the folder the world is extracted
+// to.
+const manifestName = "worldmerge.json"
+
+// manifestVersion is increased whenever the manifest changes, so that cached
+// manifests of older versions are scanned again.
+const manifestVersion = 4
+
+// worldManifest holds the result of scanning the chunks of a world, so that a
+// world only has to be scanned again if its source changed.
+type worldManifest struct {
+	Version int
+	// Source, SourceSize and SourceModTime identify the file the world was
+	// extracted from.
+	Source        string
+	SourceSize    int64
+	SourceModTime time.Time
+	// SourceHash is the hex encoded SHA-256 hash of the source file.
+	SourceHash string
+	// LastPlayed is the LastPlayed field of the level.dat of the world, as it
+	// was before the world was first opened by the merger.
+	LastPlayed int64
+	// Spawn is the world spawn point stored in the level.dat of the world.
+	Spawn [3]int32
+
+	BoundsMin, BoundsMax ChunkPos
+	// Chunks is the index of all chunks in the world, every entry holds the
+	// dimension ID followed by the X and Z coordinate.
+	Chunks [][3]int32
+	// Actors holds the unique IDs of the entities listed in the actor digests
+	// of the world, in ascending order.
+	Actors []int64
+}
+
+// loadManifest reads the manifest cached in dir. It returns nil if there is no
+// manifest or if it doesn't belong to source.
+func loadManifest(dir string, source os.FileInfo) (*worldManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := &worldManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", manifestName, err)
+	}
+	if m.Version != manifestVersion || m.SourceSize != source.Size() || !m.SourceModTime.Equal(source.ModTime()) {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// scanWorld iterates over all chunks of the world of the .mcworld file
+// sourcePath once, building a manifest for it. The world is read as by
+// openWorld from the cache entry of the file.
+func scanWorld(sourcePath, entry string, memory bool, source os.FileInfo, sourceHash string) (*worldManifest, error) {
+	dir := path.Join(entry, extractedName)
+	ldat, err := loadLevelDat(sourcePath, dir, memory)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openWorld(sourcePath, dir, memory)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	m := &worldManifest{
+		Version:       manifestVersion,
+		LastPlayed:    ldat.LastPlayed,
+		Spawn:         [3]int32{ldat.SpawnX, ldat.SpawnY, ldat.SpawnZ},
+		Source:        source.Name(),
+		SourceSize:    source.Size(),
+		SourceModTime: source.ModTime(),
+		SourceHash:    sourceHash,
+	}
+	it := newChunkIterator(db, nil)
+	defer it.Release()
+	for it.Next() {
+		pos, dim := ChunkPos(it.Position()), it.Dimension()
+		id, _ := world.DimensionID(dim)
+		if len(m.Chunks) == 0 {
+			m.BoundsMin, m.BoundsMax = pos, pos
+		}
+		m.Chunks = append(m.Chunks, [3]int32{int32(id), pos.X(), pos.Z()})
+		if m.BoundsMin[0] > pos.X() {
+			m.BoundsMin[0] = pos.X()
+		}
+		if m.BoundsMin[1] > pos.Z() {
+			m.BoundsMin[1] = pos.Z()
+		}
+		if m.BoundsMax[0] < pos.X() {
+			m.BoundsMax[0] = pos.X()
+		}
+		if m.BoundsMax[1] < pos.Z() {
+			m.BoundsMax[1] = pos.Z()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	actors := db.LDB().NewIterator(util.BytesPrefix([]byte(keyActorDigest)), nil)
+	defer actors.Release()
+	for actors.Next() {
+		digp := actors.Value()
+		for i := 0; i+8 <= len(digp); i += 8 {
+			m.Actors = append(m.Actors, int64(binary.LittleEndian.Uint64(digp[i:])))
+		}
+	}
+	if err := actors.Error(); err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Actors, func(i, j int) bool { return m.Actors[i] < m.Actors[j] })
+	return m, nil
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// save writes the manifest into dir.
+func (m *worldManifest) save(dir string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestName), data, 0o644)
+}
+
+// index returns the set of all chunks in the manifest.
+func (m *worldManifest) index() map[iterKey]struct{} {
+	index := make(map[iterKey]struct{}, len(m.Chunks))
+	for _, c := range m.Chunks {
+		dim, ok := world.DimensionByID(int(c[0]))
+		if !ok {
+			continue
+		}
+		index[iterKey{pos: world.ChunkPos{c[1], c[2]}, dim: dim}] = struct{}{}
+	}
+	return index
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// packKind is the kind of add-on pack a world can hold.
+type packKind struct {
+	// folder is the folder of the world the packs are stored in, and list the
+	// file listing the packs the world uses.
+	folder string
+	list   string
+}
+
+var (
+	behaviorPacks = packKind{folder: "behavior_packs", list: "world_behavior_packs.json"}
+	resourcePacks = packKind{folder: "resource_packs", list: "world_resource_packs.json"}
+)
+
+// packVersion is the version of a pack, such as [1, 0, 0].
+type packVersion [3]int
+
+func (v packVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v packVersion) less(o packVersion) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON reads a version written either as an array of three numbers
+// or as a string like "1.0.0".
+func (v *packVersion) UnmarshalJSON(data []byte) error {
+	var list []int
+	if err := json.Unmarshal(data, &list); err == nil {
+		copy(v[:], list)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid pack version %s", data)
+	}
+	// Anything after a dash, such as a pre-release, isn't part of the order.
+	s, _, _ = strings.Cut(s, "-")
+	for i, part := range strings.SplitN(s, ".", 3) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("invalid pack version %q", s)
+		}
+		v[i] = n
+	}
+	return nil
+}
+
+func (v packVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v[:])
+}
+
+// packRef is an entry of world_behavior_packs.json or
+// world_resource_packs.json.
+type packRef struct {
+	PackID  string      `json:"pack_id"`
+	Version packVersion `json:"version"`
+}
+
+// packManifest holds the fields of the manifest.json of a pack used to tell
+// packs apart.
+type packManifest struct {
+	Header struct {
+		Name    string      `json:"name"`
+		UUID    string      `json:"uuid"`
+		Version packVersion `json:"version"`
+	} `json:"header"`
+}
+
+// pack is a version of a pack found in the worlds being merged.
+type pack struct {
+	kind    packKind
+	name    string
+	uuid    string
+	version packVersion
+	// archive is the .mcworld file the pack is copied from, and dir the folder
+	// of the pack in it. archive is empty if no world included the pack.
+	archive string
+	dir     string
+	// worlds are the worlds that use this version of the pack.
+	worlds []string
+}
+
+// packSet holds the packs used by the merged world, one version of every pack
+// per kind.
+type packSet map[packKind][]*pack
+
+// collectPacks finds the behavior and resource packs used by worlds. Every
+// pack is used once, identified by its UUID and version. If worlds use
+// different versions of a pack, a warning is logged and only the highest
+// version is used.
+func collectPacks(worlds []*worldMap) (packSet, error) {
+	set := make(packSet)
+	for _, kind := range []packKind{behaviorPacks, resourcePacks} {
+		packs := make(map[string]map[packVersion]*pack)
+		var order []string
+		for _, w := range worlds {
+			found, err := worldPacks(w.source, kind)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range found {
+				versions, ok := packs[p.uuid]
+				if !ok {
+					versions = make(map[packVersion]*pack)
+					packs[p.uuid] = versions
+					order = append(order, p.uuid)
+				}
+				if existing, ok := versions[p.version]; ok {
+					existing.worlds = append(existing.worlds, w.source)
+					if existing.archive == "" {
+						existing.archive, existing.dir, existing.name = p.archive, p.dir, p.name
+					}
+					continue
+				}
+				p.worlds = []string{w.source}
+				versions[p.version] = p
+			}
+		}
+		for _, uuid := range order {
+			p := choosePack(packs[uuid])
+			if p.archive == "" {
+				logrus.Warnf("%s %s %s is used by %s but not included in any world", kind.folder, p.uuid, p.version, strings.Join(p.worlds, ", "))
+			}
+			set[kind] = append(set[kind], p)
+		}
+	}
+	return set, nil
+}
+
+// write copies the packs of the set into the output world in dir, and writes
+// the lists of packs the output world uses.
+func (set packSet) write(dir string) error {
+	for _, kind := range []packKind{behaviorPacks, resourcePacks} {
+		packs := set[kind]
+		if len(packs) == 0 {
+			continue
+		}
+		refs := make([]packRef, 0, len(packs))
+		folders := make(map[string]bool)
+		for _, p := range packs {
+			refs = append(refs, packRef{PackID: p.uuid, Version: p.version})
+			if p.archive == "" {
+				continue
+			}
+			folder := p.dir[len(kind.folder)+1:]
+			for i := 2; folders[folder]; i++ {
+				folder = fmt.Sprintf("%s_%d", p.dir[len(kind.folder)+1:], i)
+			}
+			folders[folder] = true
+			if err := copyPack(p, filepath.Join(dir, kind.folder, folder)); err != nil {
+				return fmt.Errorf("%s: copy %s: %w", p.archive, p.dir, err)
+			}
+		}
+		data, err := json.MarshalIndent(refs, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, kind.list), data, 0o644); err != nil {
+			return err
+		}
+		logrus.Infof("Added %d %s", len(refs), strings.ReplaceAll(kind.folder, "_", " "))
+	}
+	return nil
+}
+
+// choosePack returns the highest of the versions of a pack, warning about the
+// conflict if there is more than one.
+func choosePack(versions map[packVersion]*pack) *pack {
+	list := make([]*pack, 0, len(versions))
+	for _, p := range versions {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[j].version.less(list[i].version)
+	})
+	if len(list) > 1 {
+		var uses []string
+		for _, p := range list {
+			uses = append(uses, fmt.Sprintf("%s by %s", p.version, strings.Join(p.worlds, ", ")))
+		}
+		logrus.Warnf("%s %q (%s) is used in different versions, using %s: %s", list[0].kind.folder, list[0].name, list[0].uuid, list[0].version, strings.Join(uses, "; "))
+	}
+	return list[0]
+}
+
+// worldPacks returns the packs of kind that the world in the .mcworld file
+// filename uses, as listed by its world_*_packs.json. Packs included in the
+// world that it doesn't use are left out.
+func worldPacks(filename string, kind packKind) ([]*pack, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, &zipError{Archive: filename, Err: err}
+	}
+	defer zr.Close()
+
+	var refs []packRef
+	if data, err := readZipFile(&zr.Reader, kind.list); err != nil {
+		return nil, &zipError{Archive: filename, Entry: kind.list, Err: err}
+	} else if data != nil {
+		if err := json.Unmarshal(stripJSONComments(data), &refs); err != nil {
+			return nil, &zipError{Archive: filename, Entry: kind.list, Err: err}
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	// Find the folders of the packs included in the world. A pack is also
+	// found by its UUID alone, in case the world lists an outdated version.
+	included := make(map[packRef]*pack)
+	byUUID := make(map[string]*pack)
+	for _, f := range zr.File {
+		name, err := entryPath(f.Name)
+		if err != nil {
+			return nil, &zipError{Archive: filename, Entry: f.Name, Err: err}
+		}
+		parts := strings.Split(name, "/")
+		if len(parts) != 3 || parts[0] != kind.folder || parts[2] != "manifest.json" {
+			continue
+		}
+		data, err := readZipFile(&zr.Reader, name)
+		if err != nil {
+			return nil, &zipError{Archive: filename, Entry: f.Name, Err: err}
+		}
+		var m packManifest
+		if err := json.Unmarshal(stripJSONComments(data), &m); err != nil {
+			logrus.Warnf("%s: %s: %v", filename, f.Name, err)
+			continue
+		}
+		ref := packRef{PackID: strings.ToLower(m.Header.UUID), Version: m.Header.Version}
+		p := &pack{kind: kind, name: m.Header.Name, uuid: ref.PackID, version: ref.Version, archive: filename, dir: path.Dir(name)}
+		included[ref], byUUID[ref.PackID] = p, p
+	}
+
+	packs := make([]*pack, 0, len(refs))
+	for _, ref := range refs {
+		ref.PackID = strings.ToLower(ref.PackID)
+		if p, ok := included[ref]; ok {
+			packs = append(packs, p)
+			continue
+		}
+		if p, ok := byUUID[ref.PackID]; ok {
+			logrus.Warnf("%s: %s lists %s %s, but the world includes %s", filename, kind.list, ref.PackID, ref.Version, p.version)
+			packs = append(packs, p)
+			continue
+		}
+		packs = append(packs, &pack{kind: kind, uuid: ref.PackID, version: ref.Version})
+	}
+	return packs, nil
+}
+
+// readZipFile reads the file name of zr, returning nil if it doesn't exist.
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if p, err := entryPath(f.Name); err != nil || p != name || !f.Mode().IsRegular() {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := copyEntry(&buf, f, defaultZipLimits, 16<<20); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, nil
+}
+
+// copyPack extracts the folder of p from its archive into dst.
+func copyPack(p *pack, dst string) error {
+	zr, err := zip.OpenReader(p.archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	var total int64
+	for _, f := range zr.File {
+		name, err := entryPath(f.Name)
+		if err != nil {
+			return err
+		}
+		rel, ok := strings.CutPrefix(name, p.dir+"/")
+		if !ok || !f.Mode().IsRegular() {
+			continue
+		}
+		n, err := extractFile(f, filepath.Join(dst, filepath.FromSlash(rel)), defaultZipLimits, defaultZipLimits.MaxTotalSize-total)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		total += n
+	}
+	return nil
+}
+
+// stripJSONComments removes the // and /* */ comments that Minecraft allows in
+// its JSON files.
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out = append(out, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			out = append(out, '\n')
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
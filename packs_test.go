@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addTestPacks adds behavior packs to the world w of the input folder in and
+// lists the refs in its world_behavior_packs.json. packs holds the version of
+// every pack by its folder, named after the UUID of the pack followed by an @.
+func addTestPacks(t *testing.T, in string, w testWorld, packs map[string]string, refs string) {
+	t.Helper()
+	rewriteTestWorld(t, in, w, func(dir string) {
+		for folder, version := range packs {
+			uuid, _, _ := strings.Cut(folder, "@")
+			manifest := fmt.Sprintf(`{
+	// Comments are allowed by the game.
+	"header": {"name": "Pack %s", "uuid": %q, "version": %s}
+}`, uuid, uuid, version)
+			p := filepath.Join(dir, "behavior_packs", folder, "manifest.json")
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, behaviorPacks.list), []byte(refs), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestCollectPacks checks that a pack used by several worlds is added once,
+// in its highest version, and that packs not included in any world are still
+// listed.
+func TestCollectPacks(t *testing.T) {
+	const (
+		shared  = "8c3f0a6e-5d0a-4b8f-9a47-3f3c1b7a2d11"
+		missing = "1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b"
+	)
+	in := writeTestWorlds(t, testWorlds[:3])
+	addTestPacks(t, in, testWorlds[0], map[string]string{shared + "@1": "[1, 0, 0]"},
+		fmt.Sprintf(`[{"pack_id": %q, "version": [1, 0, 0]}]`, shared))
+	addTestPacks(t, in, testWorlds[1], map[string]string{shared + "@2": `"1.2.0"`},
+		fmt.Sprintf(`[{"pack_id": %q, "version": "1.2.0"}, {"pack_id": %q, "version": [2, 0, 0]}]`, shared, missing))
+	// The same version as the first world, listed with an upper case UUID.
+	addTestPacks(t, in, testWorlds[2], map[string]string{shared + "@1": "[1, 0, 0]"},
+		`[{"pack_id": "8C3F0A6E-5D0A-4B8F-9A47-3F3C1B7A2D11", "version": [1, 0, 0]}]`)
+	root, _ := loadTestWorlds(t, in, modeGrid, conflictFirst)
+
+	set, err := collectPacks(allWorlds(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set[resourcePacks]) != 0 {
+		t.Errorf("resource packs %v, want none", set[resourcePacks])
+	}
+	packs := make(map[string]*pack)
+	for _, p := range set[behaviorPacks] {
+		if _, ok := packs[p.uuid]; ok {
+			t.Errorf("pack %s is used more than once", p.uuid)
+		}
+		packs[p.uuid] = p
+	}
+	if p := packs[shared]; p == nil || p.version != (packVersion{1, 2, 0}) || p.archive == "" || p.dir != "behavior_packs/"+shared+"@2" {
+		t.Errorf("shared pack %+v, want version 1.2.0 included in the second world", p)
+	}
+	if p := packs[missing]; p == nil || p.version != (packVersion{2, 0, 0}) || p.archive != "" {
+		t.Errorf("missing pack %+v, want version 2.0.0 without an archive", p)
+	}
+
+	dir := t.TempDir()
+	if err := set.write(dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "behavior_packs")); err != nil || len(entries) != 1 {
+		t.Errorf("copied packs %v, %v, want only version 1.2.0 of the shared pack", entries, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, behaviorPacks.list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []packRef
+	if err := json.Unmarshal(data, &refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("%s lists %+v, want both packs", behaviorPacks.list, refs)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "behavior_packs", shared+"@2", "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m packManifest
+	if err := json.Unmarshal(stripJSONComments(data), &m); err != nil || m.Header.Version != (packVersion{1, 2, 0}) {
+		t.Errorf("copied manifest %s, %v, want version 1.2.0", data, err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// progressMode selects how a progress tracker reports its state.
+type progressMode string
+
+const (
+	// progressAuto renders a bar when stderr is a terminal and falls back to
+	// log lines otherwise.
+	progressAuto progressMode = "auto"
+	// progressBar always renders a single line progress bar on stderr.
+	progressBar progressMode = "bar"
+	// progressLog writes a log line for every report.
+	progressLog progressMode = "log"
+	// progressJSON writes one JSON object per line to stdout.
+	progressJSON progressMode = "json"
+	// progressNone disables progress reporting.
+	progressNone progressMode = "none"
+)
+
+func parseProgressMode(s string) (progressMode, error) {
+	switch m := progressMode(s); m {
+	case progressAuto, progressBar, progressLog, progressJSON, progressNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown progress mode %q", s)
+}
+
+// worldProgress is the progress of copying a single world. Worlds are keyed by
+// their file path, as names are only unique within a group.
+type worldProgress struct {
+	Name        string `json:"name"`
+	ChunksDone  int64  `json:"chunks_done"`
+	ChunksTotal int64  `json:"chunks_total"`
+	Bytes       int64  `json:"bytes"`
+	Done        bool   `json:"done"`
+
+	started time.Time
+}
+
+// progressEvent is a single line written in progressJSON mode.
+type progressEvent struct {
+	Event       string         `json:"event"`
+	Time        time.Time      `json:"time"`
+	World       *worldProgress `json:"world,omitempty"`
+	WorldsDone  int            `json:"worlds_done"`
+	WorldsTotal int            `json:"worlds_total"`
+	ChunksDone  int64          `json:"chunks_done"`
+	ChunksTotal int64          `json:"chunks_total"`
+	Bytes       int64          `json:"bytes"`
+	// ChunksPerSecond and BytesPerSecond are averaged over the whole merge.
+	ChunksPerSecond float64 `json:"chunks_per_second"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+	// ETASeconds is the estimated time until all chunks are written, or -1 if
+	// it can't be estimated yet.
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+// progress tracks chunks and bytes written per world and in total. It is safe
+// for concurrent use by the goroutines copying worlds.
+type progress struct {
+	mode progressMode
+	out  io.Writer
+
+	mu          sync.Mutex
+	start       time.Time
+	worlds      map[string]*worldProgress
+	worldsDone  int
+	chunksDone  int64
+	chunksTotal int64
+	bytes       int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgress(mode progressMode) *progress {
+	p := &progress{
+		mode:   mode,
+		out:    os.Stderr,
+		worlds: make(map[string]*worldProgress),
+	}
+	if mode == progressAuto {
+		p.mode = progressLog
+		if isTerminal(os.Stderr) {
+			p.mode = progressBar
+		}
+	}
+	if p.mode == progressJSON {
+		p.out = os.Stdout
+	}
+	return p
+}
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// addWorld registers a world with the number of chunks it is expected to copy.
+func (p *progress) addWorld(name string, chunks int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.worlds[name] = &worldProgress{Name: name, ChunksTotal: chunks}
+	p.chunksTotal += chunks
+}
+
+// startWorld marks the world as started.
+func (p *progress) startWorld(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.world(name).started = time.Now()
+}
+
+// addChunks records chunks of the world that were written with n bytes.
+func (p *progress) addChunks(name string, chunks, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.world(name)
+	w.ChunksDone += int64(chunks)
+	w.Bytes += int64(n)
+	p.chunksDone += int64(chunks)
+	p.bytes += int64(n)
+}
+
+// worldDone marks the world as finished.
+func (p *progress) worldDone(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.world(name)
+	if w.Done {
+		return
+	}
+	w.Done = true
+	p.worldsDone++
+	if p.mode == progressJSON {
+		p.emit("world_done", w)
+	} else if p.mode == progressLog {
+		logrus.Infof("Added %s (%d chunks, %s) %d/%d", w.Name, w.ChunksDone, formatBytes(w.Bytes), p.worldsDone, len(p.worlds))
+	}
+}
+
+// world returns the progress of a world, adding it if it wasn't registered.
+// p.mu must be held.
+func (p *progress) world(name string) *worldProgress {
+	w, ok := p.worlds[name]
+	if !ok {
+		w = &worldProgress{Name: name}
+		p.worlds[name] = w
+	}
+	return w
+}
+
+// Start starts reporting progress every interval until Stop is called.
+func (p *progress) Start(interval time.Duration) {
+	p.start = time.Now()
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reporting and writes the final state.
+func (p *progress) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.mode {
+	case progressBar:
+		p.renderBar()
+		fmt.Fprintln(p.out)
+	case progressJSON:
+		p.emit("done", nil)
+	}
+}
+
+// ChunksDone returns the number of chunks written so far.
+func (p *progress) ChunksDone() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.chunksDone
+}
+
+func (p *progress) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.mode {
+	case progressBar:
+		p.renderBar()
+	case progressLog:
+		chunksPerSecond, _, eta := p.rates()
+		logrus.Infof("%d/%d chunks, %d/%d worlds, %s, %.0f chunks/s, ETA %s",
+			p.chunksDone, p.chunksTotal, p.worldsDone, len(p.worlds), formatBytes(p.bytes), chunksPerSecond, formatETA(eta))
+	case progressJSON:
+		p.emit("progress", nil)
+	}
+}
+
+// rates returns the throughput since Start and the estimated remaining time,
+// which is negative if it can't be estimated yet. p.mu must be held.
+func (p *progress) rates() (chunksPerSecond, bytesPerSecond float64, eta time.Duration) {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0, 0, -1
+	}
+	chunksPerSecond = float64(p.chunksDone) / elapsed
+	bytesPerSecond = float64(p.bytes) / elapsed
+	if chunksPerSecond == 0 {
+		return chunksPerSecond, bytesPerSecond, -1
+	}
+	remaining := p.chunksTotal - p.chunksDone
+	if remaining < 0 {
+		remaining = 0
+	}
+	return chunksPerSecond, bytesPerSecond, time.Duration(float64(remaining) / chunksPerSecond * float64(time.Second))
+}
+
+// renderBar draws the progress bar over the current terminal line. p.mu must
+// be held.
+func (p *progress) renderBar() {
+	const width = 30
+	var frac float64
+	if p.chunksTotal > 0 {
+		frac = float64(p.chunksDone) / float64(p.chunksTotal)
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	filled := int(frac * width)
+	chunksPerSecond, _, eta := p.rates()
+
+	// Show the names of the worlds currently being copied.
+	var active []string
+	for _, w := range p.worlds {
+		if !w.started.IsZero() && !w.Done {
+			active = append(active, w.Name)
+		}
+	}
+	sort.Strings(active)
+	if len(active) > 3 {
+		active = append(active[:3], fmt.Sprintf("+%d", len(active)-3))
+	}
+
+	fmt.Fprintf(p.out, "\r\033[K[%s%s] %5.1f%% %d/%d chunks %d/%d worlds %s %.0f chunks/s ETA %s %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled), frac*100,
+		p.chunksDone, p.chunksTotal, p.worldsDone, len(p.worlds),
+		formatBytes(p.bytes), chunksPerSecond, formatETA(eta), strings.Join(active, ","))
+}
+
+// emit writes a single JSON line. p.mu must be held.
+func (p *progress) emit(event string, w *worldProgress) {
+	chunksPerSecond, bytesPerSecond, eta := p.rates()
+	ev := progressEvent{
+		Event:           event,
+		Time:            time.Now(),
+		World:           w,
+		WorldsDone:      p.worldsDone,
+		WorldsTotal:     len(p.worlds),
+		ChunksDone:      p.chunksDone,
+		ChunksTotal:     p.chunksTotal,
+		Bytes:           p.bytes,
+		ChunksPerSecond: chunksPerSecond,
+		BytesPerSecond:  bytesPerSecond,
+		ETASeconds:      eta.Seconds(),
+	}
+	if eta < 0 {
+		ev.ETASeconds = -1
+	}
+	if err := json.NewEncoder(p.out).Encode(ev); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func formatETA(d time.Duration) string {
+	if d < 0 {
+		return "--"
+	}
+	return d.Round(time.Second).String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestProgressJSON merges the test worlds with JSON progress and checks that
+// every world reports all of its chunks once and that the totals add up.
+func TestProgressJSON(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds)
+	root, conflicts := loadTestWorlds(t, in, modeGrid, conflictFirst)
+	var buf bytes.Buffer
+	prog := newProgress(progressJSON)
+	prog.out = &buf
+	prog.Start(time.Hour)
+	mergeTestWorldsProgress(t, root, conflicts, conflictFirst, nil, prog)
+	prog.Stop()
+
+	var total int64
+	want := make(map[string]int64)
+	for _, w := range testWorlds {
+		name := filepath.ToSlash(filepath.Join(in, filepath.FromSlash(w.name)+".mcworld"))
+		want[name] = int64(w.size * w.size)
+		total += want[name]
+	}
+
+	var events []progressEvent
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var ev progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != len(testWorlds)+1 {
+		t.Fatalf("%d events, want a world_done per world and done", len(events))
+	}
+	for i, ev := range events[:len(testWorlds)] {
+		if ev.Event != "world_done" || ev.World == nil {
+			t.Fatalf("event %d is %q, want world_done", i, ev.Event)
+		}
+		chunks, ok := want[ev.World.Name]
+		if !ok {
+			t.Errorf("world_done of unknown or repeated world %s", ev.World.Name)
+			continue
+		}
+		delete(want, ev.World.Name)
+		if ev.World.ChunksDone != chunks || ev.World.ChunksTotal != chunks || !ev.World.Done || ev.World.Bytes == 0 {
+			t.Errorf("world %s: %+v, want %d chunks done", ev.World.Name, ev.World, chunks)
+		}
+		if ev.WorldsDone != i+1 || ev.WorldsTotal != len(testWorlds) {
+			t.Errorf("event %d: %d/%d worlds done", i, ev.WorldsDone, ev.WorldsTotal)
+		}
+	}
+	done := events[len(events)-1]
+	if done.Event != "done" || done.ChunksDone != total || done.ChunksTotal != total || done.WorldsDone != len(testWorlds) {
+		t.Errorf("last event %+v, want done with %d chunks", done, total)
+	}
+}
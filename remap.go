@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// blockPattern is a block in a blockRule. A pattern used to match blocks
+// matches every block with its name and all of its states, states not listed
+// may have any value.
+type blockPattern struct {
+	Name   string         `json:"name"`
+	States map[string]any `json:"states,omitempty"`
+}
+
+// blockRule replaces every block matching From with To.
+type blockRule struct {
+	From blockPattern `json:"from"`
+	To   blockPattern `json:"to"`
+}
+
+// blockMapping is a list of blockRules, read from a JSON file such as:
+//
+//	[
+//	  {"from": {"name": "minecraft:command_block"}, "to": {"name": "minecraft:stone"}},
+//	  {"from": {"name": "minecraft:wool", "states": {"color": "red"}}, "to": {"name": "minecraft:red_wool"}}
+//	]
+//
+// Blocks are matched against their states as stored in the world, before the
+// game upgrades them to the current version. The first matching rule is used.
+type blockMapping []blockRule
+
+// loadBlockMapping reads a blockMapping from the file filename. An empty
+// filename returns an empty mapping.
+func loadBlockMapping(filename string) (blockMapping, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var mapping blockMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for i, r := range mapping {
+		if r.From.Name == "" || r.To.Name == "" {
+			return nil, fmt.Errorf("%s: rule %d: from and to need a name", filename, i)
+		}
+		for _, p := range []*blockPattern{&mapping[i].From, &mapping[i].To} {
+			p.Name = blockName(p.Name)
+			for k, v := range p.States {
+				switch v := v.(type) {
+				case string, bool:
+				case float64:
+					if v != float64(int32(v)) {
+						return nil, fmt.Errorf("%s: rule %d: state %s must be a whole number", filename, i, k)
+					}
+				default:
+					return nil, fmt.Errorf("%s: rule %d: state %s must be a string, number or bool", filename, i, k)
+				}
+			}
+		}
+	}
+	return mapping, nil
+}
+
+// replace returns the palette entry m is replaced with, or false if no rule
+// matches it.
+func (mapping blockMapping) replace(m map[string]any) (map[string]any, bool) {
+	name, _ := m["name"].(string)
+	name = blockName(name)
+	states, _ := m["states"].(map[string]any)
+	for _, r := range mapping {
+		if r.From.Name == name && r.From.matchStates(states) {
+			return blockState(r.To.Name, r.To.nbtStates()), true
+		}
+	}
+	return nil, false
+}
+
+// matchStates checks if all states of p have the same value in states.
+func (p blockPattern) matchStates(states map[string]any) bool {
+	for k, want := range p.States {
+		switch v := states[k].(type) {
+		case string:
+			if want != v {
+				return false
+			}
+		case uint8:
+			if b, ok := want.(bool); ok && b != (v != 0) || !ok && want != float64(v) {
+				return false
+			}
+		case int32:
+			if want != float64(v) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// nbtStates returns the states of p with the types block states have in NBT:
+// strings, int32s and bools stored as bytes.
+func (p blockPattern) nbtStates() map[string]any {
+	states := make(map[string]any, len(p.States))
+	for k, v := range p.States {
+		switch v := v.(type) {
+		case bool:
+			if v {
+				states[k] = uint8(1)
+			} else {
+				states[k] = uint8(0)
+			}
+		case float64:
+			states[k] = int32(v)
+		default:
+			states[k] = v
+		}
+	}
+	return states
+}
+
+// blockName adds the minecraft namespace to a block name without one.
+func blockName(name string) string {
+	if !strings.Contains(name, ":") {
+		return "minecraft:" + name
+	}
+	return name
+}
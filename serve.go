@@ -0,0 +1,253 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/opt"
+	"github.com/sirupsen/logrus"
+)
+
+// readOnlyDB reads chunks from the LevelDB of a world without ever writing to
+// it. Unlike a *mcdb.DB, it doesn't rewrite the level.dat when closed.
+type readOnlyDB struct {
+	ldb *leveldb.DB
+}
+
+// openReadOnly opens the LevelDB of the world in dir read-only.
+func openReadOnly(dir string) (*readOnlyDB, error) {
+	ldb, err := leveldb.OpenFile(filepath.Join(dir, "db"), &opt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dir, err)
+	}
+	return &readOnlyDB{ldb: ldb}, nil
+}
+
+func (db *readOnlyDB) LDB() *leveldb.DB {
+	return db.ldb
+}
+
+// LoadChunk loads the chunk at position the same way as mcdb.DB.LoadChunk.
+func (db *readOnlyDB) LoadChunk(position world.ChunkPos, dim world.Dimension) (c *chunk.Chunk, exists bool, err error) {
+	index := key_index(position, dim)
+	if _, err := db.ldb.Get(append(index, keyVersion), nil); errors.Is(err, leveldb.ErrNotFound) {
+		if _, err := db.ldb.Get(append(index, keyVersionOld), nil); err != nil {
+			return nil, false, nil
+		}
+	} else if err != nil {
+		return nil, true, fmt.Errorf("read version: %w", err)
+	}
+
+	data := chunk.SerialisedData{}
+	data.Biomes, err = db.ldb.Get(append(index, key3DData), nil)
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return nil, true, fmt.Errorf("read 3D data: %w", err)
+	}
+	if len(data.Biomes) > 512 {
+		// Strip the height map from the biomes.
+		data.Biomes = data.Biomes[512:]
+	}
+	r := dim.Range()
+	data.SubChunks = make([][]byte, (r.Height()>>4)+1)
+	for i := range data.SubChunks {
+		data.SubChunks[i], err = db.ldb.Get(append(index, keySubChunkData, byte(i+(r[0]>>4))), nil)
+		if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+			return nil, true, fmt.Errorf("read sub chunk %v: %w", i, err)
+		}
+	}
+	c, err = chunk.DiskDecode(data, r)
+	return c, true, err
+}
+
+// LoadBiomes loads the chunk at position with its biomes only. Unlike
+// LoadChunk, it doesn't decode the sub chunks, so it works for chunks with
+// blocks dragonfly doesn't know.
+func (db *readOnlyDB) LoadBiomes(position world.ChunkPos, dim world.Dimension) (*chunk.Chunk, error) {
+	data, err := db.ldb.Get(append(key_index(position, dim), key3DData), nil)
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return nil, fmt.Errorf("read 3D data: %w", err)
+	}
+	if len(data) > 512 {
+		// Strip the height map from the biomes.
+		data = data[512:]
+	}
+	return chunk.DiskDecode(chunk.SerialisedData{Biomes: data}, dim.Range())
+}
+
+// LoadBlockNBT loads the block entities of the chunk at position.
+func (db *readOnlyDB) LoadBlockNBT(position world.ChunkPos, dim world.Dimension) ([]map[string]any, error) {
+	data, err := db.ldb.Get(append(key_index(position, dim), keyBlockEntities), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []map[string]any
+	_, err = rewriteNBT(data, func(m map[string]any) bool {
+		list = append(list, m)
+		return true
+	})
+	return list, err
+}
+
+func (db *readOnlyDB) Close() error {
+	return db.ldb.Close()
+}
+
+//go:embed serve.html
+var serveHTML []byte
+
+// runServe runs the serve subcommand, which serves tiles of a merged world and
+// its layout over HTTP.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	mapFile := fs.String("map", "map.json", "map.json of the merge, drawn over the tiles")
+	cacheDir := fs.String("cache", "tile-cache", "folder tiles are cached in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: WorldMerge.exe serve [flags] <world folder>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openReadOnly(fs.Arg(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := prepareTileCache(*cacheDir, fs.Arg(0)); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Info("Finding Chunks")
+	tiles, err := newTileRenderer(db, *cacheDir)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var layout geoFeatureCollection
+	if data, err := os.ReadFile(*mapFile); err == nil {
+		var m mapJson
+		if err := json.Unmarshal(data, &m); err != nil {
+			logrus.Fatalf("%s: %v", *mapFile, err)
+		}
+		layout = layoutGeoJSON(m)
+	} else {
+		logrus.Warnf("%s: %v, serving without layout", *mapFile, err)
+		layout = geoFeatureCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(serveHTML)
+	})
+	mux.HandleFunc("/layout.geojson", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/geo+json")
+		json.NewEncoder(w).Encode(layout)
+	})
+	mux.HandleFunc("/tiles/", func(w http.ResponseWriter, r *http.Request) {
+		k, err := parseTilePath(strings.TrimPrefix(r.URL.Path, "/tiles/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, complete, err := tiles.tile(k)
+		if err != nil {
+			logrus.Errorf("tile %s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if !complete {
+			// The tile is rendered further by the next request.
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write(data)
+	})
+
+	logrus.Infof("Serving on http://%s", *addr)
+	logrus.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// parseTilePath parses a tile path of the form dimension/scale/x/z.png.
+func parseTilePath(p string) (tileKey, error) {
+	parts := strings.Split(strings.TrimSuffix(p, ".png"), "/")
+	if len(parts) != 4 {
+		return tileKey{}, fmt.Errorf("invalid tile %q", p)
+	}
+	var v [4]int64
+	for i, part := range parts {
+		var err error
+		if v[i], err = strconv.ParseInt(part, 10, 32); err != nil {
+			return tileKey{}, fmt.Errorf("invalid tile %q", p)
+		}
+	}
+	dim, ok := world.DimensionByID(int(v[0]))
+	if !ok || v[1] < 0 || v[1] > maxTileScale {
+		return tileKey{}, fmt.Errorf("invalid tile %q", p)
+	}
+	return tileKey{Dim: dim, Scale: int(v[1]), X: int32(v[2]), Z: int32(v[3])}, nil
+}
+
+// tileCacheStamp is the file in the tile cache that records which state of the
+// world the tiles were rendered from.
+const tileCacheStamp = "world.stamp"
+
+// prepareTileCache empties the tile cache if it was rendered from a different
+// state of the world in dir. The state is identified by the current LevelDB
+// manifest, which changes whenever the database is written to.
+func prepareTileCache(cache, dir string) error {
+	current, err := os.ReadFile(filepath.Join(dir, "db", "CURRENT"))
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(filepath.Join(dir, "db", strings.TrimSpace(string(current))))
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	stamp := fmt.Sprintf("%s\n%s\n%d %d\n", abs, strings.TrimSpace(string(current)), stat.Size(), stat.ModTime().UnixNano())
+
+	old, err := os.ReadFile(filepath.Join(cache, tileCacheStamp))
+	switch {
+	case err == nil && string(old) == stamp:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		// Never remove a folder that isn't a tile cache.
+		if entries, _ := os.ReadDir(cache); len(entries) > 0 {
+			return fmt.Errorf("%s is not empty and not a tile cache", cache)
+		}
+	case err != nil:
+		return err
+	}
+	if err := os.RemoveAll(cache); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cache, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cache, tileCacheStamp), []byte(stamp), 0o644)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/opt"
+	"github.com/df-mc/goleveldb/leveldb/storage"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+	"github.com/sirupsen/logrus"
+)
+
+// sourceMode decides how the worlds in .mcworld files are read.
+type sourceMode string
+
+const (
+	// sourceExtract extracts every world into the cache folder once and reads
+	// it from there.
+	sourceExtract sourceMode = "extract"
+	// sourceMemory reads the LevelDB files of a world from its archive into
+	// memory whenever the world is opened. Only the manifest of the world is
+	// written to the cache folder.
+	sourceMemory sourceMode = "memory"
+)
+
+func parseSourceMode(s string) (sourceMode, error) {
+	switch m := sourceMode(s); m {
+	case sourceExtract, sourceMemory:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown source mode %q", s)
+}
+
+// cacheDir is the folder worlds are extracted to and manifests are cached in.
+// Every .mcworld file gets its own entry in it, named by the hash of its
+// content, so that an entry can be removed at any time and is shared by all
+// copies of the same file.
+var cacheDir = "tmp"
+
+// sourceStamp is the hash of a .mcworld file together with its size and
+// modification time. It is cached in a file of cacheDir named by the path of
+// the .mcworld file, so that the file is only hashed again once it changed.
+type sourceStamp struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+// cacheEntry returns the folder in cacheDir for the .mcworld file at filename
+// and the hex encoded SHA-256 hash of the file. The folder is created if it
+// doesn't exist, and its modification time is set to mark it as used.
+func cacheEntry(filename string) (dir, hash string, err error) {
+	hash, err = sourceHash(filename)
+	if err != nil {
+		return "", "", err
+	}
+	dir = path.Join(cacheDir, hash[:32])
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	return dir, hash, os.Chtimes(dir, now, now)
+}
+
+// sourceHash returns the hex encoded SHA-256 hash of the file at filename. The
+// hash is taken from its sourceStamp if the size and modification time of the
+// file didn't change since it was last hashed.
+func sourceHash(filename string) (string, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	stampPath := path.Join(cacheDir, "source-"+hex.EncodeToString(sum[:16])+".json")
+
+	var stamp sourceStamp
+	if data, err := os.ReadFile(stampPath); err == nil && json.Unmarshal(data, &stamp) == nil &&
+		stamp.Hash != "" && stamp.Size == stat.Size() && stamp.ModTime.Equal(stat.ModTime()) {
+		now := time.Now()
+		return stamp.Hash, os.Chtimes(stampPath, now, now)
+	}
+
+	stamp = sourceStamp{Size: stat.Size(), ModTime: stat.ModTime()}
+	if stamp.Hash, err = hashFile(filename); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(stamp)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", err
+	}
+	return stamp.Hash, os.WriteFile(stampPath, data, 0o644)
+}
+
+// runCleanCache runs the clean-cache subcommand, which removes entries of the
+// cache folder.
+func runCleanCache(args []string) {
+	fs := flag.NewFlagSet("clean-cache", flag.ExitOnError)
+	fs.StringVar(&cacheDir, "cache", cacheDir, "cache folder to clean")
+	maxAge := fs.Duration("max-age", 0, "only remove entries that weren't used for this long, such as 168h")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	entries, size, err := cleanCache(*maxAge)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Removed %d cache entries, %s", entries, formatBytes(size))
+}
+
+// cleanCache removes all entries of cacheDir that weren't used for maxAge. It
+// returns the number of entries and
+// bytes removed.
+func cleanCache(maxAge time.Duration) (entries int, size int64, err error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range dirEntries {
+		info, err := e.Info()
+		if err != nil {
+			return entries, size, err
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		p := filepath.Join(cacheDir, e.Name())
+		n, err := dirSize(p)
+		if err != nil {
+			return entries, size, err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return entries, size, err
+		}
+		entries, size = entries+1, size+n
+	}
+	return entries, size, nil
+}
+
+// sourceDB is a database of a world that is merged. It is never written to.
+type sourceDB interface {
+	chunkSource
+	LoadBlockNBT(position world.ChunkPos, dim world.Dimension) ([]map[string]any, error)
+	Close() error
+}
+
+// openWorld opens the world of the .mcworld file source. With memory set the
+// world is read from the archive, otherwise from the folder dir it was
+// extracted to.
+func openWorld(source, dir string, memory bool) (sourceDB, error) {
+	if memory {
+		return openZipDB(source, defaultZipLimits)
+	}
+	return openReadOnly(dir)
+}
+
+// open opens the world of w.
+func (w *worldMap) open() (sourceDB, error) {
+	return openWorld(w.source, path.Join(w.filepath, extractedName), w.memory)
+}
+
+// openZipDB opens the LevelDB in the db folder of the archive filename
+// read-only, copying its files into memory. The archive is checked against
+// limits the same way as by UnpackZip.
+func openZipDB(filename string, limits zipLimits) (*readOnlyDB, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, &zipError{Archive: filename, Err: err}
+	}
+	defer zr.Close()
+	if len(zr.File) > limits.MaxEntries {
+		return nil, &zipError{Archive: filename, Err: fmt.Errorf("%w: %d entries", errTooLarge, len(zr.File))}
+	}
+
+	stor := storage.NewMemStorage()
+	var current bytes.Buffer
+	var total int64
+	for _, f := range zr.File {
+		name, err := entryPath(f.Name)
+		if err != nil {
+			return nil, &zipError{Archive: filename, Entry: f.Name, Err: err}
+		}
+		dir, base := path.Split(name)
+		if dir != "db/" || !f.Mode().IsRegular() {
+			continue
+		}
+		var n int64
+		if base == "CURRENT" {
+			n, err = copyEntry(&current, f, limits, limits.MaxTotalSize-total)
+		} else if fd, ok := levelDBFile(base); ok {
+			var w storage.Writer
+			if w, err = stor.Create(fd); err != nil {
+				return nil, err
+			}
+			n, err = copyEntry(w, f, limits, limits.MaxTotalSize-total)
+			// The file can only be read by the database once it is closed.
+			w.Close()
+		} else {
+			// The lock and the log of the database aren't needed to read it.
+			continue
+		}
+		if err != nil {
+			return nil, &zipError{Archive: filename, Entry: f.Name, Err: err}
+		}
+		total += n
+	}
+
+	manifest, ok := levelDBFile(strings.TrimSpace(current.String()))
+	if !ok || manifest.Type != storage.TypeManifest {
+		return nil, &zipError{Archive: filename, Entry: "db/CURRENT", Err: fmt.Errorf("invalid manifest %q", current.String())}
+	}
+	if err := stor.SetMeta(manifest); err != nil {
+		return nil, err
+	}
+	ldb, err := leveldb.Open(stor, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filename, err)
+	}
+	return &readOnlyDB{ldb: ldb}, nil
+}
+
+// levelDBFile parses the name of a file of a LevelDB, returning false for
+// files that don't hold data of the database.
+func levelDBFile(name string) (storage.FileDesc, bool) {
+	var fd storage.FileDesc
+	if num, ok := strings.CutPrefix(name, "MANIFEST-"); ok {
+		fd.Type = storage.TypeManifest
+		_, err := fmt.Sscanf(num, "%d", &fd.Num)
+		return fd, err == nil && fd.Num >= 0
+	}
+	num, ext, _ := strings.Cut(name, ".")
+	switch ext {
+	case "ldb", "sst":
+		fd.Type = storage.TypeTable
+	case "log":
+		fd.Type = storage.TypeJournal
+	default:
+		return fd, false
+	}
+	_, err := fmt.Sscanf(num, "%d", &fd.Num)
+	return fd, err == nil && fd.Num >= 0
+}
+
+// levelDat holds the fields of a level.dat the merger reads from the worlds
+// it merges.
+type levelDat struct {
+	LastPlayed             int64
+	SpawnX, SpawnY, SpawnZ int32
+}
+
+// loadLevelDat reads the level.dat of the world of the .mcworld file source,
+// from the archive if memory is set or from the folder dir otherwise. A world
+// without a level.dat gets zero values.
+func loadLevelDat(source, dir string, memory bool) (levelDat, error) {
+	var ldat levelDat
+	var data []byte
+	if memory {
+		zr, err := zip.OpenReader(source)
+		if err != nil {
+			return ldat, &zipError{Archive: source, Err: err}
+		}
+		defer zr.Close()
+		f, err := zr.Open("level.dat")
+		if errors.Is(err, os.ErrNotExist) {
+			return ldat, nil
+		} else if err != nil {
+			return ldat, &zipError{Archive: source, Entry: "level.dat", Err: err}
+		}
+		defer f.Close()
+		data, err = io.ReadAll(io.LimitReader(f, 1<<20))
+		if err != nil {
+			return ldat, &zipError{Archive: source, Entry: "level.dat", Err: err}
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(filepath.Join(dir, "level.dat"))
+		if errors.Is(err, os.ErrNotExist) {
+			return ldat, nil
+		} else if err != nil {
+			return ldat, err
+		}
+	}
+	// The first 8 bytes are a header holding the version and length.
+	if len(data) < 8 {
+		return ldat, fmt.Errorf("level.dat exists but has no data")
+	}
+	var m map[string]any
+	if err := nbt.UnmarshalEncoding(data[8:], &m, nbt.LittleEndian); err != nil {
+		return ldat, fmt.Errorf("decode level.dat: %w", err)
+	}
+	ldat.LastPlayed, _ = m["LastPlayed"].(int64)
+	ldat.SpawnX, _ = m["SpawnX"].(int32)
+	ldat.SpawnY, _ = m["SpawnY"].(int32)
+	ldat.SpawnZ, _ = m["SpawnZ"].(int32)
+	return ldat, nil
+}
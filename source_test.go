@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCacheEntryStamp checks that a .mcworld file is only hashed again once
+// its size or modification time changed.
+func TestCacheEntryStamp(t *testing.T) {
+	cacheDir = t.TempDir()
+	filename := filepath.Join(t.TempDir(), "a.mcworld")
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	write := func(data string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func() string {
+		t.Helper()
+		_, hash, err := cacheEntry(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	write("first", modTime)
+	first := entry()
+	if want := hashOf(t, filename); first != want {
+		t.Fatalf("hash %s, want %s", first, want)
+	}
+	// The same size and modification time: the stamp is used.
+	write("other", modTime)
+	if h := entry(); h != first {
+		t.Errorf("file was hashed again without changing its size or modification time")
+	}
+	write("other", modTime.Add(time.Second))
+	if h := entry(); h == first {
+		t.Errorf("file wasn't hashed again after its modification time changed")
+	}
+	write("longer", modTime.Add(time.Second))
+	if h, want := entry(), hashOf(t, filename); h != want {
+		t.Errorf("hash %s after the size changed, want %s", h, want)
+	}
+}
+
+// hashOf returns the hash of the file at filename.
+func hashOf(t *testing.T, filename string) string {
+	t.Helper()
+	h, err := hashFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// rawSubChunk is a sub chunk decoded from its disk format with the palette
+// entries kept as encoded NBT. Unlike chunk.DiskDecode, it doesn't need the
+// blocks to be registered in dragonfly, so blocks of add-ons and blocks newer
+// than dragonfly are kept as they are.
+type rawSubChunk struct {
+	layers []rawLayer
+}
+
+// rawLayer is a single block storage of a rawSubChunk.
+type rawLayer struct {
+	// indices holds the palette index of every block, at the index
+	// x<<8 | z<<4 | y.
+	indices []uint16
+	// palette holds the encoded palette entries, air is true for the
+	// entries that are air.
+	palette [][]byte
+	air     []bool
+}
+
+// airEntry is the palette entry of air, used for blocks of layers a sub chunk
+// doesn't have.
+var airEntry, _ = nbt.MarshalEncoding(blockState("minecraft:air", map[string]any{}), nbt.LittleEndian)
+
+// subChunkStorage is a block storage of a serialised sub chunk, as read by
+// readSubChunk.
+type subChunkStorage struct {
+	// header holds the bytes of the storage before its palette entries: the
+	// block size, the packed block indices and the palette size.
+	header []byte
+	// bits is the number of bits per block index, 0x7f for an empty storage
+	// without indices or palette.
+	bits    byte
+	indices []byte
+	// palette holds the encoded palette entries and entries the same entries
+	// decoded.
+	palette [][]byte
+	entries []map[string]any
+}
+
+// readSubChunk reads the storages of the serialised sub chunk data in the disk
+// format of version 1, 8 or 9. It returns the bytes before the first storage
+// and the bytes after the last. ok is false for the older formats without
+// palettes, which aren't read.
+func readSubChunk(data []byte) (head []byte, storages []subChunkStorage, rest []byte, ok bool, err error) {
+	if len(data) == 0 {
+		return nil, nil, nil, false, fmt.Errorf("sub chunk too short")
+	}
+	pos, count := 1, 1
+	switch data[0] {
+	case 1:
+	case 8, 9:
+		if len(data) < 2 {
+			return nil, nil, nil, false, fmt.Errorf("sub chunk too short")
+		}
+		pos, count = 2, int(data[1])
+		if data[0] == 9 {
+			// Version 9 holds the Y of the sub chunk after the storage count.
+			pos = 3
+		}
+	default:
+		return nil, nil, nil, false, nil
+	}
+	if pos > len(data) {
+		return nil, nil, nil, false, fmt.Errorf("sub chunk too short")
+	}
+	head = data[:pos]
+
+	for i := 0; i < count; i++ {
+		if pos >= len(data) {
+			return nil, nil, nil, false, fmt.Errorf("storage %d: sub chunk too short", i)
+		}
+		st := subChunkStorage{bits: data[pos] >> 1}
+		if st.bits == 0x7f {
+			st.header = data[pos : pos+1]
+			storages = append(storages, st)
+			pos++
+			continue
+		}
+		words, ok := paletteWords(st.bits)
+		if !ok {
+			return nil, nil, nil, false, fmt.Errorf("storage %d: invalid block size %d", i, st.bits)
+		}
+		end := pos + 1 + words*4
+		entries := 1
+		if st.bits != 0 {
+			if end+4 > len(data) {
+				return nil, nil, nil, false, fmt.Errorf("storage %d: sub chunk too short", i)
+			}
+			entries = int(binary.LittleEndian.Uint32(data[end:]))
+			end += 4
+		}
+		if end > len(data) {
+			return nil, nil, nil, false, fmt.Errorf("storage %d: sub chunk too short", i)
+		}
+		st.header, st.indices = data[pos:end], data[pos+1:pos+1+words*4]
+
+		buf := bytes.NewBuffer(data[end:])
+		dec := nbt.NewDecoderWithEncoding(buf, nbt.LittleEndian)
+		for j := 0; j < entries; j++ {
+			start := len(data) - buf.Len()
+			var m map[string]any
+			if err := dec.Decode(&m); err != nil {
+				return nil, nil, nil, false, fmt.Errorf("storage %d: palette entry %d: %w", i, j, err)
+			}
+			st.palette = append(st.palette, data[start:len(data)-buf.Len()])
+			st.entries = append(st.entries, m)
+		}
+		storages = append(storages, st)
+		pos = len(data) - buf.Len()
+	}
+	return head, storages, data[pos:], true, nil
+}
+
+// paletteWords returns the number of uint32s holding the block indices of a
+// storage with the given bits per block.
+func paletteWords(bits byte) (int, bool) {
+	switch bits {
+	case 0:
+		return 0, true
+	case 1, 2, 4, 8, 16:
+		return 4096 / (32 / int(bits)), true
+	case 3, 5, 6:
+		// These sizes don't divide 4096 evenly, the last uint32 is padded.
+		return 4096/(32/int(bits)) + 1, true
+	}
+	return 0, false
+}
+
+// decodeRawSubChunk decodes a sub chunk in the disk format of version 1, 8 or
+// 9. Older versions don't have palettes and can't be decoded.
+func decodeRawSubChunk(data []byte) (*rawSubChunk, error) {
+	_, storages, _, ok, err := readSubChunk(data)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("unsupported sub chunk version %d", data[0])
+	}
+
+	s := &rawSubChunk{}
+	for i, st := range storages {
+		l := rawLayer{indices: make([]uint16, 4096)}
+		if st.bits == 0x7f {
+			l.palette, l.air = [][]byte{airEntry}, []bool{true}
+			s.layers = append(s.layers, l)
+			continue
+		}
+		if st.bits != 0 {
+			perWord := 32 / int(st.bits)
+			mask := uint32(1)<<st.bits - 1
+			for j := range l.indices {
+				w := binary.LittleEndian.Uint32(st.indices[j/perWord*4:])
+				l.indices[j] = uint16(w >> (uint(j%perWord) * uint(st.bits)) & mask)
+			}
+		}
+		for j, m := range st.entries {
+			name, _ := m["name"].(string)
+			l.palette = append(l.palette, st.palette[j])
+			l.air = append(l.air, blockName(name) == "minecraft:air")
+		}
+		for _, idx := range l.indices {
+			if int(idx) >= len(l.palette) {
+				return nil, fmt.Errorf("storage %d: palette index %d out of %d entries", i, idx, len(l.palette))
+			}
+		}
+		s.layers = append(s.layers, l)
+	}
+	return s, nil
+}
+
+// airAt checks if the block at index i of the layer is air. Blocks of layers
+// the sub chunk doesn't have are air.
+func (s *rawSubChunk) airAt(layer, i int) bool {
+	if s == nil || layer >= len(s.layers) {
+		return true
+	}
+	l := s.layers[layer]
+	return l.air[l.indices[i]]
+}
+
+// entry returns the encoded palette entry of the block at index i of the
+// layer.
+func (s *rawSubChunk) entry(layer, i int) []byte {
+	if s == nil || layer >= len(s.layers) {
+		return airEntry
+	}
+	l := s.layers[layer]
+	return l.palette[l.indices[i]]
+}
+
+// names returns the block name of every palette entry of the layer.
+func (l rawLayer) names() []string {
+	names := make([]string, len(l.palette))
+	for i, e := range l.palette {
+		var m map[string]any
+		_ = nbt.UnmarshalEncoding(e, &m, nbt.LittleEndian)
+		names[i], _ = m["name"].(string)
+	}
+	return names
+}
+
+// onlyAir checks if every palette entry of the sub chunk is air.
+func (s *rawSubChunk) onlyAir() bool {
+	for _, l := range s.layers {
+		for _, air := range l.air {
+			if !air {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// encode encodes the sub chunk in the disk format of version 9, as the sub
+// chunk at y.
+func (s *rawSubChunk) encode(y int8) []byte {
+	out := []byte{9, byte(len(s.layers)), byte(y)}
+	for _, l := range s.layers {
+		bits := byte(0)
+		for 1<<bits < len(l.palette) {
+			bits++
+		}
+		switch bits {
+		case 7:
+			bits = 8
+		case 9, 10, 11, 12, 13, 14, 15:
+			bits = 16
+		}
+		out = append(out, bits<<1)
+		if bits != 0 {
+			words, _ := paletteWords(bits)
+			packed := make([]uint32, words)
+			perWord := 32 / int(bits)
+			for j, idx := range l.indices {
+				packed[j/perWord] |= uint32(idx) << (uint(j%perWord) * uint(bits))
+			}
+			for _, w := range packed {
+				out = binary.LittleEndian.AppendUint32(out, w)
+			}
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(l.palette)))
+		}
+		for _, e := range l.palette {
+			out = append(out, e...)
+		}
+	}
+	return out
+}
+
+// rawLayerBuilder builds a rawLayer block by block from encoded palette
+// entries.
+type rawLayerBuilder struct {
+	l     rawLayer
+	index map[string]uint16
+}
+
+func newRawLayerBuilder() *rawLayerBuilder {
+	return &rawLayerBuilder{l: rawLayer{indices: make([]uint16, 4096)}, index: make(map[string]uint16)}
+}
+
+// set sets the block at index i to the palette entry e.
+func (b *rawLayerBuilder) set(i int, e []byte, air bool) {
+	idx, ok := b.index[string(e)]
+	if !ok {
+		idx = uint16(len(b.l.palette))
+		b.index[string(e)] = idx
+		b.l.palette = append(b.l.palette, e)
+		b.l.air = append(b.l.air, air)
+	}
+	b.l.indices[i] = idx
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+)
+
+// tileSize is the width and height of a tile in pixels.
+const tileSize = 256
+
+// maxTileScale is the highest scale tiles are rendered at. A tile at scale s
+// covers tileSize<<s blocks along each axis, so that every pixel covers 2^s
+// blocks.
+const maxTileScale = 6
+
+// tileKey identifies a tile. The tile at X, Z covers the blocks from
+// X*(tileSize<<Scale) and Z*(tileSize<<Scale).
+type tileKey struct {
+	Dim   world.Dimension
+	Scale int
+	X, Z  int32
+}
+
+// chunks returns the range of chunks covered by a tile at scale 0.
+func (k tileKey) chunks() *IteratorRange {
+	n := int32(tileSize / 16)
+	return &IteratorRange{
+		Min:       world.ChunkPos{k.X * n, k.Z * n},
+		Max:       world.ChunkPos{k.X*n + n, k.Z*n + n},
+		Dimension: k.Dim,
+	}
+}
+
+// tileRenderer renders top-down tiles of a world, caching them as PNG files on
+// disk.
+type tileRenderer struct {
+	db    chunkSource
+	cache string
+	// present holds all tiles at any scale that cover at least one chunk.
+	present map[tileKey]struct{}
+	empty   []byte
+}
+
+// newTileRenderer returns a tileRenderer for db, iterating over all chunks of db
+// once to find the tiles that are not empty.
+func newTileRenderer(db chunkSource, cache string) (*tileRenderer, error) {
+	t := &tileRenderer{db: db, cache: cache, present: make(map[tileKey]struct{})}
+	it := newChunkIterator(db, nil)
+	defer it.Release()
+	for it.Next() {
+		pos := it.Position()
+		k := tileKey{Dim: it.Dimension(), X: floorDiv(pos[0], tileSize/16), Z: floorDiv(pos[1], tileSize/16)}
+		for ; k.Scale <= maxTileScale; k.Scale++ {
+			t.present[k] = struct{}{}
+			k.X, k.Z = floorDiv(k.X, 2), floorDiv(k.Z, 2)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))); err != nil {
+		return nil, err
+	}
+	t.empty = buf.Bytes()
+	return t, nil
+}
+
+// floorDiv divides a by b, rounding towards negative infinity.
+func floorDiv(a, b int32) int32 {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
+
+// maxRenderedTiles is the number of tiles at scale 0 a single request renders
+// at most. A tile at a high scale covers thousands of them, so it is built
+// over several requests from the tiles at scale 0 cached by earlier ones.
+const maxRenderedTiles = 64
+
+// tile returns the PNG encoded tile k, rendering it if it isn't cached. It
+// returns false if the tile is incomplete because it needed more than
+// maxRenderedTiles tiles at scale 0 to be rendered. Incomplete tiles aren't
+// cached.
+func (t *tileRenderer) tile(k tileKey) ([]byte, bool, error) {
+	budget := maxRenderedTiles
+	return t.cachedTile(k, &budget)
+}
+
+// cachedTile returns the tile k from the cache, or renders it with at most
+// budget tiles at scale 0 rendered.
+func (t *tileRenderer) cachedTile(k tileKey, budget *int) ([]byte, bool, error) {
+	if _, ok := t.present[k]; !ok {
+		return t.empty, true, nil
+	}
+	dimID, _ := world.DimensionID(k.Dim)
+	path := filepath.Join(t.cache, fmt.Sprint(dimID), fmt.Sprint(k.Scale), fmt.Sprint(k.X), fmt.Sprintf("%d.png", k.Z))
+	if data, err := os.ReadFile(path); err == nil {
+		return data, true, nil
+	}
+
+	img, complete, err := t.render(k, budget)
+	if err != nil {
+		return nil, false, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, false, err
+	}
+	if !complete {
+		return buf.Bytes(), false, nil
+	}
+	return buf.Bytes(), true, writeTile(path, buf.Bytes())
+}
+
+// writeTile writes the tile data to path. It is written to a temporary file
+// first, so that a tile rendered by two requests at the same time is never
+// read half written.
+func writeTile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// render renders the tile k. Tiles at scale 0 are rendered from the chunks they
+// cover, tiles at higher scales from the four tiles of the scale below. It
+// returns false if budget ran out before all tiles at scale 0 were rendered.
+func (t *tileRenderer) render(k tileKey, budget *int) (image.Image, bool, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	if k.Scale == 0 {
+		if *budget <= 0 {
+			return img, false, nil
+		}
+		*budget--
+		return img, true, t.renderChunks(k, img)
+	}
+	complete := true
+	for i := int32(0); i < 4; i++ {
+		child := tileKey{Dim: k.Dim, Scale: k.Scale - 1, X: k.X*2 + i%2, Z: k.Z*2 + i/2}
+		data, ok, err := t.cachedTile(child, budget)
+		if err != nil {
+			return nil, false, err
+		}
+		complete = complete && ok
+		src, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, fmt.Errorf("decode tile %v: %w", child, err)
+		}
+		downscale(img, src, int(i%2)*tileSize/2, int(i/2)*tileSize/2)
+	}
+	return img, complete, nil
+}
+
+// downscale draws src into dst at x, z at half its size, averaging every two by
+// two pixels.
+func downscale(dst *image.NRGBA, src image.Image, x, z int) {
+	for dx := 0; dx < tileSize/2; dx++ {
+		for dz := 0; dz < tileSize/2; dz++ {
+			var r, g, b, a, n uint32
+			for i := 0; i < 4; i++ {
+				c := color.NRGBAModel.Convert(src.At(dx*2+i%2, dz*2+i/2)).(color.NRGBA)
+				if c.A == 0 {
+					continue
+				}
+				r, g, b, a, n = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B), a+uint32(c.A), n+1
+			}
+			if n > 0 {
+				// Transparent pixels only lower the alpha, so that the edges
+				// of worlds don't turn dark.
+				dst.SetNRGBA(x+dx, z+dz, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / 4)})
+			}
+		}
+	}
+}
+
+// renderChunks draws the highest block of every column of the chunks covered
+// by k into img, shaded by the difference in height to the block north of it.
+// Blocks are read from the raw palettes of the sub chunks, so that blocks of
+// add-ons and blocks dragonfly doesn't know are drawn too.
+func (t *tileRenderer) renderChunks(k tileKey, img *image.NRGBA) error {
+	var heights [tileSize][tileSize]int16
+	var colors [tileSize][tileSize]color.NRGBA
+	r := k.chunks()
+	it := newChunkIterator(t.db, r)
+	defer it.Release()
+	for it.Next() {
+		pos := it.Position()
+		bx, bz := int(pos[0]-r.Min[0])*16, int(pos[1]-r.Min[1])*16
+		err := highestBlocks(t.db.LDB(), pos, it.Dimension(), func(x, z int, y int16, name string) {
+			heights[bx+x][bz+z] = y
+			colors[bx+x][bz+z] = blockColor(name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	for x := 0; x < tileSize; x++ {
+		for z := 0; z < tileSize; z++ {
+			col := colors[x][z]
+			if col.A == 0 {
+				continue
+			}
+			if z > 0 && colors[x][z-1].A != 0 {
+				switch d := heights[x][z] - heights[x][z-1]; {
+				case d > 0:
+					col = shade(col, 1.15)
+				case d < 0:
+					col = shade(col, 0.8)
+				}
+			}
+			img.SetNRGBA(x, z, col)
+		}
+	}
+	return nil
+}
+
+// shade multiplies the brightness of c by f.
+func shade(c color.NRGBA, f float64) color.NRGBA {
+	scale := func(v uint8) uint8 {
+		if s := float64(v) * f; s < 255 {
+			return uint8(s)
+		}
+		return 255
+	}
+	return color.NRGBA{R: scale(c.R), G: scale(c.G), B: scale(c.B), A: c.A}
+}
+
+// blockColors holds the map colors of common blocks.
+var blockColors = map[string]color.NRGBA{
+	"grass":         {0x7f, 0xb2, 0x38, 0xff},
+	"dirt":          {0x97, 0x6d, 0x4d, 0xff},
+	"stone":         {0x70, 0x70, 0x70, 0xff},
+	"sand":          {0xf7, 0xe9, 0xa3, 0xff},
+	"gravel":        {0x88, 0x80, 0x7e, 0xff},
+	"water":         {0x40, 0x40, 0xff, 0xff},
+	"flowing_water": {0x40, 0x40, 0xff, 0xff},
+	"lava":          {0xff, 0x00, 0x00, 0xff},
+	"snow_layer":    {0xff, 0xff, 0xff, 0xff},
+	"snow":          {0xff, 0xff, 0xff, 0xff},
+	"ice":           {0xa0, 0xa0, 0xff, 0xff},
+	"bedrock":       {0x50, 0x50, 0x50, 0xff},
+	"netherrack":    {0x70, 0x02, 0x00, 0xff},
+	"end_stone":     {0xf7, 0xe9, 0xa3, 0xff},
+	"leaves":        {0x00, 0x7c, 0x00, 0xff},
+	"leaves2":       {0x00, 0x7c, 0x00, 0xff},
+	"log":           {0x8f, 0x77, 0x48, 0xff},
+	"log2":          {0x8f, 0x77, 0x48, 0xff},
+	"planks":        {0x8f, 0x77, 0x48, 0xff},
+	"tallgrass":     {0x7f, 0xb2, 0x38, 0xff},
+	"clay":          {0xa4, 0xa8, 0xb8, 0xff},
+}
+
+// highestBlocks calls f with the height and name of the highest block that
+// isn't air of every column of the chunk at pos. Columns holding only air are
+// left out.
+func highestBlocks(db *leveldb.DB, pos world.ChunkPos, dim world.Dimension, f func(x, z int, y int16, name string)) error {
+	var done [256]bool
+	left := len(done)
+	index := key_index(pos, dim)
+	r := dim.Range()
+	for sy := r[1] >> 4; sy >= r[0]>>4 && left > 0; sy-- {
+		data, err := db.Get(append(index, keySubChunkData, byte(int8(sy))), nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		sub, err := decodeRawSubChunk(data)
+		if err != nil {
+			return fmt.Errorf("decode sub chunk %d of chunk %v: %w", sy, pos, err)
+		}
+		if len(sub.layers) == 0 || sub.onlyAir() {
+			continue
+		}
+		l := sub.layers[0]
+		names := l.names()
+		for col := range done {
+			if done[col] {
+				continue
+			}
+			for y := 15; y >= 0; y-- {
+				idx := l.indices[col<<4|y]
+				if l.air[idx] {
+					continue
+				}
+				f(col>>4, col&15, int16(sy<<4+y), names[idx])
+				done[col] = true
+				left--
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// blockColor returns the map color of the block with the name. Blocks without
+// a known map color, such as blocks of add-ons, get a color derived from their
+// name.
+func blockColor(name string) color.NRGBA {
+	name = strings.TrimPrefix(name, "minecraft:")
+	if c, ok := blockColors[name]; ok {
+		return c
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	return color.NRGBA{R: 64 + uint8(v)%160, G: 64 + uint8(v>>8)%160, B: 64 + uint8(v>>16)%160, A: 0xff}
+}
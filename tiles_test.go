@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+)
+
+// TestRenderTiles checks that blocks dragonfly doesn't know are drawn, and
+// that tiles left incomplete by the render budget aren't cached.
+func TestRenderTiles(t *testing.T) {
+	in := writeTestWorlds(t, []testWorld{{"g/a", "minecraft:iron_block", ChunkPos{0, 0}, 2}})
+	cacheDir = t.TempDir()
+	dir, err := extractWorld(filepath.ToSlash(filepath.Join(in, "g", "a.mcworld")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crate at x=0, y=16, z=0, above the iron blocks at y=0.
+	if err := ldb.Put(append(key_index(world.ChunkPos{0, 0}, world.Overworld), keySubChunkData, 1), testSubChunk(t, "addon:crate", 0), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ldb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := t.TempDir()
+	tiles, err := newTileRenderer(db, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := tileKey{Dim: world.Overworld, Scale: 0}
+	data, complete, err := tiles.tile(k)
+	if err != nil || !complete {
+		t.Fatalf("render tile: %v, complete %v", err, complete)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		x, z int
+		want color.NRGBA
+	}{
+		{0, 0, blockColor("addon:crate")},
+		{0, 1, shade(blockColor("minecraft:iron_block"), 0.8)},
+		{31, 31, blockColor("minecraft:iron_block")},
+		{32, 32, color.NRGBA{}},
+	} {
+		if got := color.NRGBAModel.Convert(img.At(c.x, c.z)); got != c.want {
+			t.Errorf("pixel %d, %d is %v, want %v", c.x, c.z, got, c.want)
+		}
+	}
+
+	// A new cache, so that the tile at scale 0 rendered above isn't used.
+	cache = t.TempDir()
+	if tiles, err = newTileRenderer(db, cache); err != nil {
+		t.Fatal(err)
+	}
+	budget := 0
+	parent := tileKey{Dim: world.Overworld, Scale: 2}
+	if _, complete, err := tiles.cachedTile(parent, &budget); err != nil || complete {
+		t.Fatalf("render tile without budget: %v, complete %v", err, complete)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "0", "2", "0", "0.png")); !os.IsNotExist(err) {
+		t.Errorf("incomplete tile was cached: %v", err)
+	}
+	if _, complete, err := tiles.tile(parent); err != nil || !complete {
+		t.Errorf("render tile: %v, complete %v", err, complete)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "0", "2", "0", "0.png")); err != nil {
+		t.Errorf("complete tile wasn't cached: %v", err)
+	}
+}
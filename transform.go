@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/chunk"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+	"github.com/sirupsen/logrus"
+)
+
+// transform changes the chunks of worlds while they are copied. Chunks are
+// copied as they are stored unless a part of the transform is configured, in
+// which case the parts of the chunk it needs are decoded.
+type transform struct {
+	// blocks replaces blocks in the palettes of all sub chunks.
+	blocks blockMapping
+	// entities decides which entities are copied, it may be nil.
+	entities *entityRules
+	// items decides which items are kept in containers, it may be nil.
+	items *itemRules
+
+	registry *addonRegistry
+	unknown  unknownPolicy
+	// placeholder is the block undefined blocks are replaced with under
+	// unknownPlaceholder.
+	placeholder string
+
+	report *transformReport
+}
+
+// transformJson records in map.json which parts of the transform were used by
+// the merge, so that verify knows how the merged chunks may differ from the
+// chunks of the source worlds.
+type transformJson struct {
+	// ReplaceBlocks, EntityRules and ItemRules are the hex encoded SHA-256
+	// hashes of the rule files used, empty if no file was used.
+	ReplaceBlocks string `json:",omitempty"`
+	EntityRules   string `json:",omitempty"`
+	ItemRules     string `json:",omitempty"`
+	// Unknown is how identifiers not defined by any pack were handled.
+	Unknown unknownPolicy `json:",omitempty"`
+}
+
+// newTransformJson hashes the rule files passed, returning nil if neither a
+// rule file nor a check of undefined identifiers is used.
+func newTransformJson(replaceBlocks, entityRules, itemRules string, unknown unknownPolicy) (*transformJson, error) {
+	t := &transformJson{}
+	for _, f := range []struct {
+		filename string
+		hash     *string
+	}{{replaceBlocks, &t.ReplaceBlocks}, {entityRules, &t.EntityRules}, {itemRules, &t.ItemRules}} {
+		if f.filename == "" {
+			continue
+		}
+		var err error
+		if *f.hash, err = hashFile(f.filename); err != nil {
+			return nil, err
+		}
+	}
+	if unknown != unknownNone {
+		t.Unknown = unknown
+	}
+	if *t == (transformJson{}) {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// blocksChanged checks if the transform may have replaced blocks, and with
+// them dropped block entities.
+func (t *transformJson) blocksChanged() bool {
+	return t != nil && (t.ReplaceBlocks != "" || t.Unknown == unknownPlaceholder || t.Unknown == unknownDrop)
+}
+
+// entitiesChanged checks if the transform may have dropped entities.
+func (t *transformJson) entitiesChanged() bool {
+	return t != nil && (t.EntityRules != "" || t.Unknown == unknownPlaceholder || t.Unknown == unknownDrop)
+}
+
+// active checks if the transform changes or checks anything.
+func (t *transform) active() bool {
+	return t != nil && (len(t.blocks) > 0 || t.entities != nil || t.items != nil || t.unknown != unknownNone)
+}
+
+// forWorld returns the transform of a single world, or nil if chunks are
+// copied unchanged.
+func (t *transform) forWorld(source string) *worldTransform {
+	if !t.active() {
+		return nil
+	}
+	return &worldTransform{
+		t:         t,
+		world:     source,
+		undefined: make(map[string]map[iterKey]struct{}),
+		actors:    make(map[string]actorState),
+		counts:    make(map[iterKey]int),
+		changes:   make(map[string]int),
+	}
+}
+
+// worldTransform applies a transform to the keys of a single world. It is
+// not safe for concurrent use.
+type worldTransform struct {
+	t     *transform
+	world string
+
+	// undefined holds the chunks of the output every undefined identifier was
+	// found in.
+	undefined map[string]map[iterKey]struct{}
+	// actors holds the entities in actor storage by their unique ID. The
+	// chunk of such an entity is only known once the actor digest listing it
+	// is copied, which comes after it in key order.
+	actors map[string]actorState
+	// counts holds the number of entities kept in every output chunk.
+	counts map[iterKey]int
+	// changes counts the changes made to the world.
+	changes map[string]int
+
+	// stripped holds the blocks of the output chunk strippedChunk that were
+	// replaced with a block without a block entity, for every sub chunk by its
+	// Y. The sub chunks of a chunk come before its block entities in key
+	// order, so only the chunk transformed last is kept.
+	strippedChunk iterKey
+	stripped      map[int][]bool
+}
+
+// actorState is what a worldTransform knows about an entity in actor storage.
+type actorState struct {
+	id                 string
+	undefined, dropped bool
+}
+
+// subChunk applies the block mapping to the block palette of the sub chunk
+// data at y of the output chunk k, and then checks the blocks against the
+// registry, replacing undefined blocks if the transform says so. The blocks
+// replaced with a block without a block entity are recorded, so that their
+// block entities are dropped by blockEntity.
+func (wt *worldTransform) subChunk(k iterKey, y int, data []byte) ([]byte, error) {
+	if k != wt.strippedChunk {
+		wt.strippedChunk, wt.stripped = k, nil
+	}
+	var lost map[int]bool
+	out, err := rewritePalettes(data, func(layer, i int, m map[string]any) map[string]any {
+		r := wt.replaceBlock(k, m)
+		if r != nil && layer == 0 && r["name"] != m["name"] && !hasBlockEntity(r["name"].(string)) {
+			if lost == nil {
+				lost = make(map[int]bool)
+			}
+			lost[i] = true
+		}
+		return r
+	})
+	if err != nil || lost == nil {
+		return out, err
+	}
+	sub, err := decodeRawSubChunk(data)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]bool, len(sub.layers[0].indices))
+	for i, idx := range sub.layers[0].indices {
+		blocks[i] = lost[int(idx)]
+	}
+	if wt.stripped == nil {
+		wt.stripped = make(map[int][]bool)
+	}
+	wt.stripped[y] = blocks
+	return out, nil
+}
+
+// replaceBlock applies the block mapping and the registry to the block
+// palette entry m in the output chunk k. It returns the entry replacing m, or
+// nil if m is kept.
+func (wt *worldTransform) replaceBlock(k iterKey, m map[string]any) map[string]any {
+	name, _ := m["name"].(string)
+	var replaced map[string]any
+	if r, ok := wt.t.blocks.replace(m); ok {
+		replaced = r
+		wt.changes[fmt.Sprintf("mapped %s to %s (sub chunks)", name, r["name"])]++
+		name = r["name"].(string)
+	}
+	if wt.t.unknown == unknownNone || wt.t.registry.block(name) {
+		return replaced
+	}
+	wt.found(name, k)
+	var replacement string
+	switch wt.t.unknown {
+	case unknownPlaceholder:
+		replacement = wt.t.placeholder
+	case unknownDrop:
+		replacement = "minecraft:air"
+	default:
+		return replaced
+	}
+	wt.changes[fmt.Sprintf("replaced %s with %s (sub chunks)", name, replacement)]++
+	return blockState(replacement, nil)
+}
+
+// blockEntity checks the block entity m in the output chunk k, returning false
+// if its block was replaced with a block without a block entity. The item
+// rules are applied to the container of a block entity that is kept.
+func (wt *worldTransform) blockEntity(k iterKey, m map[string]any) bool {
+	if k == wt.strippedChunk && wt.stripped != nil {
+		x, _ := m["x"].(int32)
+		y, _ := m["y"].(int32)
+		z, _ := m["z"].(int32)
+		if blocks := wt.stripped[int(y>>4)]; blocks != nil && blocks[int(x&15)<<8|int(z&15)<<4|int(y&15)] {
+			id, _ := m["id"].(string)
+			wt.changes["dropped "+id+" (block replaced)"]++
+			return false
+		}
+	}
+	if wt.t.items == nil {
+		return true
+	}
+	wt.t.items.sanitizeContainer(m, func(change string) {
+		wt.changes[change]++
+	})
+	return true
+}
+
+// blockEntityBlocks are patterns as used by path.Match of the names of the
+// vanilla blocks that have a block entity. Blocks of add-ons never have one.
+var blockEntityBlocks = []string{
+	"*chest", "*shulker_box", "barrel", "*furnace", "smoker", "lit_smoker", "hopper", "dropper", "dispenser",
+	"brewing_stand", "beacon", "enchanting_table", "*command_block", "structure_block", "jigsaw", "mob_spawner",
+	"trial_spawner", "vault", "bell", "*campfire", "cauldron", "lectern", "jukebox", "noteblock", "flower_pot",
+	"skull", "*_skull", "*_head", "*sign", "*banner", "bed", "beehive", "bee_nest", "conduit", "end_portal",
+	"end_gateway", "daylight_detector*", "*comparator", "piston", "sticky_piston", "*piston_arm_collision",
+	"moving_block", "frame", "glow_frame", "chiseled_bookshelf", "decorated_pot", "*sculk_sensor",
+	"sculk_catalyst", "sculk_shrieker", "suspicious_sand", "suspicious_gravel", "crafter", "creaking_heart",
+}
+
+// hasBlockEntity checks if the block with the name has a block entity.
+func hasBlockEntity(name string) bool {
+	name, ok := strings.CutPrefix(name, "minecraft:")
+	if !ok {
+		return false
+	}
+	for _, pattern := range blockEntityBlocks {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// entity checks an entity stored in the output chunk k, returning false if
+// the entity should be dropped.
+func (wt *worldTransform) entity(k iterKey, m map[string]any) bool {
+	id, keep, undefined := wt.checkEntity(m)
+	if undefined {
+		wt.found(id, k)
+	}
+	return keep && wt.fits(k, id)
+}
+
+// actor checks an entity stored in actor storage under the unique ID uid,
+// returning false if the entity should be dropped. The limit of entities per
+// chunk is applied by digest.
+func (wt *worldTransform) actor(uid []byte, m map[string]any) bool {
+	id, keep, undefined := wt.checkEntity(m)
+	wt.actors[string(uid)] = actorState{id: id, undefined: undefined, dropped: !keep}
+	return keep
+}
+
+// digest checks the actor digest of the output chunk k, removing the unique
+// IDs of entities that were dropped from it. Entities over the limit of the
+// chunk are removed from it as well and their unique IDs are returned, as they
+// were already copied.
+func (wt *worldTransform) digest(k iterKey, digp []byte) (out []byte, over [][]byte) {
+	out = digp[:0:0]
+	for i := 0; i+8 <= len(digp); i += 8 {
+		uid := digp[i : i+8]
+		a, ok := wt.actors[string(uid)]
+		if a.undefined {
+			wt.found(a.id, k)
+		}
+		if a.dropped {
+			continue
+		}
+		if ok && !wt.fits(k, a.id) {
+			over = append(over, uid)
+			continue
+		}
+		out = append(out, uid...)
+	}
+	return out, over
+}
+
+// checkEntity applies the entity rules and the registry to the entity m. It
+// returns the identifier of the entity, whether it is kept and whether its
+// identifier is undefined.
+func (wt *worldTransform) checkEntity(m map[string]any) (id string, keep, undefined bool) {
+	id, _ = m["identifier"].(string)
+	rules := wt.t.entities
+	if !rules.keep(id, m) {
+		wt.changes["dropped "+id+" (rules)"]++
+		return id, false, false
+	}
+	if wt.t.unknown != unknownNone && !wt.t.registry.entity(id) {
+		undefined = true
+		if wt.t.unknown != unknownReport {
+			wt.changes["dropped "+id+" (undefined)"]++
+			return id, false, true
+		}
+	}
+	if rules != nil && rules.StripNames && stripName(m) {
+		wt.changes["stripped custom names"]++
+	}
+	return id, true, undefined
+}
+
+// fits counts an entity with the identifier id kept in the output chunk k,
+// returning false if the chunk already holds as many entities as allowed.
+func (wt *worldTransform) fits(k iterKey, id string) bool {
+	if wt.t.entities == nil || wt.t.entities.MaxPerChunk == 0 {
+		return true
+	}
+	if wt.counts[k] >= wt.t.entities.MaxPerChunk {
+		wt.changes["dropped "+id+" (chunk limit)"]++
+		return false
+	}
+	wt.counts[k]++
+	return true
+}
+
+// found records the undefined identifier id in the output chunk k.
+func (wt *worldTransform) found(id string, k iterKey) {
+	chunks, ok := wt.undefined[id]
+	if !ok {
+		chunks = make(map[iterKey]struct{})
+		wt.undefined[id] = chunks
+	}
+	chunks[k] = struct{}{}
+}
+
+// done adds what the transform found in the world to the report. It must be
+// called once after the world was copied.
+func (wt *worldTransform) done() {
+	if wt == nil || len(wt.undefined) == 0 && len(wt.changes) == 0 {
+		return
+	}
+	r := &worldReport{Changes: wt.changes}
+	if len(r.Changes) == 0 {
+		r.Changes = nil
+	}
+	if len(wt.undefined) > 0 {
+		r.Undefined = make(map[string][]reportChunk, len(wt.undefined))
+		for id, chunks := range wt.undefined {
+			list := make([]reportChunk, 0, len(chunks))
+			for k := range chunks {
+				dim, _ := world.DimensionID(k.dim)
+				list = append(list, reportChunk{Dimension: dim, Pos: ChunkPos(k.pos)})
+			}
+			sortReportChunks(list)
+			r.Undefined[id] = list
+		}
+	}
+	wt.t.report.add(wt.world, r)
+}
+
+// transformReport collects what the transform found and changed in every
+// world. It is safe for concurrent use.
+type transformReport struct {
+	mu     sync.Mutex
+	Worlds map[string]*worldReport `json:"worlds"`
+}
+
+// worldReport is what the transform found and changed in a single world.
+type worldReport struct {
+	// Undefined holds the chunks of the merged world every identifier that
+	// no pack defines was found in.
+	Undefined map[string][]reportChunk `json:"undefined,omitempty"`
+	// Changes counts the changes made to the world by their description.
+	Changes map[string]int `json:"changes,omitempty"`
+}
+
+// reportChunk is a chunk of the merged world in a transformReport.
+type reportChunk struct {
+	Dimension int      `json:"dimension"`
+	Pos       ChunkPos `json:"pos"`
+}
+
+// add adds the report of a world. A world reported more than once, such as
+// by copyWorld and by resolveConflicts, gets the reports combined.
+func (r *transformReport) add(world string, wr *worldReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Worlds == nil {
+		r.Worlds = make(map[string]*worldReport)
+	}
+	prev, ok := r.Worlds[world]
+	if !ok {
+		r.Worlds[world] = wr
+		return
+	}
+	for c, n := range wr.Changes {
+		if prev.Changes == nil {
+			prev.Changes = make(map[string]int)
+		}
+		prev.Changes[c] += n
+	}
+	for id, list := range wr.Undefined {
+		if prev.Undefined == nil {
+			prev.Undefined = make(map[string][]reportChunk)
+		}
+		// Both reports never hold the same chunk, as every chunk is written by
+		// either of them.
+		prev.Undefined[id] = append(prev.Undefined[id], list...)
+		sortReportChunks(prev.Undefined[id])
+	}
+}
+
+// sortReportChunks sorts chunks by dimension and position.
+func sortReportChunks(list []reportChunk) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Dimension != b.Dimension {
+			return a.Dimension < b.Dimension
+		}
+		if a.Pos.X() != b.Pos.X() {
+			return a.Pos.X() < b.Pos.X()
+		}
+		return a.Pos.Z() < b.Pos.Z()
+	})
+}
+
+// log logs a summary of the report for every world.
+func (r *transformReport) log() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.Worlds))
+	for name := range r.Worlds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wr := r.Worlds[name]
+		if len(wr.Undefined) > 0 {
+			ids := make([]string, 0, len(wr.Undefined))
+			for id, chunks := range wr.Undefined {
+				ids = append(ids, fmt.Sprintf("%s (%d chunks)", id, len(chunks)))
+			}
+			sort.Strings(ids)
+			logrus.Warnf("%s: identifiers not defined by any pack: %s", name, strings.Join(ids, ", "))
+		}
+		changes := make([]string, 0, len(wr.Changes))
+		for c, n := range wr.Changes {
+			changes = append(changes, fmt.Sprintf("%s: %d", c, n))
+		}
+		sort.Strings(changes)
+		if len(changes) > 0 {
+			logrus.Infof("%s: %s", name, strings.Join(changes, ", "))
+		}
+	}
+}
+
+// write writes the report to a JSON file. If the report is empty, a report
+// left by an earlier merge is removed instead.
+func (r *transformReport) write(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Worlds) == 0 {
+		if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// blockState returns a block palette entry for the block name with the states
+// passed, which may be nil.
+func blockState(name string, states map[string]any) map[string]any {
+	if states == nil {
+		states = map[string]any{}
+	}
+	return map[string]any{"name": name, "states": states, "version": chunk.CurrentBlockVersion}
+}
+
+// rewritePalettes passes every block palette entry of the serialised sub
+// chunk data to f, together with the index of its storage and its index in
+// the palette. If f returns a non-nil entry, it replaces the original one.
+// Only the palettes are decoded, the block indices are copied as they are.
+// Sub chunks in the old formats without palettes are returned unchanged, as
+// is data if f didn't replace any entry.
+func rewritePalettes(data []byte, f func(layer, i int, m map[string]any) map[string]any) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	head, storages, rest, ok, err := readSubChunk(data)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return data, nil
+	}
+
+	out := append(make([]byte, 0, len(data)), head...)
+	changed := false
+	for i, st := range storages {
+		out = append(out, st.header...)
+		for j, m := range st.entries {
+			replacement := f(i, j, m)
+			if replacement == nil {
+				out = append(out, st.palette[j]...)
+				continue
+			}
+			b, err := nbt.MarshalEncoding(replacement, nbt.LittleEndian)
+			if err != nil {
+				return nil, fmt.Errorf("storage %d: palette entry %d: %w", i, j, err)
+			}
+			out, changed = append(out, b...), true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return append(out, rest...), nil
+}
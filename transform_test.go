@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// TestTransformBlockEntities checks that the block entities of blocks
+// replaced with a block without a block entity are dropped, while those of
+// blocks that keep one are kept.
+func TestTransformBlockEntities(t *testing.T) {
+	// Every block is at x=i, y=1, z=0 of the sub chunk at y=2.
+	blocks := []string{"minecraft:command_block", "minecraft:chest", "addon:crate", "minecraft:barrel"}
+	b := newRawLayerBuilder()
+	for i := 0; i < 4096; i++ {
+		b.set(i, airEntry, true)
+	}
+	for i, name := range blocks {
+		e, err := nbt.MarshalEncoding(blockState(name, nil), nbt.LittleEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.set(i<<8|1, e, false)
+	}
+	data := (&rawSubChunk{layers: []rawLayer{b.l}}).encode(2)
+
+	rules := blockMapping{
+		{From: blockPattern{Name: "minecraft:command_block"}, To: blockPattern{Name: "minecraft:stone"}},
+		{From: blockPattern{Name: "minecraft:chest"}, To: blockPattern{Name: "minecraft:trapped_chest"}},
+	}
+	registry := &addonRegistry{blocks: map[string]bool{}, entities: map[string]bool{}}
+	for _, c := range []struct {
+		name    string
+		tr      *transform
+		dropped []string
+	}{
+		{"mapping", &transform{blocks: rules, unknown: unknownNone}, []string{"minecraft:command_block"}},
+		{"unknown report", &transform{unknown: unknownReport, registry: registry}, nil},
+		{"unknown drop", &transform{unknown: unknownDrop, registry: registry}, []string{"addon:crate"}},
+		{"unknown placeholder", &transform{unknown: unknownPlaceholder, placeholder: "minecraft:stone", registry: registry}, []string{"addon:crate"}},
+		{"mapping and drop", &transform{blocks: rules, unknown: unknownDrop, registry: registry}, []string{"minecraft:command_block", "addon:crate"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.tr.report = &transformReport{}
+			wt := c.tr.forWorld("w")
+			k := iterKey{pos: world.ChunkPos{3, -1}, dim: world.Overworld}
+			if _, err := wt.subChunk(k, 2, data); err != nil {
+				t.Fatal(err)
+			}
+			dropped := map[string]bool{}
+			for _, name := range c.dropped {
+				dropped[name] = true
+			}
+			for i, name := range blocks {
+				m := map[string]any{"id": name, "x": int32(3*16 + i), "y": int32(2*16 + 1), "z": int32(-16)}
+				if kept := wt.blockEntity(k, m); kept == dropped[name] {
+					t.Errorf("block entity of %s kept: %v, want %v", name, kept, !dropped[name])
+				}
+			}
+			// A block entity of another chunk isn't affected.
+			other := iterKey{pos: world.ChunkPos{4, -1}, dim: world.Overworld}
+			if !wt.blockEntity(other, map[string]any{"x": int32(4 * 16), "y": int32(2*16 + 1), "z": int32(-16)}) {
+				t.Errorf("block entity of another chunk was dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// errUnsafePath is returned for an entry whose name would be extracted
+	// outside of the target folder.
+	errUnsafePath = errors.New("unsafe path")
+	// errTooLarge is returned when an archive exceeds one of its zipLimits.
+	errTooLarge = errors.New("archive too large")
+	// errUnsupportedEntry is returned for entries that aren't regular files or
+	// folders, such as symlinks.
+	errUnsupportedEntry = errors.New("unsupported entry type")
+)
+
+// zipError is an error that occurred while extracting an archive. Entry is
+// empty if the error isn't caused by a single entry.
+type zipError struct {
+	Archive string
+	Entry   string
+	Err     error
+}
+
+func (e *zipError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("%s: %v", e.Archive, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Archive, e.Entry, e.Err)
+}
+
+func (e *zipError) Unwrap() error {
+	return e.Err
+}
+
+// zipLimits bound what is extracted from an archive, protecting against zip
+// bombs. The sizes are counted as the data is extracted, so archives with
+// wrong sizes in their headers are caught as well.
+type zipLimits struct {
+	// MaxEntries is the largest number of entries in an archive.
+	MaxEntries int
+	// MaxFileSize is the largest size of a single extracted file, and
+	// MaxTotalSize the largest size of all extracted files together.
+	MaxFileSize  int64
+	MaxTotalSize int64
+	// MaxRatio is the largest ratio of the extracted to the compressed size
+	// of a file. Files smaller than 1 MiB are not checked, as they compress
+	// well without being a threat.
+	MaxRatio int64
+}
+
+// defaultZipLimits are generous limits for the worlds players upload. A world
+// larger than this is better merged from a folder.
+var defaultZipLimits = zipLimits{
+	MaxEntries:   100_000,
+	MaxFileSize:  4 << 30,
+	MaxTotalSize: 16 << 30,
+	MaxRatio:     200,
+}
+
+// UnpackZip extracts the entries of the archive filename for which filterFn
+// returns true into unpackFolder. Entries with names that would be extracted
+// outside of unpackFolder are rejected, as are archives exceeding limits. The
+// CRC-32 of every extracted file is checked. All errors are of type *zipError.
+func UnpackZip(filename, unpackFolder string, filterFn func(string) bool, limits zipLimits) error {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return &zipError{Archive: filename, Err: err}
+	}
+	defer zr.Close()
+	if len(zr.File) > limits.MaxEntries {
+		return &zipError{Archive: filename, Err: fmt.Errorf("%w: %d entries", errTooLarge, len(zr.File))}
+	}
+
+	var total int64
+	for _, srcFile := range zr.File {
+		name, err := entryPath(srcFile.Name)
+		if err != nil {
+			return &zipError{Archive: filename, Entry: srcFile.Name, Err: err}
+		}
+		if !filterFn(name) {
+			continue
+		}
+		outPath := filepath.Join(unpackFolder, filepath.FromSlash(name))
+
+		switch mode := srcFile.Mode(); {
+		case mode.IsDir():
+			err = os.MkdirAll(outPath, 0o755)
+		case mode.IsRegular():
+			var n int64
+			n, err = extractFile(srcFile, outPath, limits, limits.MaxTotalSize-total)
+			total += n
+		default:
+			err = errUnsupportedEntry
+		}
+		if err != nil {
+			return &zipError{Archive: filename, Entry: srcFile.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// entryPath returns the cleaned, slash separated name of an archive entry. It
+// fails if the name is absolute or leaves the folder it is extracted into.
+// Backslashes are treated as separators, as written by some Windows tools, and
+// names with a colon, such as drive letters, are rejected on every platform.
+func entryPath(name string) (string, error) {
+	p := strings.ReplaceAll(name, `\`, "/")
+	if strings.ContainsRune(p, 0) || path.IsAbs(p) || filepath.VolumeName(p) != "" || strings.Contains(p, ":") {
+		return "", errUnsafePath
+	}
+	p = path.Clean(strings.TrimSuffix(p, "/"))
+	if p == "." || !filepath.IsLocal(filepath.FromSlash(p)) {
+		return "", errUnsafePath
+	}
+	return p, nil
+}
+
+// extractFile extracts a single file to outPath and returns the number of
+// bytes written. remaining is what is left of limits.MaxTotalSize.
+func extractFile(f *zip.File, outPath string, limits zipLimits, remaining int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := copyEntry(out, f, limits, remaining)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// copyEntry copies the content of the file f to w, failing if it is larger
+// than allowed by limits. remaining is what is left of limits.MaxTotalSize.
+func copyEntry(w io.Writer, f *zip.File, limits zipLimits, remaining int64) (int64, error) {
+	limit, reason := limits.MaxFileSize, "file size limit"
+	if remaining < limit {
+		limit, reason = remaining, "total size limit"
+	}
+	if f.UncompressedSize64 > uint64(limit) {
+		return 0, fmt.Errorf("%w: more than %d bytes (%s)", errTooLarge, limit, reason)
+	}
+	ratioLimit := int64(f.CompressedSize64) * limits.MaxRatio
+	if ratioLimit < 1<<20 {
+		ratioLimit = 1 << 20
+	}
+	if ratioLimit < limit {
+		limit, reason = ratioLimit, fmt.Sprintf("compression ratio limit of %d", limits.MaxRatio)
+	}
+	fr, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer fr.Close()
+
+	// Reading up to the end of the entry makes the reader check its CRC-32,
+	// one byte more than allowed is read to find out if the limit is exceeded.
+	n, err := io.Copy(w, io.LimitReader(fr, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("%w: more than %d bytes (%s)", errTooLarge, limit, reason)
+	}
+	return n, err
+}
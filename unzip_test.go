@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is an entry of an archive written by writeTestZip. If crc is not
+// zero, the entry is stored uncompressed with crc as its CRC-32.
+type testEntry struct {
+	name string
+	data []byte
+	crc  uint32
+}
+
+// writeTestZip writes an archive holding entries to a new file, which is
+// returned.
+func writeTestZip(t *testing.T, entries []testEntry) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		var w interface{ Write([]byte) (int, error) }
+		if e.crc != 0 {
+			w, err = zw.CreateRaw(&zip.FileHeader{
+				Name: e.name, Method: zip.Store, CRC32: e.crc,
+				CompressedSize64: uint64(len(e.data)), UncompressedSize64: uint64(len(e.data)),
+			})
+		} else {
+			w, err = zw.Create(e.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// TestUnpackZipRejects checks that unsafe entry names and archives exceeding
+// their limits are rejected with a *zipError, without writing anything outside
+// of the destination folder.
+func TestUnpackZipRejects(t *testing.T) {
+	small := []byte("level data")
+	limits := zipLimits{MaxEntries: 10, MaxFileSize: 4 << 20, MaxTotalSize: 6 << 20, MaxRatio: 200}
+	for _, c := range []struct {
+		name    string
+		entries []testEntry
+		limits  zipLimits
+		want    error
+	}{
+		{"traversal", []testEntry{{name: "../evil.txt", data: small}}, limits, errUnsafePath},
+		{"nested traversal", []testEntry{{name: "db/../../evil.txt", data: small}}, limits, errUnsafePath},
+		{"absolute", []testEntry{{name: "/evil.txt", data: small}}, limits, errUnsafePath},
+		{"backslash traversal", []testEntry{{name: `..\evil.txt`, data: small}}, limits, errUnsafePath},
+		{"backslash absolute", []testEntry{{name: `\evil.txt`, data: small}}, limits, errUnsafePath},
+		{"drive letter", []testEntry{{name: "C:/evil.txt", data: small}}, limits, errUnsafePath},
+		{"drive letter backslash", []testEntry{{name: `C:\evil.txt`, data: small}}, limits, errUnsafePath},
+		{"drive relative", []testEntry{{name: "C:evil.txt", data: small}}, limits, errUnsafePath},
+		{"entries", []testEntry{{name: "a", data: small}, {name: "b", data: small}}, zipLimits{MaxEntries: 1, MaxFileSize: 1 << 20, MaxTotalSize: 1 << 20, MaxRatio: 200}, errTooLarge},
+		{"file size", []testEntry{{name: "db/big", data: bytes.Repeat([]byte{1}, 5<<20)}}, limits, errTooLarge},
+		{"total size", []testEntry{{name: "db/a", data: bytes.Repeat([]byte{1}, 3<<20)}, {name: "db/b", data: bytes.Repeat([]byte{2}, 3<<20)}, {name: "db/c", data: bytes.Repeat([]byte{3}, 3<<20)}}, zipLimits{MaxEntries: 10, MaxFileSize: 4 << 20, MaxTotalSize: 8 << 20, MaxRatio: 10000}, errTooLarge},
+		{"ratio", []testEntry{{name: "db/zeros", data: make([]byte, 3<<20)}}, limits, errTooLarge},
+		{"crc", []testEntry{{name: "db/a", data: small, crc: crc32.ChecksumIEEE(small) + 1}}, limits, zip.ErrChecksum},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			filename := writeTestZip(t, c.entries)
+			base := t.TempDir()
+			dest := filepath.Join(base, "dest")
+			err := UnpackZip(filename, dest, func(string) bool { return true }, c.limits)
+
+			var zerr *zipError
+			if !errors.As(err, &zerr) {
+				t.Fatalf("error %v is not a *zipError", err)
+			}
+			if !errors.Is(err, c.want) {
+				t.Errorf("error %v, want %v", err, c.want)
+			}
+			err = filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if p != base && p != dest && !strings.HasPrefix(p, dest+string(filepath.Separator)) {
+					t.Errorf("%s was written outside of the destination", p)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestUnpackZip checks that safe entries, also with backslashes, are extracted
+// and that entries are filtered.
+func TestUnpackZip(t *testing.T) {
+	filename := writeTestZip(t, []testEntry{
+		{name: "level.dat", data: []byte("level")},
+		{name: `db\CURRENT`, data: []byte("MANIFEST-000001")},
+		{name: "skip/me", data: []byte("skipped")},
+	})
+	dest := t.TempDir()
+	err := UnpackZip(filename, dest, func(name string) bool { return !strings.HasPrefix(name, "skip/") }, defaultZipLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"level.dat": "level", "db/CURRENT": "MANIFEST-000001"} {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "skip")); !os.IsNotExist(err) {
+		t.Errorf("filtered entry was extracted: %v", err)
+	}
+}
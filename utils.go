@@ -1,76 +1,10 @@
 package main
 
 import (
-	"archive/zip"
-	"compress/flate"
-	"io"
-	"io/fs"
 	"os"
-	"path"
 	"path/filepath"
-
-	"github.com/sirupsen/logrus"
 )
 
-func UnpackZip(filename, unpackFolder string, filteFn func(string) bool) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	s, _ := f.Stat()
-	zr, _ := zip.NewReader(f, s.Size())
-	for _, srcFile := range zr.File {
-		srcName := filepath.ToSlash(srcFile.Name)
-		if !filteFn(srcName) {
-			continue
-		}
-
-		outPath := path.Join(unpackFolder, srcName)
-		if srcFile.Mode().IsDir() {
-			os.Mkdir(outPath, 0o755)
-		} else {
-			os.MkdirAll(path.Dir(outPath), 0o755)
-			fr, _ := srcFile.Open()
-			f, _ := os.Create(path.Join(unpackFolder, srcName))
-			f.Chmod(0775)
-			io.Copy(f, fr)
-			fr.Close()
-			f.Close()
-		}
-	}
-	return nil
-}
-
-func ZipFolder(filename, folder string) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	zw := zip.NewWriter(f)
-
-	// Register a custom Deflate compressor.
-	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.NoCompression)
-	})
-
-	err = filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
-		if !d.Type().IsDir() {
-			rel := path[len(folder)+1:]
-			zwf, _ := zw.Create(rel)
-			data, err := os.ReadFile(path)
-			if err != nil {
-				logrus.Error(err)
-			}
-			zwf.Write(data)
-		}
-		return nil
-	})
-	zw.Close()
-	f.Close()
-	return err
-}
-
 // ChunkPos is the position of a chunk. It is composed of two integers and is written as two varint32s.
 type ChunkPos [2]int32
 
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+)
+
+// worldBorder is the largest absolute block coordinate of the Bedrock world
+// border.
+const worldBorder = 30_000_000
+
+// placement is the absolute rectangle covered by a world or group after
+// layout. Coordinates are chunk coordinates held in int64 so that offsets
+// that overflow int32 can be detected, max is exclusive.
+type placement struct {
+	path     string
+	min, max [2]int64
+}
+
+func (p placement) overlaps(o placement) bool {
+	return p.min[0] < o.max[0] && o.min[0] < p.max[0] && p.min[1] < o.max[1] && o.min[1] < p.max[1]
+}
+
+func (p placement) contains(o placement) bool {
+	return o.min[0] >= p.min[0] && o.max[0] <= p.max[0] && o.min[1] >= p.min[1] && o.max[1] <= p.max[1]
+}
+
+func (p placement) String() string {
+	return fmt.Sprintf("%s [%d %d]-[%d %d]", p.path, p.min[0], p.min[1], p.max[0], p.max[1])
+}
+
+// layoutProblem is a problem found by validateLayout.
+type layoutProblem struct {
+	// fixable is true for problems that fixLayout is able to resolve, which
+	// are overlaps.
+	fixable bool
+	msg     string
+}
+
+// validateLayout checks that no two worlds or groups with the same parent
+// overlap, that every item lies within its parent group, and that all chunks
+// of all worlds end up within the world border and within int32 coordinates.
+// Overlaps are not reported if allowOverlaps is true.
+func validateLayout(root *mapGroup, allowOverlaps bool) []layoutProblem {
+	var problems []layoutProblem
+	validateGroup(root, "", [2]int64{}, allowOverlaps, &problems)
+	return problems
+}
+
+func validateGroup(g *mapGroup, groupPath string, base [2]int64, allowOverlaps bool, problems *[]layoutProblem) placement {
+	self := itemPlacement(g, groupPath, base)
+	var children []placement
+	for _, name := range sortedKeys(g.groups) {
+		children = append(children, validateGroup(g.groups[name], path.Join(groupPath, name), self.min, allowOverlaps, problems))
+	}
+	for _, name := range sortedKeys(g.worlds) {
+		p := itemPlacement(g.worlds[name], path.Join(groupPath, name), self.min)
+		children = append(children, p)
+		validateRange(p, problems)
+	}
+
+	for i, a := range children {
+		if !self.contains(a) {
+			// fixLayout only moves children apart, which doesn't bring them
+			// back into their group.
+			*problems = append(*problems, layoutProblem{msg: fmt.Sprintf("%v is outside of its group %v", a, self)})
+		}
+		if allowOverlaps {
+			continue
+		}
+		for _, b := range children[i+1:] {
+			if a.overlaps(b) {
+				*problems = append(*problems, layoutProblem{fixable: true, msg: fmt.Sprintf("%v overlaps %v", a, b)})
+			}
+		}
+	}
+	return self
+}
+
+// validateRange checks that every block of a world is within the world border
+// and that its chunk and block coordinates fit in an int32.
+func validateRange(p placement, problems *[]layoutProblem) {
+	for _, v := range [...]int64{p.min[0], p.min[1], p.max[0] - 1, p.max[1] - 1} {
+		switch {
+		case v*16 < math.MinInt32 || v*16+15 > math.MaxInt32:
+			*problems = append(*problems, layoutProblem{msg: fmt.Sprintf("%v overflows int32 block coordinates", p)})
+			return
+		case v*16 < -worldBorder || v*16+15 > worldBorder:
+			*problems = append(*problems, layoutProblem{msg: fmt.Sprintf("%v is outside of the world border of ±%d blocks", p, worldBorder)})
+			return
+		}
+	}
+}
+
+func itemPlacement(item layoutItem, itemPath string, base [2]int64) placement {
+	offset, size := item.getOffset(), item.BoundsTotal()
+	p := placement{path: itemPath}
+	p.min = [2]int64{base[0] + int64(offset[0]), base[1] + int64(offset[1])}
+	p.max = [2]int64{p.min[0] + int64(size[0]), p.min[1] + int64(size[1])}
+	if itemPath == "" {
+		p.path = "/"
+	}
+	return p
+}
+
+// fixLayout moves apart all worlds and groups that overlap, growing their
+// parent groups to fit. It returns the number of items moved.
+func fixLayout(g *mapGroup, padding int32) int {
+	moved := 0
+	var children []layoutItem
+	for _, name := range sortedKeys(g.groups) {
+		moved += fixLayout(g.groups[name], padding)
+		children = append(children, g.groups[name])
+	}
+	for _, name := range sortedKeys(g.worlds) {
+		children = append(children, g.worlds[name])
+	}
+
+	// Every child is moved along the X axis until it no longer overlaps any
+	// of the children placed before it.
+	for i, child := range children {
+		for {
+			p := itemPlacement(child, "", [2]int64{})
+			right, overlapping := int64(0), false
+			for _, other := range children[:i] {
+				o := itemPlacement(other, "", [2]int64{})
+				if p.overlaps(o) {
+					overlapping = true
+					if o.max[0] > right {
+						right = o.max[0]
+					}
+				}
+			}
+			if !overlapping {
+				break
+			}
+			child.setOffset(ChunkPos{int32(right) + padding, child.getOffset().Z()})
+			moved++
+		}
+	}
+
+	// Make the group cover all of its children again.
+	for _, child := range children {
+		p := itemPlacement(child, "", [2]int64{})
+		if int32(p.max[0]) > g.size[0] {
+			g.size[0] = int32(p.max[0])
+		}
+		if int32(p.max[1]) > g.size[1] {
+			g.size[1] = int32(p.max[1])
+		}
+	}
+	return moved
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testGroup returns a group holding a world of the given size at every
+// offset in offsets, named by their index.
+func testGroup(size ChunkPos, offsets ...ChunkPos) *mapGroup {
+	g := &mapGroup{worlds: make(map[string]*worldMap), groups: make(map[string]*mapGroup)}
+	for i, o := range offsets {
+		name := string(rune('a' + i))
+		g.worlds[name] = &worldMap{Name: name, boundsMax: size.Sub(ChunkPos{1, 1}), offsetFromParent: o}
+		if end := o.Add(size); end.X() > g.size.X() || end.Z() > g.size.Z() {
+			g.size = ChunkPos{maxInt32(g.size.X(), end.X()), maxInt32(g.size.Z(), end.Z())}
+		}
+	}
+	return g
+}
+
+// testRoot returns a root group holding only the group g, covering it.
+func testRoot(g *mapGroup) *mapGroup {
+	return &mapGroup{groups: map[string]*mapGroup{"g": g}, size: g.offsetFromParent.Add(g.size)}
+}
+
+// TestValidateLayout checks the problems found in layouts with overlapping
+// worlds, worlds outside of their group and worlds out of range.
+func TestValidateLayout(t *testing.T) {
+	tests := []struct {
+		name          string
+		root          func() *mapGroup
+		allowOverlaps bool
+		// want holds a part of the message of every problem expected, and
+		// fixable whether they are fixable.
+		want    []string
+		fixable bool
+	}{
+		{"valid", func() *mapGroup {
+			return testRoot(testGroup(ChunkPos{4, 4}, ChunkPos{0, 0}, ChunkPos{5, 0}))
+		}, false, nil, false},
+		{"overlap", func() *mapGroup {
+			return testRoot(testGroup(ChunkPos{4, 4}, ChunkPos{0, 0}, ChunkPos{3, 3}))
+		}, false, []string{"g/a [0 0]-[4 4] overlaps g/b [3 3]-[7 7]"}, true},
+		{"allowed overlap", func() *mapGroup {
+			return testRoot(testGroup(ChunkPos{4, 4}, ChunkPos{0, 0}, ChunkPos{3, 3}))
+		}, true, nil, false},
+		{"outside of group", func() *mapGroup {
+			g := testGroup(ChunkPos{4, 4}, ChunkPos{0, 0})
+			g.worlds["a"].offsetFromParent = ChunkPos{-2, 0}
+			return testRoot(g)
+		}, false, []string{"is outside of its group"}, false},
+		{"world border", func() *mapGroup {
+			g := testGroup(ChunkPos{4, 4}, ChunkPos{0, 0})
+			g.offsetFromParent = ChunkPos{worldBorder / 16, 0}
+			return testRoot(g)
+		}, false, []string{"outside of the world border"}, false},
+		{"int32", func() *mapGroup {
+			g := testGroup(ChunkPos{4, 4}, ChunkPos{0, 0})
+			g.offsetFromParent = ChunkPos{1 << 30, 0}
+			return testRoot(g)
+		}, false, []string{"overflows int32"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := validateLayout(tt.root(), tt.allowOverlaps)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("found %d problems, want %d: %v", len(problems), len(tt.want), problems)
+			}
+			for i, p := range problems {
+				if !strings.Contains(p.msg, tt.want[i]) {
+					t.Errorf("problem %q doesn't contain %q", p.msg, tt.want[i])
+				}
+				if p.fixable != tt.fixable {
+					t.Errorf("problem %q is fixable: %v, want %v", p.msg, p.fixable, tt.fixable)
+				}
+			}
+		})
+	}
+}
+
+// TestFixLayout checks that fixLayout moves overlapping worlds apart and
+// grows their group to fit.
+func TestFixLayout(t *testing.T) {
+	g := testGroup(ChunkPos{4, 4}, ChunkPos{0, 0}, ChunkPos{2, 1}, ChunkPos{3, 0})
+	root := testRoot(g)
+	if moved := fixLayout(root, 1); moved != 2 {
+		t.Errorf("moved %d worlds, want 2", moved)
+	}
+	if problems := validateLayout(root, false); len(problems) != 0 {
+		t.Errorf("layout has problems after fixing it: %v", problems)
+	}
+	if g.size != (ChunkPos{14, 5}) {
+		t.Errorf("group has size %v after fixing it, want [14 5]", g.size)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/util"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyProblem is a chunk of the merged world that doesn't match the chunk of
+// the source world it was copied from.
+type verifyProblem struct {
+	World  string
+	Dim    string
+	Source ChunkPos
+	Output ChunkPos
+	Reason string
+}
+
+// verifyStats counts the chunks checked by the verify subcommand.
+type verifyStats struct {
+	Worlds, Checked, Missing, Mismatched int
+	// Conflicted are chunks claimed by more than one world, which were merged
+	// or taken from one of them and so aren't compared.
+	Conflicted int
+	Problems   []verifyProblem
+}
+
+// runVerify runs the verify subcommand, which compares the chunks of a merged
+// world with the chunks of the source worlds listed in its map.json.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	mapFile := fs.String("map", "map.json", "map.json written by the merge")
+	sample := fs.Int("sample", 64, "number of chunks compared per world, 0 to compare every chunk")
+	seed := fs.Int64("seed", 1, "seed used to pick the sampled chunks")
+	maxProblems := fs.Int("max-problems", 100, "number of problems listed, all of them are counted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: WorldMerge.exe verify [flags] <world folder>")
+		fmt.Fprintln(fs.Output(), "The sources listed in map.json are read relative to the current folder, as during the merge.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(*mapFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	var m mapJson
+	if err := json.Unmarshal(data, &m); err != nil {
+		logrus.Fatalf("%s: %v", *mapFile, err)
+	}
+	out, err := openReadOnly(fs.Arg(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer out.Close()
+
+	stats, err := verifyMerge(m, out.LDB(), *sample, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for i, p := range stats.Problems {
+		if i == *maxProblems {
+			fmt.Printf("... %d more\n", len(stats.Problems)-i)
+			break
+		}
+		fmt.Printf("%s: %s chunk %v (output %v): %s\n", p.World, p.Dim, p.Source, p.Output, p.Reason)
+	}
+	fmt.Printf("%d worlds, %d chunks checked, %d missing, %d mismatched, %d skipped as conflicts\n",
+		stats.Worlds, stats.Checked, stats.Missing, stats.Mismatched, stats.Conflicted)
+	if len(stats.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyWorld is a world listed in map.json, with the chunks it holds.
+type verifyWorld struct {
+	path   string
+	json   worldJson
+	entry  string
+	hash   string
+	offset ChunkPos
+	chunks []iterKey
+}
+
+// verifyMerge compares up to sample chunks of every world in m, or all of them
+// if sample is 0, with the chunks in out.
+func verifyMerge(m mapJson, out *leveldb.DB, sample int, r *rand.Rand) (*verifyStats, error) {
+	var worlds []*verifyWorld
+	var collect func(g groupJson, groupPath string)
+	collect = func(g groupJson, groupPath string) {
+		for _, name := range sortedKeys(g.Worlds) {
+			worlds = append(worlds, &verifyWorld{path: groupPath + "/" + name, json: g.Worlds[name]})
+		}
+		for _, name := range sortedKeys(g.Groups) {
+			collect(g.Groups[name], groupPath+"/"+name)
+		}
+	}
+	for _, name := range sortedKeys(m.Groups) {
+		collect(m.Groups[name], name)
+	}
+
+	// Find the chunks of all worlds first, so that chunks written by more than
+	// one world are known before any chunk is compared.
+	claims := make(map[iterKey]int)
+	for _, w := range worlds {
+		if err := w.load(); err != nil {
+			return nil, fmt.Errorf("%s: %w", w.path, err)
+		}
+		for _, k := range w.chunks {
+			claims[iterKey{pos: world.ChunkPos(w.offset.Add(k.pos)), dim: k.dim}]++
+		}
+	}
+
+	if m.Transform.blocksChanged() {
+		logrus.Info("Blocks were replaced by the merge, sub chunks are not compared and block entities may be missing")
+	}
+	if m.Transform.entitiesChanged() {
+		logrus.Info("Entities were dropped by the merge, entities may be missing")
+	}
+	stats := &verifyStats{Worlds: len(worlds)}
+	for _, w := range worlds {
+		logrus.Infof("Verifying %s", w.path)
+		if err := w.verify(out, claims, sample, r, m.Transform, stats); err != nil {
+			return nil, fmt.Errorf("%s: %w", w.path, err)
+		}
+	}
+	return stats, nil
+}
+
+// load finds the chunks of w, reading the world from its source archive.
+func (w *verifyWorld) load() error {
+	stat, err := os.Stat(filepath.FromSlash(w.json.Source))
+	if err != nil {
+		return err
+	}
+	if w.entry, w.hash, err = cacheEntry(w.json.Source); err != nil {
+		return err
+	}
+	if w.hash != w.json.SourceHash {
+		return fmt.Errorf("%s changed since the merge", w.json.Source)
+	}
+	manifest, err := loadManifest(w.entry, stat)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		if manifest, err = scanWorld(w.json.Source, w.entry, true, stat, w.hash); err != nil {
+			return err
+		}
+	}
+	// The offset that was added to every chunk, as in worldMap.chunkOffset.
+	w.offset = w.json.OffsetAbsolute.Sub(w.json.BoundsMin)
+	for k := range manifest.index() {
+		w.chunks = append(w.chunks, k)
+	}
+	sort.Slice(w.chunks, func(i, j int) bool {
+		a, b := w.chunks[i], w.chunks[j]
+		ai, _ := world.DimensionID(a.dim)
+		bi, _ := world.DimensionID(b.dim)
+		if ai != bi {
+			return ai < bi
+		}
+		if a.pos[0] != b.pos[0] {
+			return a.pos[0] < b.pos[0]
+		}
+		return a.pos[1] < b.pos[1]
+	})
+	return nil
+}
+
+// verify compares the chunks of w with out, adding the result to stats. tr is
+// the transform the merge applied to the chunks, which may be nil.
+func (w *verifyWorld) verify(out *leveldb.DB, claims map[iterKey]int, sample int, r *rand.Rand, tr *transformJson, stats *verifyStats) error {
+	chunks := w.chunks
+	if sample > 0 && sample < len(chunks) {
+		picked := make([]iterKey, 0, sample)
+		for _, i := range r.Perm(len(chunks))[:sample] {
+			picked = append(picked, chunks[i])
+		}
+		chunks = picked
+	}
+
+	src, err := openWorld(w.json.Source, "", true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	for _, k := range chunks {
+		outK := iterKey{pos: world.ChunkPos(w.offset.Add(k.pos)), dim: k.dim}
+		if claims[outK] > 1 {
+			stats.Conflicted++
+			continue
+		}
+		stats.Checked++
+		reason, err := compareChunk(src.LDB(), out, k, outK, w.offset, tr)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			continue
+		}
+		if reason == "missing" {
+			stats.Missing++
+		} else {
+			stats.Mismatched++
+		}
+		stats.Problems = append(stats.Problems, verifyProblem{
+			World:  w.path,
+			Dim:    fmt.Sprint(k.dim),
+			Source: ChunkPos(k.pos),
+			Output: ChunkPos(outK.pos),
+			Reason: reason,
+		})
+	}
+	return nil
+}
+
+// compareChunk compares the chunk k of src with the chunk outK of out, which
+// it was copied to moved by offset and changed by the transform tr, which may
+// be nil. Parts of the chunk the transform may have changed are only checked
+// for what it can't have changed. It returns why the chunks don't match, or
+// an empty string if they do.
+func compareChunk(src, out *leveldb.DB, k, outK iterKey, offset ChunkPos, tr *transformJson) (string, error) {
+	srcKeys, err := chunkKeys(src, k)
+	if err != nil {
+		return "", err
+	}
+	outKeys, err := chunkKeys(out, outK)
+	if err != nil {
+		return "", err
+	}
+	_, hasVersion := outKeys[string([]byte{keyVersion})]
+	_, hasVersionOld := outKeys[string([]byte{keyVersionOld})]
+	if !hasVersion && !hasVersionOld {
+		return "missing", nil
+	}
+
+	for tag, value := range srcKeys {
+		if tag[0] != keySubChunkData {
+			continue
+		}
+		if outValue, ok := outKeys[tag]; !ok {
+			return fmt.Sprintf("sub chunk %d missing", int8(tag[1])), nil
+		} else if !tr.blocksChanged() && !bytes.Equal(value, outValue) {
+			return fmt.Sprintf("sub chunk %d differs", int8(tag[1])), nil
+		}
+	}
+	for tag := range outKeys {
+		if _, ok := srcKeys[tag]; tag[0] == keySubChunkData && !ok {
+			return fmt.Sprintf("unexpected sub chunk %d", int8(tag[1])), nil
+		}
+	}
+
+	biomes := func(keys map[string][]byte) []byte {
+		if data := keys[string([]byte{key3DData})]; len(data) > 512 {
+			return data[512:]
+		}
+		return nil
+	}
+	if !bytes.Equal(biomes(srcKeys), biomes(outKeys)) {
+		return "biomes differ", nil
+	}
+
+	srcBlockEntities, err := nbtPositions(srcKeys[string([]byte{keyBlockEntities})], blockEntityPos, offset)
+	if err != nil {
+		return "", fmt.Errorf("chunk %v: block entities: %w", k.pos, err)
+	}
+	outBlockEntities, err := nbtPositions(outKeys[string([]byte{keyBlockEntities})], blockEntityPos, ChunkPos{})
+	if err != nil {
+		return fmt.Sprintf("block entities: %v", err), nil
+	}
+	if reason := comparePositions("block entities", srcBlockEntities, outBlockEntities, tr.blocksChanged()); reason != "" {
+		return reason, nil
+	}
+
+	srcEntities, err := chunkEntities(src, k, srcKeys, offset)
+	if err != nil {
+		return "", fmt.Errorf("chunk %v: entities: %w", k.pos, err)
+	}
+	outEntities, err := chunkEntities(out, outK, outKeys, ChunkPos{})
+	if err != nil {
+		return fmt.Sprintf("entities: %v", err), nil
+	}
+	return comparePositions("entities", srcEntities, outEntities, tr.entitiesChanged()), nil
+}
+
+// chunkKeys returns the values of all keys of the chunk k in db, by the part of
+// the key that follows the chunk index.
+func chunkKeys(db *leveldb.DB, k iterKey) (map[string][]byte, error) {
+	index := key_index(k.pos, k.dim)
+	keys := make(map[string][]byte)
+	iter := db.NewIterator(util.BytesPrefix(index), nil)
+	defer iter.Release()
+	for iter.Next() {
+		// The index of an overworld chunk is a prefix of the index of the chunk
+		// at the same position in the other dimensions.
+		if _, n, ok := parseChunkKey(iter.Key()); ok && n == len(index) {
+			keys[string(iter.Key()[n:])] = append([]byte(nil), iter.Value()...)
+		}
+	}
+	return keys, iter.Error()
+}
+
+// chunkEntities returns the positions of the entities of the chunk k, both
+// those stored in the chunk and those in actor storage, moved by offset.
+func chunkEntities(db *leveldb.DB, k iterKey, keys map[string][]byte, offset ChunkPos) ([]string, error) {
+	positions, err := nbtPositions(keys[string([]byte{keyEntities})], entityPos, offset)
+	if err != nil {
+		return nil, err
+	}
+	digp, err := db.Get(append([]byte(keyActorDigest), key_index(k.pos, k.dim)...), nil)
+	if err == leveldb.ErrNotFound {
+		return positions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i := 0; i+8 <= len(digp); i += 8 {
+		data, err := db.Get(append([]byte(keyActorPrefix), digp[i:i+8]...), nil)
+		if err == leveldb.ErrNotFound {
+			positions = append(positions, fmt.Sprintf("missing actor %x", digp[i:i+8]))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		p, err := nbtPositions(data, entityPos, offset)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, p...)
+	}
+	return positions, nil
+}
+
+// nbtPositions decodes the NBT compound tags appended to each other in data
+// and returns the identifier and position of each, moved by offset, as given by
+// pos. Tags pos returns an empty string for are left out.
+func nbtPositions(data []byte, pos func(m map[string]any, offset ChunkPos) string, offset ChunkPos) ([]string, error) {
+	var positions []string
+	_, err := rewriteNBT(data, func(m map[string]any) bool {
+		if p := pos(m, offset); p != "" {
+			positions = append(positions, p)
+		}
+		return true
+	})
+	return positions, err
+}
+
+// blockEntityPos returns the ID and position of a block entity moved by
+// offset.
+func blockEntityPos(m map[string]any, offset ChunkPos) string {
+	x, _ := m["x"].(int32)
+	y, _ := m["y"].(int32)
+	z, _ := m["z"].(int32)
+	return fmt.Sprintf("%v %d %d %d", m["id"], x+offset.X()*16, y, z+offset.Z()*16)
+}
+
+// entityPos returns the identifier and position of an entity moved by offset.
+// The position is moved the same way as by moveEntity. Entities without a
+// valid position aren't copied and return an empty string.
+func entityPos(m map[string]any, offset ChunkPos) string {
+	if _, err := moveEntity(m, offset); err != nil {
+		return ""
+	}
+	// Positions are stored as float32 and printed as such to keep them short.
+	e, _ := decodeEntityNBT(m)
+	return fmt.Sprintf("%v %g %g %g", m["identifier"], float32(e.Pos[0]), float32(e.Pos[1]), float32(e.Pos[2]))
+}
+
+// comparePositions compares the positions expected in a chunk with those
+// found in it, ignoring their order. With dropped set, positions may be
+// missing, but every position found must still be expected.
+func comparePositions(what string, expected, found []string, dropped bool) string {
+	if dropped {
+		left := make(map[string]int, len(expected))
+		for _, p := range expected {
+			left[p]++
+		}
+		for _, p := range found {
+			if left[p] == 0 {
+				return fmt.Sprintf("unexpected %s: %q", what, p)
+			}
+			left[p]--
+		}
+		return ""
+	}
+	if len(expected) != len(found) {
+		return fmt.Sprintf("%d %s, expected %d", len(found), what, len(expected))
+	}
+	sort.Strings(expected)
+	sort.Strings(found)
+	for i := range expected {
+		if expected[i] != found[i] {
+			return fmt.Sprintf("%s differ: %q, expected %q", what, found[i], expected[i])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/goleveldb/leveldb/util"
+)
+
+// TestVerifyTransform checks that verify accepts chunks changed by the
+// transform recorded in map.json, and reports them without it.
+func TestVerifyTransform(t *testing.T) {
+	in := writeTestWorlds(t, []testWorld{{"g/a", "minecraft:iron_block", ChunkPos{0, 0}, 2}})
+	root, conflicts := loadTestWorlds(t, in, modeGrid, conflictFirst)
+	tr := &transform{
+		blocks:  blockMapping{{From: blockPattern{Name: "minecraft:iron_block"}, To: blockPattern{Name: "minecraft:emerald_block"}}},
+		unknown: unknownNone,
+		report:  &transformReport{},
+	}
+	m, err := writeGroupToJSON(root, modeGrid, &transformJson{ReplaceBlocks: "hash"}, filepath.Join(t.TempDir(), "map.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mergeTestWorlds(t, root, conflicts, conflictFirst, tr)
+
+	stats, err := verifyMerge(m, db.LDB(), 0, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 4 || len(stats.Problems) != 0 {
+		t.Errorf("checked %d chunks with problems %+v, want 4 without problems", stats.Checked, stats.Problems)
+	}
+
+	m.Transform = nil
+	if stats, err = verifyMerge(m, db.LDB(), 0, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mismatched != 4 {
+		t.Errorf("%d chunks mismatched without the transform, want 4", stats.Mismatched)
+	}
+}
+
+// TestComparePositions checks that positions may only be missing if the
+// transform dropped some.
+func TestComparePositions(t *testing.T) {
+	expected := []string{"minecraft:pig 1 2 3", "minecraft:pig 1 2 3", "minecraft:cow 4 5 6"}
+	for _, c := range []struct {
+		name    string
+		found   []string
+		dropped bool
+		ok      bool
+	}{
+		{"same", []string{"minecraft:cow 4 5 6", "minecraft:pig 1 2 3", "minecraft:pig 1 2 3"}, false, true},
+		{"missing", []string{"minecraft:pig 1 2 3", "minecraft:pig 1 2 3"}, false, false},
+		{"moved", []string{"minecraft:pig 1 2 3", "minecraft:pig 1 2 3", "minecraft:cow 4 5 7"}, false, false},
+		{"dropped", []string{"minecraft:pig 1 2 3"}, true, true},
+		{"dropped all", nil, true, true},
+		{"dropped and moved", []string{"minecraft:cow 4 5 7"}, true, false},
+		{"dropped and duplicated", []string{"minecraft:cow 4 5 6", "minecraft:cow 4 5 6"}, true, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			reason := comparePositions("entities", append([]string(nil), expected...), c.found, c.dropped)
+			if (reason == "") != c.ok {
+				t.Errorf("reason %q, want match %v", reason, c.ok)
+			}
+		})
+	}
+}
+
+// TestVerifyMerge checks that verify accepts a plain merge and reports chunks
+// removed from or changed in the output afterwards.
+func TestVerifyMerge(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds)
+	root, conflicts := loadTestWorlds(t, in, modeGrid, conflictFirst)
+	m, err := writeGroupToJSON(root, modeGrid, nil, filepath.Join(t.TempDir(), "map.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mergeTestWorlds(t, root, conflicts, conflictFirst, nil)
+
+	var total int
+	for _, tw := range testWorlds {
+		total += int(tw.size * tw.size)
+	}
+	stats, err := verifyMerge(m, db.LDB(), 0, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Worlds != len(testWorlds) || stats.Checked != total || len(stats.Problems) != 0 {
+		t.Errorf("verified %d worlds, %d chunks with problems %+v, want %d worlds, %d chunks without problems", stats.Worlds, stats.Checked, stats.Problems, len(testWorlds), total)
+	}
+	if stats, err = verifyMerge(m, db.LDB(), 2, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 2*len(testWorlds) {
+		t.Errorf("checked %d chunks sampling 2 per world, want %d", stats.Checked, 2*len(testWorlds))
+	}
+
+	// Remove the first chunk of one world and change the first chunk of
+	// another.
+	worlds := mapWorlds(m.Groups["root"], "", nil)
+	removed := world.ChunkPos(worlds[testWorlds[0].name].OffsetAbsolute)
+	changed := world.ChunkPos(worlds[testWorlds[3].name].OffsetAbsolute)
+	ldb := db.LDB()
+	it := ldb.NewIterator(util.BytesPrefix(key_index(removed, world.Overworld)), nil)
+	for it.Next() {
+		if err := ldb.Delete(it.Key(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it.Release()
+	if err := ldb.Put(append(key_index(changed, world.Overworld), keySubChunkData, 0), testSubChunk(t, "minecraft:stone", 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats, err = verifyMerge(m, db.LDB(), 0, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Missing != 1 || stats.Mismatched != 1 || len(stats.Problems) != 2 {
+		t.Fatalf("%d missing and %d mismatched chunks with problems %+v, want one of each", stats.Missing, stats.Mismatched, stats.Problems)
+	}
+	for _, p := range stats.Problems {
+		want := removed
+		if p.Reason != "missing" {
+			want = changed
+		}
+		if world.ChunkPos(p.Output) != want {
+			t.Errorf("problem %+v, want it at %v", p, want)
+		}
+	}
+}
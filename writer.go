@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/util"
+	"golang.org/x/sync/semaphore"
+)
+
+// recordKind is the kind of a chunkRecord.
+type recordKind uint8
+
+const (
+	// recordChunk holds the key/value pairs of a single chunk.
+	recordChunk recordKind = iota
+	// recordWorldDone is sent after the last chunk of a world.
+	recordWorldDone
+	// recordRollback asks the writer to delete every key it has written for
+	// the world.
+	recordRollback
+)
+
+// recordSize is the size at which a worldWriter sends its pairs to the
+// chunkWriter.
+const recordSize = 64 << 10
+
+// chunkRecord is sent from a worldWriter to the chunkWriter.
+type chunkRecord struct {
+	kind  recordKind
+	world string
+	batch *leveldb.Batch
+	// chunks is the number of chunks started in the record.
+	chunks int
+	// size is the number of bytes of memory reserved for the record.
+	size int64
+}
+
+// chunkWriter is the single goroutine writing to the output database. Worlds
+// are read concurrently and send their chunks to it as records, which are
+// collected into batches that are written once they grow over a threshold, or
+// once no more records are waiting.
+//
+// The total size of records that have been sent but not yet written is
+// limited, so that worlds are read only as fast as the output can be written.
+type chunkWriter struct {
+	db        *leveldb.DB
+	batchSize int
+	maxMemory int64
+	mem       *semaphore.Weighted
+	records   chan *chunkRecord
+	prog      *progress
+	errs      *errorCollector
+
+	batch    *leveldb.Batch
+	reserved int64
+	// current is the world of the record being replayed into batch.
+	current string
+	// journal holds what every world has written until it is done, it is nil
+	// if worlds are never rolled back.
+	journal map[string]*worldJournal
+
+	done chan struct{}
+}
+
+func newChunkWriter(db *leveldb.DB, batchSize int, maxMemory int64, prog *progress, errs *errorCollector) *chunkWriter {
+	w := &chunkWriter{
+		db:        db,
+		batchSize: batchSize,
+		maxMemory: maxMemory,
+		mem:       semaphore.NewWeighted(maxMemory),
+		records:   make(chan *chunkRecord, 64),
+		prog:      prog,
+		errs:      errs,
+		batch:     new(leveldb.Batch),
+		done:      make(chan struct{}),
+	}
+	if errs.policy == policySkipWorld {
+		w.journal = make(map[string]*worldJournal)
+	}
+	go w.run()
+	return w
+}
+
+// send passes a record to the writer, blocking while too much memory is in
+// use by records that haven't been written yet.
+func (w *chunkWriter) send(ctx context.Context, r *chunkRecord) error {
+	if r.batch != nil {
+		r.size = int64(len(r.batch.Dump()))
+	}
+	if r.size > w.maxMemory {
+		// A single record larger than the limit would never be sent.
+		r.size = w.maxMemory
+	}
+	if err := w.mem.Acquire(ctx, r.size); err != nil {
+		return err
+	}
+	w.records <- r
+	return nil
+}
+
+// Close waits for all records to be written. No records may be sent after
+// Close is called.
+func (w *chunkWriter) Close() {
+	close(w.records)
+	<-w.done
+}
+
+func (w *chunkWriter) run() {
+	defer close(w.done)
+	for {
+		var r *chunkRecord
+		var ok bool
+		select {
+		case r, ok = <-w.records:
+		default:
+			// No record is ready, the worlds may be waiting for the memory
+			// held by the current batch. Write it before waiting for more.
+			if err := w.flush(); err != nil {
+				w.errs.abort(fmt.Errorf("write output: %w", err))
+			}
+			r, ok = <-w.records
+		}
+		if !ok {
+			break
+		}
+		if err := w.handle(r); err != nil {
+			w.errs.abort(fmt.Errorf("write output: %w", err))
+		}
+	}
+	if err := w.flush(); err != nil {
+		w.errs.abort(fmt.Errorf("write output: %w", err))
+	}
+}
+
+func (w *chunkWriter) handle(r *chunkRecord) error {
+	w.reserved += r.size
+	switch r.kind {
+	case recordChunk:
+		if w.errs.Context().Err() != nil {
+			// The merge was stopped, drain the remaining records.
+			w.release()
+			return nil
+		}
+		w.current = r.world
+		if err := r.batch.Replay(w); err != nil {
+			return err
+		}
+		w.prog.addChunks(r.world, r.chunks, int(r.size))
+		if len(w.batch.Dump()) >= w.batchSize || w.reserved >= w.maxMemory {
+			return w.flush()
+		}
+	case recordWorldDone:
+		w.prog.worldDone(r.world)
+		// A finished world is never rolled back.
+		delete(w.journal, r.world)
+	case recordRollback:
+		if err := w.flush(); err != nil {
+			return err
+		}
+		if err := w.journal[r.world].rollback(w.db, w.batch); err != nil {
+			return err
+		}
+		delete(w.journal, r.world)
+		return w.flush()
+	}
+	return nil
+}
+
+// Put adds a key/value pair of a record to the current batch. It implements
+// leveldb.BatchReplay.
+func (w *chunkWriter) Put(key, value []byte) {
+	w.batch.Put(key, value)
+	w.record(key)
+}
+
+// Delete implements leveldb.BatchReplay. Worlds only delete keys they wrote
+// themselves, which are journaled like the keys they put.
+func (w *chunkWriter) Delete(key []byte) {
+	w.batch.Delete(key)
+	w.record(key)
+}
+
+// record adds key to the journal of the current world.
+func (w *chunkWriter) record(key []byte) {
+	if w.journal == nil {
+		return
+	}
+	j, ok := w.journal[w.current]
+	if !ok {
+		j = &worldJournal{chunks: make(map[string]struct{}), keys: make(map[string]struct{})}
+		w.journal[w.current] = j
+	}
+	j.add(key)
+}
+
+// flush writes the current batch and releases the memory of all records in
+// it. Once the merge was stopped, the batch is dropped instead.
+func (w *chunkWriter) flush() error {
+	if w.errs.Context().Err() != nil {
+		w.batch.Reset()
+		w.release()
+		return nil
+	}
+	if w.batch.Len() > 0 {
+		if err := w.db.Write(w.batch, nil); err != nil {
+			return err
+		}
+		w.batch.Reset()
+	}
+	w.release()
+	return nil
+}
+
+// release frees the memory reserved by all records handled so far.
+func (w *chunkWriter) release() {
+	w.mem.Release(w.reserved)
+	w.reserved = 0
+}
+
+// worldJournal is what a world wrote to the output, kept to roll it back. The
+// keys of chunks are recorded by the index of their chunk, which no other world
+// writes to, so that the journal grows with the number of chunks rather than
+// the number of keys.
+type worldJournal struct {
+	// chunks holds the index of every chunk with keys or an actor digest
+	// written, keys all other keys, such as those of actors.
+	chunks map[string]struct{}
+	keys   map[string]struct{}
+}
+
+// add records a key written or deleted.
+func (j *worldJournal) add(key []byte) {
+	if bytes.HasPrefix(key, []byte(keyActorDigest)) {
+		if idx := key[len(keyActorDigest):]; len(idx) == 8 || len(idx) == 12 {
+			j.chunks[string(idx)] = struct{}{}
+			return
+		}
+	}
+	if _, n, ok := parseChunkKey(key); ok {
+		j.chunks[string(key[:n])] = struct{}{}
+		return
+	}
+	j.keys[string(key)] = struct{}{}
+}
+
+// rollback adds the deletion of every key in the journal to batch, reading
+// the keys of the chunks from db. j may be nil if nothing was written.
+func (j *worldJournal) rollback(db *leveldb.DB, batch *leveldb.Batch) error {
+	if j == nil {
+		return nil
+	}
+	for idx := range j.chunks {
+		batch.Delete(append([]byte(keyActorDigest), idx...))
+		iter := db.NewIterator(util.BytesPrefix([]byte(idx)), nil)
+		for iter.Next() {
+			// Keys of the same position in another dimension share the
+			// prefix of an overworld index.
+			if _, n, ok := parseChunkKey(iter.Key()); ok && n == len(idx) {
+				batch.Delete(append([]byte(nil), iter.Key()...))
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	for k := range j.keys {
+		batch.Delete([]byte(k))
+	}
+	return nil
+}
+
+// worldWriter collects the keys of a single world and sends them to the
+// chunkWriter in records of about recordSize bytes.
+type worldWriter struct {
+	ctx   context.Context
+	w     *chunkWriter
+	world string
+	batch *leveldb.Batch
+
+	chunks    int
+	lastChunk iterKey
+}
+
+func newWorldWriter(ctx context.Context, w *chunkWriter, world string) *worldWriter {
+	return &worldWriter{ctx: ctx, w: w, world: world, batch: new(leveldb.Batch)}
+}
+
+// Put queues the key/value pair to be written on the next flush.
+func (w *worldWriter) Put(key, value []byte) {
+	w.batch.Put(key, value)
+}
+
+// Delete queues the deletion of a key, which may have been written by an
+// earlier flush.
+func (w *worldWriter) Delete(key []byte) {
+	w.batch.Delete(key)
+}
+
+// Len returns the number of bytes queued.
+func (w *worldWriter) Len() int {
+	return len(w.batch.Dump())
+}
+
+// chunkDone counts the chunk for progress reporting. Keys of the same chunk
+// are next to each other in key order, so a chunk with more than one version
+// key is only counted once.
+func (w *worldWriter) chunkDone(k iterKey) {
+	if w.lastChunk == k {
+		return
+	}
+	w.lastChunk = k
+	w.chunks++
+}
+
+// flush sends all queued pairs to the chunkWriter as a single record.
+func (w *worldWriter) flush() error {
+	if w.batch.Len() == 0 {
+		return nil
+	}
+	r := &chunkRecord{kind: recordChunk, world: w.world, batch: w.batch, chunks: w.chunks}
+	w.batch, w.chunks = new(leveldb.Batch), 0
+	return w.w.send(w.ctx, r)
+}
+
+// done tells the chunkWriter that the world has no more chunks.
+func (w *worldWriter) done() {
+	w.w.records <- &chunkRecord{kind: recordWorldDone, world: w.world}
+}
+
+// rollback discards all queued pairs and deletes every key that was already
+// written for the world.
+func (w *worldWriter) rollback() {
+	w.batch.Reset()
+	w.w.records <- &chunkRecord{kind: recordRollback, world: w.world}
+}
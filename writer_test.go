@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/df-mc/dragonfly/server/world"
+	"github.com/df-mc/dragonfly/server/world/mcdb"
+	"github.com/df-mc/goleveldb/leveldb"
+	"golang.org/x/sync/semaphore"
+)
+
+// testKeys returns the keys of a chunk with a sub chunk and an actor digest in
+// the dimension dim, and the key of the actor listed in it.
+func testKeys(pos world.ChunkPos, dim world.Dimension, uid byte) [][]byte {
+	index := key_index(pos, dim)
+	return [][]byte{
+		append(index, keyVersion),
+		append(index, keySubChunkData, 0),
+		append([]byte(keyActorDigest), index...),
+		append([]byte(keyActorPrefix), uid, 0, 0, 0, 0, 0, 0, 0),
+	}
+}
+
+// TestChunkWriterRollback checks that rolling back a world deletes every key
+// it wrote, including keys deleted after writing them, and nothing of the
+// other worlds, even at the same position in another dimension.
+func TestChunkWriterRollback(t *testing.T) {
+	db, err := mcdb.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	errs := newErrorCollector(policySkipWorld)
+	w := newChunkWriter(db.LDB(), 1<<20, 1<<20, newProgress(progressNone), errs)
+
+	kept := testKeys(world.ChunkPos{1, 2}, world.Nether, 1)
+	failed := append(testKeys(world.ChunkPos{1, 2}, world.Overworld, 2), testKeys(world.ChunkPos{3, 4}, world.Overworld, 3)...)
+	ok := newWorldWriter(errs.Context(), w, "ok")
+	for _, k := range kept {
+		ok.Put(k, []byte{1})
+	}
+	bad := newWorldWriter(errs.Context(), w, "bad")
+	for _, k := range failed {
+		bad.Put(k, []byte{1})
+	}
+	// Written by an earlier flush, then deleted.
+	if err := bad.flush(); err != nil {
+		t.Fatal(err)
+	}
+	bad.Delete(failed[3])
+	if err := ok.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bad.flush(); err != nil {
+		t.Fatal(err)
+	}
+	ok.done()
+	bad.rollback()
+	bad.done()
+	w.Close()
+
+	for _, k := range kept {
+		if found, _ := db.LDB().Has(k, nil); !found {
+			t.Errorf("key %x of another world was deleted", k)
+		}
+	}
+	for _, k := range failed {
+		if found, _ := db.LDB().Has(k, nil); found {
+			t.Errorf("key %x of the rolled back world is left", k)
+		}
+	}
+	if len(w.journal) != 0 {
+		t.Errorf("%d journals left after all worlds are done", len(w.journal))
+	}
+}
+
+// TestChunkWriterCancel checks that the pending batch is dropped rather than
+// written once the merge was stopped.
+func TestChunkWriterCancel(t *testing.T) {
+	db, err := mcdb.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	errs := newErrorCollector(policyFailFast)
+	// The writer isn't started, so that the record stays in its batch.
+	w := &chunkWriter{
+		db:        db.LDB(),
+		batchSize: 1 << 20,
+		maxMemory: 1 << 20,
+		mem:       semaphore.NewWeighted(1 << 20),
+		prog:      newProgress(progressNone),
+		errs:      errs,
+		batch:     new(leveldb.Batch),
+	}
+	batch := new(leveldb.Batch)
+	keys := testKeys(world.ChunkPos{}, world.Overworld, 1)
+	for _, k := range keys {
+		batch.Put(k, []byte{1})
+	}
+	if err := w.handle(&chunkRecord{kind: recordChunk, world: "world", batch: batch}); err != nil {
+		t.Fatal(err)
+	}
+	errs.worldError("other", errors.New("failed"))
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if found, _ := db.LDB().Has(k, nil); found {
+			t.Errorf("key %x was written after the merge was stopped", k)
+		}
+	}
+}
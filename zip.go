@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// skipZipFiles are the files of a world that are left out of an archive. The
+// lock and log of the LevelDB are only used while the database is open.
+var skipZipFiles = map[string]bool{"db/LOCK": true, "db/LOG": true, "db/LOG.old": true}
+
+// zipEntry is a file of a folder compressed for an archive by ZipFolder.
+type zipEntry struct {
+	header *zip.FileHeader
+	// path is the temporary file holding the compressed data.
+	path string
+	err  error
+}
+
+// ZipFolder writes all files in folder to the archive filename. Up to workers
+// files are compressed at the same time with the flate compression level, or
+// stored if level is 0. Every file is streamed into a temporary file next to
+// filename, so that no file is ever held in memory as a whole. The archive is
+// written to a temporary file as well and only replaces filename once all files
+// were written.
+func ZipFolder(filename, folder string, level, workers int) (err error) {
+	var files []string
+	err = filepath.WalkDir(folder, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(folder, p)
+		if err != nil {
+			return err
+		}
+		if !skipZipFiles[filepath.ToSlash(rel)] {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(filename), ".zip-")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		os.RemoveAll(tmpDir)
+	}()
+
+	// Files are compressed in any order but written in the order of files.
+	// sem holds a slot for every compressed file that wasn't written yet, so
+	// that at most workers temporary files exist at the same time.
+	entries := make([]chan zipEntry, len(files))
+	for i := range entries {
+		entries[i] = make(chan zipEntry, 1)
+	}
+	sem := make(chan struct{}, workers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, rel := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(i int, rel string) {
+				defer wg.Done()
+				tmp := filepath.Join(tmpDir, strconv.Itoa(i))
+				h, err := compressFile(filepath.Join(folder, rel), tmp, level)
+				if h != nil {
+					h.Name = filepath.ToSlash(rel)
+				}
+				entries[i] <- zipEntry{header: h, path: tmp, err: err}
+			}(i, rel)
+		}
+	}()
+
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(filename + ".tmp")
+		}
+	}()
+	zw := zip.NewWriter(f)
+	for i, rel := range files {
+		e := <-entries[i]
+		if e.err != nil {
+			return fmt.Errorf("compress %s: %w", rel, e.err)
+		}
+		if err := copyZipEntry(zw, e); err != nil {
+			return fmt.Errorf("write %s: %w", rel, err)
+		}
+		<-sem
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// compressFile compresses the file src into dst and returns the header of the
+// entry with its sizes and checksum set.
+func compressFile(src, dst string, level int) (*zip.FileHeader, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	h := &zip.FileHeader{Method: zip.Store}
+	crc := crc32.NewIEEE()
+	counter := &countingWriter{w: out}
+	var n int64
+	if level == 0 {
+		n, err = io.Copy(io.MultiWriter(counter, crc), in)
+	} else {
+		h.Method = zip.Deflate
+		var fw *flate.Writer
+		if fw, err = flate.NewWriter(counter, level); err != nil {
+			return nil, err
+		}
+		if n, err = io.Copy(io.MultiWriter(fw, crc), in); err == nil {
+			err = fw.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.CRC32 = crc.Sum32()
+	h.UncompressedSize64 = uint64(n)
+	h.CompressedSize64 = uint64(counter.n)
+	return h, out.Close()
+}
+
+// copyZipEntry writes the compressed entry e to zw and removes its temporary
+// file.
+func copyZipEntry(zw *zip.Writer, e zipEntry) error {
+	w, err := zw.CreateRaw(e.header)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(e.path)
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// TestZipFolder checks that an archive of a world written with several
+// workers is the same as one written with a single worker, holds the files in
+// the order they were walked in and unpacks to the files of the world.
+func TestZipFolder(t *testing.T) {
+	in := writeTestWorlds(t, testWorlds[:1])
+	cacheDir = t.TempDir()
+	dir, err := extractWorld(filepath.ToSlash(filepath.Join(in, filepath.FromSlash(testWorlds[0].name)+".mcworld")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A large file walked first, so that the files after it are compressed
+	// before it with more than one worker, and files left out of archives.
+	r := rand.New(rand.NewSource(1))
+	large := make([]byte, 4<<20)
+	r.Read(large)
+	for name, data := range map[string][]byte{"a_large": large, "db/LOCK": nil, "db/LOG": []byte("log")} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, level := range []int{0, flate.BestSpeed} {
+		var first []byte
+		for _, workers := range []int{1, 4, 16} {
+			filename := filepath.Join(t.TempDir(), "world.mcworld")
+			if err := ZipFolder(filename, dir, level, workers); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = data
+			} else if !bytes.Equal(data, first) {
+				t.Errorf("level %d: archive written by %d workers differs from the one by a single worker", level, workers)
+			}
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			if skipZipFiles[f.Name] {
+				t.Errorf("level %d: %s is in the archive", level, f.Name)
+			}
+		}
+		if !sort.StringsAreSorted(names) || names[0] != "a_large" {
+			t.Errorf("level %d: entries %q aren't in the order they were walked in", level, names)
+		}
+
+		filename := filepath.Join(t.TempDir(), "world.mcworld")
+		if err := os.WriteFile(filename, first, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		dest := t.TempDir()
+		if err := UnpackZip(filename, dest, func(string) bool { return true }, defaultZipLimits); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			want, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name))); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("level %d: %s unpacked to %d bytes, %v, want %d bytes", level, name, len(got), err, len(want))
+			}
+		}
+	}
+}